@@ -0,0 +1,479 @@
+// Package admission bounds the number of keys a database engine holds, and the memory they take up.
+// A Tracker decides whether a new key is admitted and which keys are evicted to make room for it,
+// so that a flood of new keys cannot grow the database until the keys expire.
+package admission
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrFull is returned by the engines for new keys that cannot be admitted when the fallback is Deny.
+var ErrFull = errors.New("database is full")
+
+// DefaultRecordBytes is the estimated size of a record besides its key: the tree nodes or map entry
+// holding it, its entries in the indexes and the data of a rate limiter bucket.
+const DefaultRecordBytes = 256
+
+// Sizer is implemented by data whose size varies. A record whose data implements it is estimated at
+// RecordBytes plus the bytes it reports, once it is stored.
+type Sizer interface {
+	Bytes() int64
+}
+
+// DataBytes returns the bytes the data reports if it is a Sizer, and zero otherwise.
+func DataBytes(data any) int64 {
+	if sizer, ok := data.(Sizer); ok {
+		return sizer.Bytes()
+	}
+	return 0
+}
+
+// Policy decides which keys are evicted to make room for new ones.
+type Policy int
+
+const (
+	// LRU evicts the least recently used keys, and always admits new keys.
+	LRU Policy = iota
+	// LFU evicts the least frequently used keys, the least recently used first among equals. A new
+	// key is only admitted if the keys evicted for it were used no more than once, so that a flood
+	// of new keys cannot push out the keys in regular use. Frequencies are halved as traffic goes by,
+	// so that keys no longer in use become evictable.
+	LFU
+	// Expiry evicts the keys expiring soonest, those that never expire last, and always admits new
+	// keys.
+	Expiry
+)
+
+// String returns the name ParsePolicy accepts for the policy.
+func (p Policy) String() string {
+	switch p {
+	case LRU:
+		return "lru"
+	case LFU:
+		return "lfu"
+	case Expiry:
+		return "expiry"
+	default:
+		return fmt.Sprintf("Policy(%d)", int(p))
+	}
+}
+
+// ParsePolicy parses "lru", "lfu" or "expiry".
+func ParsePolicy(s string) (Policy, error) {
+	switch strings.ToLower(s) {
+	case "lru":
+		return LRU, nil
+	case "lfu":
+		return LFU, nil
+	case "expiry":
+		return Expiry, nil
+	default:
+		return LRU, fmt.Errorf("unknown eviction policy %q", s)
+	}
+}
+
+// Fallback decides what happens to the new keys a Tracker cannot admit.
+type Fallback int
+
+const (
+	// Allow runs the callback against the zero value of a key that cannot be admitted, and returns
+	// its result without storing its data.
+	Allow Fallback = iota
+	// Deny fails the operation with ErrFull, without running the callback.
+	Deny
+)
+
+// String returns the name ParseFallback accepts for the fallback.
+func (f Fallback) String() string {
+	switch f {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	default:
+		return fmt.Sprintf("Fallback(%d)", int(f))
+	}
+}
+
+// ParseFallback parses "allow" or "deny".
+func ParseFallback(s string) (Fallback, error) {
+	switch strings.ToLower(s) {
+	case "allow":
+		return Allow, nil
+	case "deny":
+		return Deny, nil
+	default:
+		return Allow, fmt.Errorf("unknown fallback %q", s)
+	}
+}
+
+// Limits bounds a database. A non-positive MaxKeys or MaxBytes leaves that dimension unbounded, and
+// a non-positive RecordBytes means DefaultRecordBytes.
+type Limits struct {
+	MaxKeys     int   // MaxKeys is the largest number of keys held.
+	MaxBytes    int64 // MaxBytes is the largest estimated size of the keys held, in bytes.
+	RecordBytes int64 // RecordBytes is the estimated size of a record besides its key.
+	Policy      Policy
+	Fallback    Fallback
+}
+
+// Stats describes a Tracker.
+type Stats struct {
+	Keys      int   // Keys is the number of keys tracked.
+	Bytes     int64 // Bytes is the estimated size of the keys tracked.
+	Evictions int64 // Evictions counts the keys chosen for eviction to make room for new ones.
+	Refusals  int64 // Refusals counts the new keys that could not be admitted.
+}
+
+// Tracker keeps track of the keys of a database and how they are used, and picks the keys to evict
+// when new keys need room. The engines tell it about every key they store or remove; membership is
+// what the Tracker believes, and the engines act on its decisions. It is safe for concurrent use.
+type Tracker struct {
+	lock      sync.Mutex
+	limits    Limits
+	entries   entries
+	positions map[string]*entry
+	bytes     int64
+	tick      uint64 // tick orders uses by recency.
+	touches   int    // touches counts the uses since frequencies were last halved.
+	evictions int64
+	refusals  int64
+}
+
+// entry is a tracked key. Its position in the heap is kept up to date so that it can be moved or
+// removed without a search.
+type entry struct {
+	key       string
+	bytes     int64
+	lastUsed  uint64
+	uses      int
+	expiresAt time.Time
+	position  int
+}
+
+// NewTracker returns an empty Tracker enforcing the limits.
+func NewTracker(limits Limits) *Tracker {
+	if limits.RecordBytes <= 0 {
+		limits.RecordBytes = DefaultRecordBytes
+	}
+
+	t := &Tracker{limits: limits, positions: map[string]*entry{}}
+	t.entries.policy = limits.Policy
+	return t
+}
+
+// Fallback returns what happens to the keys the Tracker cannot admit.
+func (t *Tracker) Fallback() Fallback {
+	return t.limits.Fallback
+}
+
+// Admit makes room for the keys that are not tracked yet. It returns the keys to evict, which are no
+// longer tracked, and the keys that could not be admitted. The admitted keys are tracked from now
+// on, but count as unused until they are touched. With the Deny fallback the keys are admitted
+// together: if any of them is refused, nothing changes and ErrFull is returned.
+func (t *Tracker) Admit(keys ...string) ([]string, []string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var victims []*entry
+	var admitted []*entry
+	var refused []string
+	keyCount, bytes := len(t.entries.list), t.bytes
+
+	for _, key := range keys {
+		if _, ok := t.positions[key]; ok || t.pending(admitted, key) {
+			continue
+		}
+
+		e := &entry{key: key, bytes: int64(len(key)) + t.limits.RecordBytes}
+		taken := []*entry{}
+		for !t.fits(keyCount+1, bytes+e.bytes) {
+			victim := t.victim()
+			if victim == nil {
+				break
+			}
+			taken = append(taken, victim)
+			keyCount--
+			bytes -= victim.bytes
+		}
+
+		if !t.fits(keyCount+1, bytes+e.bytes) {
+			// Keys evicted for nothing would only be missed
+			t.restore(taken)
+			keyCount, bytes = keyCount+len(taken), bytes+sum(taken)
+			refused = append(refused, key)
+
+			if t.limits.Fallback == Deny {
+				t.restore(victims)
+				t.refusals++
+				return nil, refused, ErrFull
+			}
+			continue
+		}
+
+		victims = append(victims, taken...)
+		admitted = append(admitted, e)
+		keyCount++
+		bytes += e.bytes
+	}
+
+	for _, e := range admitted {
+		t.tick++
+		e.lastUsed = t.tick
+		t.positions[e.key] = e
+		t.bytes += e.bytes
+		heap.Push(&t.entries, e)
+	}
+
+	evicted := make([]string, 0, len(victims))
+	for _, victim := range victims {
+		evicted = append(evicted, victim.key)
+	}
+	t.evictions += int64(len(victims))
+	t.refusals += int64(len(refused))
+
+	return evicted, refused, nil
+}
+
+// restore tracks the victims again. The caller must hold the lock.
+func (t *Tracker) restore(victims []*entry) {
+	for _, victim := range victims {
+		t.positions[victim.key] = victim
+		t.bytes += victim.bytes
+		heap.Push(&t.entries, victim)
+	}
+}
+
+// sum returns the bytes of the entries.
+func sum(list []*entry) int64 {
+	var bytes int64
+	for _, e := range list {
+		bytes += e.bytes
+	}
+	return bytes
+}
+
+// pending reports whether the key is among the entries about to be admitted.
+func (t *Tracker) pending(admitted []*entry, key string) bool {
+	for _, e := range admitted {
+		if e.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// fits reports whether the given number of keys and bytes are within the limits.
+func (t *Tracker) fits(keys int, bytes int64) bool {
+	if t.limits.MaxKeys > 0 && keys > t.limits.MaxKeys {
+		return false
+	}
+	return t.limits.MaxBytes <= 0 || bytes <= t.limits.MaxBytes
+}
+
+// victim untracks and returns the key the policy evicts first, or nil if there is none the policy
+// is willing to evict. The caller must hold the lock.
+func (t *Tracker) victim() *entry {
+	if len(t.entries.list) == 0 {
+		return nil
+	}
+
+	// A key in regular use is worth more than a new one
+	if t.limits.Policy == LFU && t.entries.list[0].uses > 1 {
+		return nil
+	}
+
+	victim, _ := heap.Pop(&t.entries).(*entry)
+	delete(t.positions, victim.key)
+	t.bytes -= victim.bytes
+
+	return victim
+}
+
+// Touch records a use of the key, when its data now expires and how many bytes the data takes up
+// beyond RecordBytes, as reported by DataBytes. A key that is not tracked, because it was stored
+// without being admitted or was evicted while in use, is tracked again. A key that grows is not
+// evicted for it, but makes room for the next keys admitted.
+func (t *Tracker) Touch(key string, expiresAt time.Time, dataBytes int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	e, ok := t.positions[key]
+	if !ok {
+		e = &entry{key: key}
+		t.positions[key] = e
+		heap.Push(&t.entries, e)
+	}
+
+	bytes := int64(len(key)) + t.limits.RecordBytes + max(0, dataBytes)
+	t.bytes += bytes - e.bytes
+	e.bytes = bytes
+
+	t.tick++
+	e.lastUsed = t.tick
+	e.uses++
+	e.expiresAt = expiresAt
+	heap.Fix(&t.entries, e.position)
+
+	if t.limits.Policy == LFU {
+		t.age()
+	}
+}
+
+// age halves every frequency once there have been ten uses for each key tracked, or a thousand,
+// whichever is more. The caller must hold the lock.
+func (t *Tracker) age() {
+	t.touches++
+	if t.touches < max(10*len(t.entries.list), 1000) {
+		return
+	}
+
+	t.touches = 0
+	for _, e := range t.entries.list {
+		e.uses /= 2
+	}
+	// Halving keeps the order of the frequencies, but not of the ties broken by recency
+	heap.Init(&t.entries)
+}
+
+// Remove stops tracking the key, if it is tracked.
+func (t *Tracker) Remove(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	e, ok := t.positions[key]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&t.entries, e.position)
+	delete(t.positions, key)
+	t.bytes -= e.bytes
+}
+
+// Tracked reports whether the key is tracked. The engines check it before evicting a key, under the
+// same lock they hold to touch it, so that a key used since it was picked is not evicted after all.
+func (t *Tracker) Tracked(key string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	_, ok := t.positions[key]
+	return ok
+}
+
+// Trim evicts keys until the tracked keys are within the limits, whatever the policy, and returns
+// them. It is used when a database is restored with more keys than the limits allow.
+func (t *Tracker) Trim() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var evicted []string
+	for len(t.entries.list) > 0 && !t.fits(len(t.entries.list), t.bytes) {
+		e, _ := heap.Pop(&t.entries).(*entry)
+		delete(t.positions, e.key)
+		t.bytes -= e.bytes
+		evicted = append(evicted, e.key)
+	}
+
+	t.evictions += int64(len(evicted))
+	return evicted
+}
+
+// Reset stops tracking every key.
+func (t *Tracker) Reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.entries.list = nil
+	t.positions = map[string]*entry{}
+	t.bytes = 0
+	t.touches = 0
+}
+
+// Staged returns an empty Tracker with the same limits, in which the keys of a database being
+// restored are tracked until Replace swaps them in.
+func (t *Tracker) Staged() *Tracker {
+	return NewTracker(t.limits)
+}
+
+// Replace stops tracking every key, and tracks the keys of staged instead. The evictions and refusals
+// of staged, such as those of its Trim, are added to the Tracker's. Staged must not be used after.
+func (t *Tracker) Replace(staged *Tracker) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	staged.lock.Lock()
+	defer staged.lock.Unlock()
+
+	t.entries.list = staged.entries.list
+	t.positions = staged.positions
+	t.bytes = staged.bytes
+	t.tick = staged.tick
+	t.touches = staged.touches
+	t.evictions += staged.evictions
+	t.refusals += staged.refusals
+}
+
+// Stats describes the Tracker.
+func (t *Tracker) Stats() Stats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return Stats{
+		Keys:      len(t.entries.list),
+		Bytes:     t.bytes,
+		Evictions: t.evictions,
+		Refusals:  t.refusals,
+	}
+}
+
+// entries implements heap.Interface, ordering the keys by the policy, the next to evict first.
+type entries struct {
+	list   []*entry
+	policy Policy
+}
+
+func (h *entries) Len() int { return len(h.list) }
+
+func (h *entries) Less(i, j int) bool {
+	a, b := h.list[i], h.list[j]
+
+	switch h.policy {
+	case LFU:
+		if a.uses != b.uses {
+			return a.uses < b.uses
+		}
+	case Expiry:
+		// Keys that never expire go last
+		if !a.expiresAt.Equal(b.expiresAt) {
+			return !a.expiresAt.IsZero() && (b.expiresAt.IsZero() || a.expiresAt.Before(b.expiresAt))
+		}
+	case LRU:
+	}
+
+	return a.lastUsed < b.lastUsed
+}
+
+func (h *entries) Swap(i, j int) {
+	h.list[i], h.list[j] = h.list[j], h.list[i]
+	h.list[i].position = i
+	h.list[j].position = j
+}
+
+func (h *entries) Push(x any) {
+	e, _ := x.(*entry)
+	e.position = len(h.list)
+	h.list = append(h.list, e)
+}
+
+func (h *entries) Pop() any {
+	old := h.list
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	h.list = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,245 @@
+//nolint:testpackage // Allow tests to access the admission package
+package admission
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fill admits and touches the keys "0" to "n-1" in order.
+func fill(t *testing.T, tracker *Tracker, n int, expiresAt func(i int) time.Time) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		if _, refused, err := tracker.Admit(key); err != nil || len(refused) > 0 {
+			t.Fatalf("Expected %s to be admitted, got %v, %v", key, refused, err)
+		}
+		tracker.Touch(key, expiresAt(i), 0)
+	}
+}
+
+func never(_ int) time.Time { return time.Time{} }
+
+func TestLRU(t *testing.T) {
+	tracker := NewTracker(Limits{MaxKeys: 3, Policy: LRU})
+	fill(t, tracker, 3, never)
+
+	// Using 0 again makes 1 the least recently used
+	tracker.Touch("0", time.Time{}, 0)
+
+	victims, refused, err := tracker.Admit("3", "4")
+	if err != nil || len(refused) > 0 {
+		t.Fatalf("Unexpected refusal: %v, %v", refused, err)
+	}
+	if !slices.Equal(victims, []string{"1", "2"}) {
+		t.Errorf("Expected 1 and 2 to be evicted, got %v", victims)
+	}
+
+	for key, tracked := range map[string]bool{"0": true, "1": false, "2": false, "3": true, "4": true} {
+		if tracker.Tracked(key) != tracked {
+			t.Errorf("Expected %s tracked to be %v", key, tracked)
+		}
+	}
+
+	// Keys already tracked need no room
+	if victims, _, _ = tracker.Admit("0", "3"); len(victims) > 0 {
+		t.Errorf("Expected no evictions for tracked keys, got %v", victims)
+	}
+}
+
+func TestLFU(t *testing.T) {
+	tracker := NewTracker(Limits{MaxKeys: 3, Policy: LFU})
+	fill(t, tracker, 3, never)
+
+	// 0 and 2 are in regular use
+	tracker.Touch("0", time.Time{}, 0)
+	tracker.Touch("2", time.Time{}, 0)
+
+	victims, refused, err := tracker.Admit("3")
+	if err != nil || len(refused) > 0 || !slices.Equal(victims, []string{"1"}) {
+		t.Fatalf("Expected 1 to be evicted for 3, got %v, %v, %v", victims, refused, err)
+	}
+
+	// Once 3 is in regular use too, there is no room for new keys
+	tracker.Touch("3", time.Time{}, 0)
+	tracker.Touch("3", time.Time{}, 0)
+
+	victims, refused, err = tracker.Admit("4")
+	if err != nil || len(victims) > 0 || !slices.Equal(refused, []string{"4"}) {
+		t.Fatalf("Expected 4 to be refused, got %v, %v, %v", victims, refused, err)
+	}
+
+	stats := tracker.Stats()
+	if stats.Keys != 3 || stats.Evictions != 1 || stats.Refusals != 1 {
+		t.Errorf("Expected 3 keys, 1 eviction and 1 refusal, got %+v", stats)
+	}
+}
+
+func TestLFUAging(t *testing.T) {
+	tracker := NewTracker(Limits{MaxKeys: 2, Policy: LFU})
+	fill(t, tracker, 2, never)
+	tracker.Touch("0", time.Time{}, 0)
+	tracker.Touch("1", time.Time{}, 0)
+
+	if _, refused, _ := tracker.Admit("2"); len(refused) != 1 {
+		t.Fatalf("Expected 2 to be refused while 0 and 1 are in regular use")
+	}
+
+	// Enough traffic on 0 halves the frequencies until 1 is no longer in regular use
+	for i := 0; i < 2000; i++ {
+		tracker.Touch("0", time.Time{}, 0)
+	}
+
+	victims, refused, err := tracker.Admit("2")
+	if err != nil || len(refused) > 0 || !slices.Equal(victims, []string{"1"}) {
+		t.Errorf("Expected 1 to be evicted for 2, got %v, %v, %v", victims, refused, err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	start := time.Now()
+	tracker := NewTracker(Limits{MaxKeys: 4, Policy: Expiry})
+
+	// 0 never expires, 1 expires last and 3 first
+	fill(t, tracker, 4, func(i int) time.Time {
+		if i == 0 {
+			return time.Time{}
+		}
+		return start.Add(time.Duration(10-i) * time.Second)
+	})
+
+	victims, _, _ := tracker.Admit("4", "5", "6")
+	if !slices.Equal(victims, []string{"3", "2", "1"}) {
+		t.Errorf("Expected 3, 2 then 1 to be evicted, got %v", victims)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	tracker := NewTracker(Limits{MaxBytes: 30, RecordBytes: 10, Policy: LRU})
+
+	// Each key takes up its length and the record bytes
+	fill(t, tracker, 2, never)
+	if stats := tracker.Stats(); stats.Bytes != 22 {
+		t.Fatalf("Expected 22 bytes, got %d", stats.Bytes)
+	}
+
+	victims, _, _ := tracker.Admit("a-longer-key")
+	if !slices.Equal(victims, []string{"0", "1"}) {
+		t.Errorf("Expected both keys to be evicted for the long one, got %v", victims)
+	}
+
+	// A key that could never fit is refused without evicting anything
+	victims, refused, _ := tracker.Admit("a-key-longer-than-the-limit")
+	if len(victims) > 0 || len(refused) != 1 || !tracker.Tracked("a-longer-key") {
+		t.Errorf("Expected the key to be refused and nothing evicted, got %v, %v", victims, refused)
+	}
+}
+
+// sized is data that reports its own size.
+type sized int64
+
+func (s sized) Bytes() int64 { return int64(s) }
+
+func TestDataBytes(t *testing.T) {
+	tracker := NewTracker(Limits{MaxBytes: 100, RecordBytes: 10, Policy: LRU})
+	fill(t, tracker, 2, never)
+
+	// The data of key 0 grows, and the next key admitted needs its room
+	tracker.Touch("0", time.Time{}, DataBytes(sized(80)))
+	if stats := tracker.Stats(); stats.Bytes != 102 {
+		t.Fatalf("Expected 102 bytes, got %d", stats.Bytes)
+	}
+
+	if victims, _, _ := tracker.Admit("2"); !slices.Equal(victims, []string{"1", "0"}) {
+		t.Errorf("Expected both keys to be evicted, got %v", victims)
+	}
+
+	if DataBytes("unsized") != 0 {
+		t.Errorf("Expected data that is not a Sizer to take up no bytes")
+	}
+}
+
+func TestDenyFallback(t *testing.T) {
+	tracker := NewTracker(Limits{MaxKeys: 2, Policy: LFU, Fallback: Deny})
+	fill(t, tracker, 2, never)
+	tracker.Touch("1", time.Time{}, 0)
+
+	// There is room for 2 by evicting 0, but not for 3 as well, so neither is admitted
+	victims, refused, err := tracker.Admit("2", "3")
+	if !errors.Is(err, ErrFull) || len(victims) > 0 || !slices.Equal(refused, []string{"3"}) {
+		t.Fatalf("Expected ErrFull refusing 3, got %v, %v, %v", victims, refused, err)
+	}
+
+	if !tracker.Tracked("0") || !tracker.Tracked("1") || tracker.Tracked("2") {
+		t.Errorf("Expected nothing to change")
+	}
+}
+
+func TestTrim(t *testing.T) {
+	tracker := NewTracker(Limits{MaxKeys: 2, Policy: LRU})
+
+	// Restored keys are touched without being admitted
+	for i := 0; i < 5; i++ {
+		tracker.Touch(strconv.Itoa(i), time.Time{}, 0)
+	}
+
+	if evicted := tracker.Trim(); !slices.Equal(evicted, []string{"0", "1", "2"}) {
+		t.Errorf("Expected 0, 1 and 2 to be trimmed, got %v", evicted)
+	}
+
+	tracker.Remove("3")
+	if stats := tracker.Stats(); stats.Keys != 1 {
+		t.Errorf("Expected 1 key, got %d", stats.Keys)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	tracker := NewTracker(Limits{MaxKeys: 2, Policy: LRU})
+	tracker.Touch("old", time.Time{}, 0)
+
+	// The old key stays tracked until the restored keys are swapped in
+	staged := tracker.Staged()
+	for i := 0; i < 3; i++ {
+		staged.Touch(strconv.Itoa(i), time.Time{}, 0)
+	}
+	staged.Trim()
+	if !tracker.Tracked("old") || tracker.Tracked("1") {
+		t.Errorf("Expected only the old key to be tracked before the replacement")
+	}
+
+	tracker.Replace(staged)
+	if tracker.Tracked("old") || !tracker.Tracked("1") || !tracker.Tracked("2") {
+		t.Errorf("Expected only the staged keys to be tracked after the replacement")
+	}
+	if stats := tracker.Stats(); stats.Keys != 2 || stats.Evictions != 1 {
+		t.Errorf("Expected 2 keys and 1 eviction, got %+v", stats)
+	}
+
+	// The limits still hold
+	if victims, _, err := tracker.Admit("3"); err != nil || !slices.Equal(victims, []string{"1"}) {
+		t.Errorf("Expected 1 to make room for 3, got %v, error: %v", victims, err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, policy := range []Policy{LRU, LFU, Expiry} {
+		if parsed, err := ParsePolicy(policy.String()); err != nil || parsed != policy {
+			t.Errorf("Expected %v to parse, got %v, %v", policy, parsed, err)
+		}
+	}
+	for _, fallback := range []Fallback{Allow, Deny} {
+		if parsed, err := ParseFallback(fallback.String()); err != nil || parsed != fallback {
+			t.Errorf("Expected %v to parse, got %v, %v", fallback, parsed, err)
+		}
+	}
+	if _, err := ParsePolicy("fifo"); err == nil {
+		t.Errorf("Expected an unknown policy to fail")
+	}
+	if _, err := ParseFallback("maybe"); err == nil {
+		t.Errorf("Expected an unknown fallback to fail")
+	}
+}
@@ -1 +1,636 @@
-package concurrent
\ No newline at end of file
+// Package concurrent provides a lock-striped hash map implementation of the rate limiter store.
+// Keys are spread over a fixed number of shards, each guarded by its own mutex, which gives O(1)
+// point lookups without the BST/AVL switchover used by the naive engine.
+package concurrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dominicfollett/argus-db/database/admission"
+	"github.com/dominicfollett/argus-db/database/expiry"
+	"github.com/dominicfollett/argus-db/database/snapshot"
+	"github.com/dominicfollett/argus-db/database/wal"
+)
+
+// DefaultShards is the number of shards used when none is configured.
+const DefaultShards = 32
+
+// DefaultSweepInterval is how often the eviction sweeper visits every shard.
+const DefaultSweepInterval = 1 * time.Second
+
+// shard is a single stripe of the hash map.
+type shard[D any] struct {
+	lock    sync.Mutex
+	records map[string]D
+	expiry  *expiry.Index[D]   // expiry orders the shard's keys by expiry time, if expiresAt is set.
+	limiter *admission.Tracker // limiter is the DB's tracker, if it is bounded.
+}
+
+// store sets the key's data, and its expiry time if the shard is indexed, and tells the tracker the
+// key was used. The caller must hold the shard's lock.
+func (s *shard[D]) store(key string, data D, expiresAt func(data D) time.Time) {
+	s.records[key] = data
+	if s.expiry != nil {
+		s.expiry.Set(key, expiresAt(data), data)
+	}
+	if s.limiter != nil {
+		var expires time.Time
+		if expiresAt != nil {
+			expires = expiresAt(data)
+		}
+		s.limiter.Touch(key, expires, admission.DataBytes(data))
+	}
+}
+
+// remove deletes the key. The caller must hold the shard's lock.
+func (s *shard[D]) remove(key string) {
+	delete(s.records, key)
+	if s.expiry != nil {
+		s.expiry.Remove(key)
+	}
+	if s.limiter != nil {
+		s.limiter.Remove(key)
+	}
+}
+
+type DB[D, P, R any] struct {
+	shards        []*shard[D]
+	sweepInterval time.Duration
+	callback      func(data D, params P) (D, R, error)
+	evict         func(data D) bool
+	expiresAt     func(data D) time.Time
+	codec         snapshot.Codec[D]
+	journal       wal.Journal[D]
+	limiter       *admission.Tracker // limiter bounds the keys held, if limits are set.
+	stopRoutine   context.CancelFunc
+	wg            *sync.WaitGroup
+	logger        *slog.Logger
+}
+
+// config holds the optional DB settings.
+type config struct {
+	shards        int
+	sweepInterval time.Duration
+	limits        *admission.Limits
+}
+
+// Option configures optional DB settings.
+type Option func(c *config)
+
+// WithShards sets the number of shards. Values smaller than one are ignored.
+func WithShards(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.shards = n
+		}
+	}
+}
+
+// WithSweepInterval sets how often the eviction sweeper runs. Non-positive values are ignored.
+func WithSweepInterval(interval time.Duration) Option {
+	return func(c *config) {
+		if interval > 0 {
+			c.sweepInterval = interval
+		}
+	}
+}
+
+// WithLimits bounds the number of keys held and their estimated size. New keys that need room evict
+// the keys the limits' policy picks, or are handled by its fallback if they cannot be admitted.
+func WithLimits(limits admission.Limits) Option {
+	return func(c *config) {
+		c.limits = &limits
+	}
+}
+
+func NewDB[D, P, R any](
+	callback func(data D, params P) (D, R, error),
+	evict func(data D) bool,
+	expiresAt func(data D) time.Time,
+	codec snapshot.Codec[D],
+	journal wal.Journal[D],
+	logger *slog.Logger,
+	opts ...Option) *DB[D, P, R] {
+	logger.Info("initializing concurrent DB...")
+
+	c := &config{
+		shards:        DefaultShards,
+		sweepInterval: DefaultSweepInterval,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	context, cancel := context.WithCancel(context.Background())
+
+	db := &DB[D, P, R]{
+		shards:        make([]*shard[D], c.shards),
+		sweepInterval: c.sweepInterval,
+		callback:      callback,
+		evict:         evict,
+		expiresAt:     expiresAt,
+		codec:         codec,
+		journal:       journal,
+		stopRoutine:   cancel,
+		wg:            &sync.WaitGroup{},
+		logger:        logger,
+	}
+
+	if c.limits != nil {
+		db.limiter = admission.NewTracker(*c.limits)
+	}
+
+	for i := range db.shards {
+		db.shards[i] = db.newShard()
+	}
+
+	// Start the eviction sweeper
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+
+		db.logger.Info("Starting eviction sweeper", "shards", len(db.shards))
+
+		ticker := time.NewTicker(db.sweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-context.Done():
+				db.logger.Info("Eviction sweeper stopped. Exiting")
+				return
+			case <-ticker.C:
+				db.sweep()
+			}
+		}
+	}()
+
+	return db
+}
+
+// Shutdown stops the eviction sweeper and waits for it to exit.
+func (db *DB[D, P, R]) Shutdown() {
+	db.logger.Info("terminating the eviction sweeper")
+	db.stopRoutine()
+
+	db.wg.Wait()
+	db.logger.Info("concurrent db shutdown complete")
+}
+
+// Calculate applies the callback to the data stored under key while holding the key's shard lock,
+// and stores the data returned by the callback, after appending it to the journal if there is one.
+// Shard locks are only ever held for the duration of a callback and an append, so the context is
+// only checked before the lock is taken.
+func (db *DB[D, P, R]) Calculate(ctx context.Context, key string, params P) (R, error) {
+	if err := ctx.Err(); err != nil {
+		var zero R
+		return zero, fmt.Errorf("concurrent db calculate: %w", err)
+	}
+
+	refused, err := db.admit(key)
+	if err != nil {
+		var zero R
+		return zero, err
+	}
+	if len(refused) > 0 {
+		// The key is treated as new, but not stored
+		var none D
+		_, result, err := db.callback(none, params)
+		return result, err
+	}
+
+	s := db.shardFor(key)
+
+	s.lock.Lock()
+	// We must absolutely unlock the shard before we return
+	defer s.lock.Unlock()
+
+	// Apply the callback defined by the user of this DB
+	data, result, err := db.callback(s.records[key], params)
+	if err != nil {
+		db.logger.Info("concurrent db calculate, callback function failed", "error", err)
+		return result, err
+	}
+
+	if err = db.record(wal.Record[D]{Key: key, Data: data}); err != nil {
+		var zero R
+		return zero, err
+	}
+
+	s.store(key, data, db.expiresAt)
+
+	return result, nil
+}
+
+// CalculateMany applies the callback to each key in turn, with the params at the same index.
+// Without commit, every key is calculated independently as by Calculate. With commit, the shards of
+// all the keys are locked together in ascending order, the callback runs against pending copies of
+// their data, and the new data is only stored if commit(results) returns true. The callback must then
+// return new values rather than mutate the data it is given. A key may appear more than once, in which
+// case each occurrence sees the data left by the one before. The boolean reports whether every result
+// was stored.
+func (db *DB[D, P, R]) CalculateMany(
+	ctx context.Context,
+	keys []string,
+	params []P,
+	commit func(results []R) bool,
+) ([]R, bool, error) {
+	if len(keys) != len(params) {
+		return nil, false, fmt.Errorf("concurrent db calculate many: %d keys but %d params", len(keys), len(params))
+	}
+
+	results := make([]R, len(keys))
+
+	if commit == nil {
+		for i, key := range keys {
+			result, err := db.Calculate(ctx, key, params[i])
+			if err != nil {
+				return results[:i], false, err
+			}
+			results[i] = result
+		}
+		return results, true, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, false, fmt.Errorf("concurrent db calculate many: %w", err)
+	}
+
+	// Keys that cannot be admitted are calculated as new keys, but not stored
+	refused, err := db.admit(keys...)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Lock each shard once, always in the same order to avoid deadlocks
+	indexes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		indexes = append(indexes, db.shardIndex(key))
+	}
+	slices.Sort(indexes)
+	indexes = slices.Compact(indexes)
+
+	for _, i := range indexes {
+		db.shards[i].lock.Lock()
+	}
+	// We must absolutely unlock the shards before we return
+	defer func() {
+		for _, i := range indexes {
+			db.shards[i].lock.Unlock()
+		}
+	}()
+
+	pending := make(map[string]D, len(keys))
+	for _, key := range keys {
+		pending[key] = db.shardFor(key).records[key]
+	}
+	for _, key := range refused {
+		var none D
+		pending[key] = none
+	}
+
+	for i, key := range keys {
+		data, result, err := db.callback(pending[key], params[i])
+		if err != nil {
+			db.logger.Info("concurrent db calculate many, callback function failed", "error", err)
+			return results, false, err
+		}
+
+		pending[key] = data
+		results[i] = result
+	}
+
+	if !commit(results) {
+		return results, false, nil
+	}
+
+	for _, key := range refused {
+		delete(pending, key)
+	}
+
+	records := make([]wal.Record[D], 0, len(pending))
+	for key, data := range pending {
+		records = append(records, wal.Record[D]{Key: key, Data: data})
+	}
+
+	if err := db.record(records...); err != nil {
+		return results, false, err
+	}
+
+	for key, data := range pending {
+		db.shardFor(key).store(key, data, db.expiresAt)
+	}
+
+	return results, true, nil
+}
+
+// Peek returns the data stored under key without applying the callback. The boolean reports
+// whether the key exists. Callers must treat the data as read-only.
+func (db *DB[D, P, R]) Peek(key string) (D, bool, error) {
+	s := db.shardFor(key)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, ok := s.records[key]
+	return data, ok, nil
+}
+
+// Delete removes the key and reports whether it existed.
+func (db *DB[D, P, R]) Delete(key string) (bool, error) {
+	s := db.shardFor(key)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.records[key]; !ok {
+		return false, nil
+	}
+
+	if err := db.record(wal.Record[D]{Key: key, Deleted: true}); err != nil {
+		return false, err
+	}
+
+	s.remove(key)
+
+	return true, nil
+}
+
+// admit makes room for the keys that are not stored yet, if the DB is bounded, by removing the keys
+// the tracker picks. A key used since it was picked is tracked again and left alone. admit returns
+// the keys that could not be admitted, or an error wrapping admission.ErrFull if the fallback is to
+// deny them. If the journal fails, the keys not yet removed are left, and tracked again when next
+// used. No shard lock may be held by the caller.
+func (db *DB[D, P, R]) admit(keys ...string) ([]string, error) {
+	if db.limiter == nil {
+		return nil, nil
+	}
+
+	victims, refused, err := db.limiter.Admit(keys...)
+	if err != nil {
+		return nil, fmt.Errorf("concurrent db admit: %w", err)
+	}
+
+	for _, victim := range victims {
+		s := db.shardFor(victim)
+
+		s.lock.Lock()
+		if _, ok := s.records[victim]; ok && !db.limiter.Tracked(victim) {
+			if err = db.record(wal.Record[D]{Key: victim, Deleted: true}); err != nil {
+				s.lock.Unlock()
+				return nil, err
+			}
+			s.remove(victim)
+		}
+		s.lock.Unlock()
+	}
+
+	if len(victims) > 0 {
+		db.logger.Debug("concurrent db, keys evicted to make room", "count", len(victims))
+	}
+	return refused, nil
+}
+
+// LimitStats describes the keys held by a bounded DB, and reports false if the DB is unbounded.
+func (db *DB[D, P, R]) LimitStats() (admission.Stats, bool) {
+	if db.limiter == nil {
+		return admission.Stats{}, false
+	}
+	return db.limiter.Stats(), true
+}
+
+// record appends the records to the journal, if there is one, before they are committed.
+func (db *DB[D, P, R]) record(records ...wal.Record[D]) error {
+	if db.journal == nil {
+		return nil
+	}
+
+	if err := db.journal.Append(records...); err != nil {
+		db.logger.Error("concurrent db could not journal changes", "error", err)
+		return fmt.Errorf("concurrent db journal: %w", err)
+	}
+	return nil
+}
+
+// Scan calls fn, in ascending key order, for up to limit keys in the range [start, end) until fn
+// returns false. An empty end leaves the range unbounded above and a limit of zero or less means no
+// limit. The hash map has no order of its own, so the matching records are gathered one shard at
+// a time and sorted before fn is called without any locks held.
+func (db *DB[D, P, R]) Scan(
+	ctx context.Context,
+	start string,
+	end string,
+	limit int,
+	fn func(key string, data D) bool,
+) error {
+	return db.scan(ctx, limit, fn, func(key string) bool {
+		return key >= start && (end == "" || key < end)
+	})
+}
+
+// ScanPrefix is like Scan over every key that starts with prefix.
+func (db *DB[D, P, R]) ScanPrefix(ctx context.Context, prefix string, limit int, fn func(key string, data D) bool) error {
+	return db.scan(ctx, limit, fn, func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// record is a key and its data gathered by a scan.
+type record[D any] struct {
+	key  string
+	data D
+}
+
+// scan calls fn in ascending key order for up to limit keys accepted by match.
+func (db *DB[D, P, R]) scan(
+	ctx context.Context,
+	limit int,
+	fn func(key string, data D) bool,
+	match func(key string) bool,
+) error {
+	records := []record[D]{}
+
+	for _, s := range db.shards {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("concurrent db scan: %w", err)
+		}
+
+		s.lock.Lock()
+		for key, data := range s.records {
+			if match(key) {
+				records = append(records, record[D]{key: key, data: data})
+			}
+		}
+		s.lock.Unlock()
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].key < records[j].key })
+
+	for i, r := range records {
+		if limit > 0 && i >= limit {
+			break
+		}
+		if !fn(r.key, r.data) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Snapshot writes every key and its data to w in the snapshot format, in ascending key order. Every
+// shard is locked until the snapshot has been written, so it is a point-in-time view of the database.
+func (db *DB[D, P, R]) Snapshot(w io.Writer) error {
+	sw, err := snapshot.NewWriter(w, db.codec)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range db.shards {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+	}
+
+	records := []record[D]{}
+	for _, s := range db.shards {
+		for key, data := range s.records {
+			records = append(records, record[D]{key: key, data: data})
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].key < records[j].key })
+
+	for _, r := range records {
+		if err = sw.Write(r.key, r.data); err != nil {
+			return err
+		}
+	}
+
+	return sw.Close()
+}
+
+// Restore replaces the contents of the database with the snapshot read from r, leaving out the
+// entries evict reports as expired. The snapshot is verified in full before anything is replaced.
+func (db *DB[D, P, R]) Restore(r io.Reader) error {
+	entries, err := snapshot.ReadAll(r, db.codec)
+	if err != nil {
+		return err
+	}
+
+	shards := make([]*shard[D], len(db.shards))
+	for i := range shards {
+		shards[i] = db.newShard()
+	}
+
+	if db.limiter != nil {
+		db.limiter.Reset()
+	}
+
+	restored := 0
+	for _, entry := range entries {
+		if db.evict(entry.Data) {
+			continue
+		}
+		shards[db.shardIndex(entry.Key)].store(entry.Key, entry.Data, db.expiresAt)
+		restored++
+	}
+
+	// The snapshot may hold more keys than the limits allow
+	trimmed := 0
+	if db.limiter != nil {
+		for _, key := range db.limiter.Trim() {
+			s := shards[db.shardIndex(key)]
+			delete(s.records, key)
+			if s.expiry != nil {
+				s.expiry.Remove(key)
+			}
+			trimmed++
+		}
+	}
+
+	for i, s := range db.shards {
+		s.lock.Lock()
+		s.records = shards[i].records
+		s.expiry = shards[i].expiry
+		s.lock.Unlock()
+	}
+
+	db.logger.Info("concurrent db restored from snapshot",
+		"restored", restored-trimmed, "expired", len(entries)-restored, "trimmed", trimmed)
+	return nil
+}
+
+// sweep visits each shard in turn and removes the records for which evict returns true. Indexed
+// shards only hand evict the records whose expiry time has passed; a record evict declines then
+// stays until it is next updated.
+func (db *DB[D, P, R]) sweep() {
+	evicted := 0
+	now := time.Now()
+
+	for _, s := range db.shards {
+		s.lock.Lock()
+		if s.expiry != nil {
+			for key, data, ok := s.expiry.Pop(now); ok; key, data, ok = s.expiry.Pop(now) {
+				if db.evict(data) {
+					s.remove(key)
+					evicted++
+				}
+			}
+		} else {
+			for key, data := range s.records {
+				if db.evict(data) {
+					s.remove(key)
+					evicted++
+				}
+			}
+		}
+		s.lock.Unlock()
+	}
+
+	if evicted > 0 {
+		db.logger.Debug("eviction sweeper, records evicted", "count", evicted)
+	}
+}
+
+// newShard returns an empty shard, indexed by expiry time if expiresAt is set, and sharing the DB's
+// tracker if it is bounded.
+func (db *DB[D, P, R]) newShard() *shard[D] {
+	s := &shard[D]{records: map[string]D{}, limiter: db.limiter}
+	if db.expiresAt != nil {
+		s.expiry = expiry.NewIndex[D]()
+	}
+	return s
+}
+
+// shardFor returns the shard responsible for the given key.
+func (db *DB[D, P, R]) shardFor(key string) *shard[D] {
+	return db.shards[db.shardIndex(key)]
+}
+
+// shardIndex returns the index of the shard responsible for the given key.
+func (db *DB[D, P, R]) shardIndex(key string) int {
+	return int(fnv32a(key) % uint32(len(db.shards)))
+}
+
+// fnv32a computes the 32-bit FNV-1a hash of the key without allocating.
+func fnv32a(key string) uint32 {
+	const offset32 = 2166136261
+	const prime32 = 16777619
+
+	hash := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= prime32
+	}
+
+	return hash
+}
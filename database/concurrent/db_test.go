@@ -0,0 +1,371 @@
+//nolint:testpackage // Allow tests to access the concurrent package
+package concurrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dominicfollett/argus-db/database/admission"
+)
+
+type counter struct {
+	count     int
+	expiresAt time.Time
+}
+
+func testCallback(c *counter, _ struct{}) (*counter, int, error) {
+	if c == nil {
+		c = &counter{}
+	}
+	c.count++
+	c.expiresAt = time.Now().Add(50 * time.Millisecond)
+
+	return c, c.count, nil
+}
+
+func testEvict(c *counter) bool {
+	return time.Since(c.expiresAt) >= 0
+}
+
+func newTestDB(opts ...Option) *DB[*counter, struct{}, int] {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return NewDB(testCallback, testEvict, nil, nil, nil, logger, opts...)
+}
+
+func TestCalculate(t *testing.T) {
+	db := newTestDB(WithShards(4))
+	defer db.Shutdown()
+
+	if len(db.shards) != 4 {
+		t.Fatalf("Expected 4 shards, got %d", len(db.shards))
+	}
+
+	var wg sync.WaitGroup
+	const numKeys = 50
+	const concurrencyLevel = 10
+
+	for i := 0; i < concurrencyLevel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numKeys; j++ {
+				if _, err := db.Calculate(context.Background(), strconv.Itoa(j), struct{}{}); err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for j := 0; j < numKeys; j++ {
+		result, err := db.Calculate(context.Background(), strconv.Itoa(j), struct{}{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if result != concurrencyLevel+1 {
+			t.Errorf("Key %d: expected count %d, got %d", j, concurrencyLevel+1, result)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	db := newTestDB(WithShards(2), WithSweepInterval(10*time.Millisecond))
+	defer db.Shutdown()
+
+	for j := 0; j < 20; j++ {
+		if _, err := db.Calculate(context.Background(), strconv.Itoa(j), struct{}{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	for _, s := range db.shards {
+		s.lock.Lock()
+		if len(s.records) != 0 {
+			t.Errorf("Expected stale records to be evicted, %d remain", len(s.records))
+		}
+		s.lock.Unlock()
+	}
+}
+
+func TestSweepExpiryIndex(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var evictions atomic.Int64
+	evict := func(c *counter) bool {
+		evictions.Add(1)
+		return testEvict(c)
+	}
+	expiresAt := func(c *counter) time.Time {
+		return c.expiresAt
+	}
+
+	db := NewDB(testCallback, evict, expiresAt, nil, nil, logger, WithShards(2), WithSweepInterval(time.Hour))
+	defer db.Shutdown()
+
+	ctx := context.Background()
+	for j := 0; j < 10; j++ {
+		if _, err := db.Calculate(ctx, "stale"+strconv.Itoa(j), struct{}{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	for j := 0; j < 10; j++ {
+		if _, err := db.Calculate(ctx, "fresh"+strconv.Itoa(j), struct{}{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	db.sweep()
+
+	// Only the records whose time has passed are handed to evict
+	if n := evictions.Load(); n != 10 {
+		t.Errorf("Expected evict to be called for the 10 stale records, got %d calls", n)
+	}
+
+	for j := 0; j < 10; j++ {
+		if _, ok, _ := db.Peek("stale" + strconv.Itoa(j)); ok {
+			t.Errorf("Expected stale%d to be evicted", j)
+		}
+		if _, ok, _ := db.Peek("fresh" + strconv.Itoa(j)); !ok {
+			t.Errorf("Expected fresh%d to remain", j)
+		}
+	}
+
+	// Deleted records leave the index too
+	if deleted, _ := db.Delete("fresh0"); !deleted {
+		t.Fatalf("Expected fresh0 to be deleted")
+	}
+	indexed := 0
+	for _, s := range db.shards {
+		indexed += s.expiry.Len()
+	}
+	if indexed != 9 {
+		t.Errorf("Expected 9 indexed records, got %d", indexed)
+	}
+}
+
+func TestScan(t *testing.T) {
+	db := newTestDB()
+	defer db.Shutdown()
+
+	for _, key := range []string{"t1:b", "t2:a", "t1:a", "u", "t1:c"} {
+		if _, err := db.Calculate(context.Background(), key, struct{}{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	result := []string{}
+	err := db.ScanPrefix(context.Background(), "t1:", 2, func(key string, _ *counter) bool {
+		result = append(result, key)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(result) != 2 || result[0] != "t1:a" || result[1] != "t1:b" {
+		t.Errorf("Expected [t1:a t1:b], got %v", result)
+	}
+
+	result = []string{}
+	err = db.Scan(context.Background(), "t1:b", "u", 0, func(key string, _ *counter) bool {
+		result = append(result, key)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(result) != 3 || result[0] != "t1:b" || result[2] != "t2:a" {
+		t.Errorf("Expected [t1:b t1:c t2:a], got %v", result)
+	}
+}
+
+func TestCalculateMany(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// Batches with a commit function need a callback that leaves the stored data alone
+	callback := func(c *counter, _ struct{}) (*counter, int, error) {
+		next := counter{expiresAt: time.Now().Add(time.Minute)}
+		if c != nil {
+			next.count = c.count
+		}
+		next.count++
+		return &next, next.count, nil
+	}
+
+	db := NewDB(callback, testEvict, nil, nil, nil, logger, WithShards(4))
+	defer db.Shutdown()
+
+	ctx := context.Background()
+	keys := []string{"a", "b", "a"}
+	params := make([]struct{}, len(keys))
+
+	results, committed, err := db.CalculateMany(ctx, keys, params, func(_ []int) bool { return false })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if committed || results[2] != 2 {
+		t.Errorf("Expected an uncommitted second count of 2 for a, got %v, %v", results, committed)
+	}
+	if _, ok, _ := db.Peek("a"); ok {
+		t.Error("Expected a rejected batch not to store a")
+	}
+
+	results, committed, err = db.CalculateMany(ctx, keys, params, func(_ []int) bool { return true })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !committed || results[0] != 1 || results[1] != 1 || results[2] != 2 {
+		t.Errorf("Expected committed results [1 1 2], got %v, %v", results, committed)
+	}
+
+	results, _, err = db.CalculateMany(ctx, keys, params, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if results[0] != 3 || results[1] != 2 || results[2] != 4 {
+		t.Errorf("Expected results [3 2 4], got %v", results)
+	}
+}
+
+type counterCodec struct{}
+
+func (counterCodec) Encode(c *counter) ([]byte, error) {
+	return []byte(strconv.Itoa(c.count) + " " + c.expiresAt.Format(time.RFC3339Nano)), nil
+}
+
+func (counterCodec) Decode(b []byte) (*counter, error) {
+	count, expiresAt, _ := strings.Cut(string(b), " ")
+
+	c := &counter{}
+	var err error
+	if c.count, err = strconv.Atoi(count); err != nil {
+		return nil, err
+	}
+	if c.expiresAt, err = time.Parse(time.RFC3339Nano, expiresAt); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// A long sweep interval keeps the sweeper out of the way
+	source := NewDB(testCallback, testEvict, nil, counterCodec{}, nil, logger, WithShards(4), WithSweepInterval(time.Hour))
+	defer source.Shutdown()
+
+	for _, key := range []string{"a", "b", "b"} {
+		if _, err := source.Calculate(context.Background(), key, struct{}{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := source.Snapshot(&buffer); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	snapshot := buffer.Bytes()
+
+	target := NewDB(testCallback, testEvict, nil, counterCodec{}, nil, logger, WithShards(8), WithSweepInterval(time.Hour))
+	defer target.Shutdown()
+
+	if err := target.Restore(bytes.NewReader(snapshot)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if c, ok, _ := target.Peek("b"); !ok || c.count != 2 {
+		t.Errorf("Expected b to be restored with a count of 2, got ok: %t, counter: %+v", ok, c)
+	}
+
+	// Once the records have expired, restoring leaves them out
+	time.Sleep(60 * time.Millisecond)
+
+	if err := target.Restore(bytes.NewReader(snapshot)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, ok, _ := target.Peek("a"); ok {
+		t.Error("Expected the expired record not to be restored")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	limits := admission.Limits{MaxKeys: 10, Policy: admission.LRU}
+	db := newTestDB(WithShards(4), WithSweepInterval(time.Hour), WithLimits(limits))
+	defer db.Shutdown()
+
+	ctx := context.Background()
+	for i := 0; i < 25; i++ {
+		if _, err := db.Calculate(ctx, strconv.Itoa(i), struct{}{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Only the 10 most recently used keys are left
+	for i := 0; i < 25; i++ {
+		if _, ok, _ := db.Peek(strconv.Itoa(i)); ok != (i >= 15) {
+			t.Errorf("Expected key %d to exist: %t", i, i >= 15)
+		}
+	}
+
+	stats, ok := db.LimitStats()
+	if !ok || stats.Keys != 10 || stats.Evictions != 15 {
+		t.Errorf("Expected 10 keys and 15 evictions, got %+v", stats)
+	}
+}
+
+func TestLimitsFallback(t *testing.T) {
+	for _, fallback := range []admission.Fallback{admission.Allow, admission.Deny} {
+		t.Run(fallback.String(), func(t *testing.T) {
+			limits := admission.Limits{MaxKeys: 2, Policy: admission.LFU, Fallback: fallback}
+			db := newTestDB(WithSweepInterval(time.Hour), WithLimits(limits))
+			defer db.Shutdown()
+
+			// Both keys are in regular use, so there is no room for a new one
+			ctx := context.Background()
+			for _, key := range []string{"a", "b", "a", "b"} {
+				if _, err := db.Calculate(ctx, key, struct{}{}); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+
+			result, err := db.Calculate(ctx, "c", struct{}{})
+			switch fallback {
+			case admission.Allow:
+				if err != nil || result != 1 {
+					t.Errorf("Expected c to be calculated as a new key, got %d, %v", result, err)
+				}
+			case admission.Deny:
+				if !errors.Is(err, admission.ErrFull) {
+					t.Errorf("Expected ErrFull, got %v", err)
+				}
+			}
+
+			_, _, err = db.CalculateMany(ctx, []string{"a", "d"}, []struct{}{{}, {}}, func(_ []int) bool { return true })
+			if (fallback == admission.Deny) != errors.Is(err, admission.ErrFull) {
+				t.Errorf("Expected ErrFull only when denying, got %v", err)
+			}
+
+			for key, exists := range map[string]bool{"a": true, "b": true, "c": false, "d": false} {
+				if _, ok, _ := db.Peek(key); ok != exists {
+					t.Errorf("Expected %s to exist: %t", key, exists)
+				}
+			}
+		})
+	}
+}
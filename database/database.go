@@ -1,27 +1,186 @@
 package database
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/dominicfollett/argus-db/database/admission"
+	"github.com/dominicfollett/argus-db/database/concurrent"
 	"github.com/dominicfollett/argus-db/database/naive"
+	"github.com/dominicfollett/argus-db/database/snapshot"
+	"github.com/dominicfollett/argus-db/database/wal"
 )
 
-type Database interface {
-	Calculate(key string, params any) (any, error)
+// ErrUnknownEngine is returned by NewDatabase when no engine is registered under the requested name.
+var ErrUnknownEngine = errors.New("unknown database engine")
+
+// ErrEngineTypes is returned by NewDatabase when an engine was registered for different data,
+// params or result types than the ones requested.
+var ErrEngineTypes = errors.New("database engine registered for different types")
+
+// Database stores a value of type D per key. Calculate passes the stored value and the params P to
+// the callback supplied at construction, stores the value it returns and hands back its result R.
+// Values evict reports as expired are removed in the background. If expiresAt is supplied at
+// construction, it must return when a value expires, or the zero time if it never does, and it must
+// agree with evict: the engines then keep an index of the keys by expiry time, and only consult evict
+// once a key's time has passed.
+// Calculate gives up with an error wrapping the context's error if the context is done first.
+// Peek returns the stored value without calling the callback, and reports whether the key exists.
+// CalculateMany calculates several keys in one call. With a nil commit each key is calculated as by
+// Calculate, and an error stops it at the failing key, returned with the results of the keys before
+// it; otherwise the keys are locked together, in an order that avoids deadlocks, and their new data is
+// only stored if commit(results) returns true, which the boolean reports. In that mode the callback
+// must return new values rather than mutate the data it is given.
+// Delete removes the key, and reports whether it existed.
+// Scan calls fn in ascending key order for up to limit keys in [start, end) until fn returns false;
+// an empty end is unbounded and a non-positive limit means no limit. ScanPrefix does the same for
+// the keys starting with prefix. Scans are not point-in-time views of the database.
+// Snapshot writes every key and its data to w, using the codec supplied at construction, in the
+// format of the snapshot package. Restore replaces the contents of the database with a snapshot,
+// leaving out the entries evict reports as expired. Both return snapshot.ErrNoCodec without a codec.
+// If a journal is supplied at construction, every committed change is appended to it before it is
+// stored, and an operation fails without storing anything if the journal fails.
+// A database bounded by WithLimits evicts keys to make room for new ones. New keys it cannot admit
+// are calculated against the zero value without being stored, or fail with an error wrapping
+// admission.ErrFull, as the limits' fallback says.
+type Database[D, P, R any] interface {
+	Calculate(ctx context.Context, key string, params P) (R, error)
+	CalculateMany(ctx context.Context, keys []string, params []P, commit func(results []R) bool) ([]R, bool, error)
+	Peek(key string) (D, bool, error)
+	Delete(key string) (bool, error)
+	Scan(ctx context.Context, start string, end string, limit int, fn func(key string, data D) bool) error
+	ScanPrefix(ctx context.Context, prefix string, limit int, fn func(key string, data D) bool) error
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
 	Shutdown()
 }
 
-func NewDatabase(
+// Factory constructs a Database engine. Engines register a Factory under a name with Register.
+type Factory[D, P, R any] func(
+	callback func(data D, params P) (D, R, error),
+	evict func(data D) bool,
+	expiresAt func(data D) time.Time,
+	codec snapshot.Codec[D],
+	journal wal.Journal[D],
+	logger *slog.Logger,
+) Database[D, P, R]
+
+//nolint:gochecknoglobals // engines register themselves process-wide, typically from an init()
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]any{}
+)
+
+// builtin reports whether the name refers to one of the engines shipped in this module.
+func builtin(name string) bool {
+	switch name {
+	case "naive", "rebalancing", "lockfree", "concurrent":
+		return true
+	default:
+		return false
+	}
+}
+
+// Register makes an engine available to NewDatabase under the given name. It is intended to be
+// called from an init() function and panics if the name is already taken or the factory is nil.
+// The engine is only found by NewDatabase calls instantiated with the same D, P and R.
+func Register[D, P, R any](name string, factory Factory[D, P, R]) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if factory == nil {
+		panic("database: Register factory is nil for engine " + name)
+	}
+
+	if _, ok := registry[name]; ok || builtin(name) {
+		panic("database: Register called twice for engine " + name)
+	}
+
+	registry[name] = factory
+}
+
+// options holds the engine-specific settings passed to NewDatabase.
+type options struct {
+	naive      []naive.Option
+	concurrent []concurrent.Option
+}
+
+// Option configures an engine constructed by NewDatabase. Options for other engines are ignored, as
+// are all options for registered engines.
+type Option func(o *options)
+
+// WithNaiveOptions passes the options to the naive engine.
+func WithNaiveOptions(opts ...naive.Option) Option {
+	return func(o *options) {
+		o.naive = append(o.naive, opts...)
+	}
+}
+
+// WithConcurrentOptions passes the options to the concurrent engine.
+func WithConcurrentOptions(opts ...concurrent.Option) Option {
+	return func(o *options) {
+		o.concurrent = append(o.concurrent, opts...)
+	}
+}
+
+// WithLimits bounds the number of keys held by the builtin engines, and their estimated size.
+func WithLimits(limits admission.Limits) Option {
+	return func(o *options) {
+		o.naive = append(o.naive, naive.WithLimits(limits))
+		o.concurrent = append(o.concurrent, concurrent.WithLimits(limits))
+	}
+}
+
+// NewDatabase constructs the engine registered under the given name. It returns ErrUnknownEngine
+// if no such engine exists, and ErrEngineTypes if it was registered for other types.
+func NewDatabase[D, P, R any](
 	engine string,
-	callback func(data any, params any) (any, any, error),
-	evict func(data any) bool,
+	callback func(data D, params P) (D, R, error),
+	evict func(data D) bool,
+	expiresAt func(data D) time.Time,
+	codec snapshot.Codec[D],
+	journal wal.Journal[D],
 	logger *slog.Logger,
-) Database {
+	opts ...Option,
+) (Database[D, P, R], error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
 
 	switch engine {
 	case "naive":
-		return naive.NewDB(callback, evict, logger)
-	default:
-		return naive.NewDB(callback, evict, logger)
+		return naive.NewDB(callback, evict, expiresAt, codec, journal, logger, o.naive...), nil
+	case "rebalancing":
+		// The naive engine without its shadow AVL tree
+		opts := append(slices.Clone(o.naive), naive.WithRebalancing())
+		return naive.NewDB(callback, evict, expiresAt, codec, journal, logger, opts...), nil
+	case "lockfree":
+		// The naive engine searching its BST without locks
+		opts := append(slices.Clone(o.naive), naive.WithLockFreeReads())
+		return naive.NewDB(callback, evict, expiresAt, codec, journal, logger, opts...), nil
+	case "concurrent":
+		return concurrent.NewDB(callback, evict, expiresAt, codec, journal, logger, o.concurrent...), nil
 	}
+
+	registryLock.RLock()
+	entry, ok := registry[engine]
+	registryLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownEngine, engine)
+	}
+
+	factory, ok := entry.(Factory[D, P, R])
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrEngineTypes, engine)
+	}
+
+	return factory(callback, evict, expiresAt, codec, journal, logger), nil
 }
@@ -0,0 +1,62 @@
+package database_test
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/dominicfollett/argus-db/database"
+	"github.com/dominicfollett/argus-db/database/snapshot"
+	"github.com/dominicfollett/argus-db/database/wal"
+)
+
+// stubDB embeds the interface so it only needs to implement what the test exercises.
+type stubDB struct {
+	database.Database[string, int, int]
+}
+
+func TestRegister(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	callback := func(data string, params int) (string, int, error) { return data, params, nil }
+	evict := func(_ string) bool { return false }
+
+	database.Register("stub", func(
+		_ func(data string, params int) (string, int, error),
+		_ func(data string) bool,
+		_ func(data string) time.Time,
+		_ snapshot.Codec[string],
+		_ wal.Journal[string],
+		_ *slog.Logger,
+	) database.Database[string, int, int] {
+		return stubDB{}
+	})
+
+	db, err := database.NewDatabase("stub", callback, evict, nil, nil, nil, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, ok := db.(stubDB); !ok {
+		t.Errorf("Expected the registered engine, got %T", db)
+	}
+
+	if _, err = database.NewDatabase("does-not-exist", callback, evict, nil, nil, nil, logger); !errors.Is(err, database.ErrUnknownEngine) {
+		t.Errorf("Expected ErrUnknownEngine, got %v", err)
+	}
+
+	// The same engine requested with different types must not be handed out
+	_, err = database.NewDatabase(
+		"stub",
+		func(data int, params int) (int, int, error) { return data, params, nil },
+		func(_ int) bool { return false },
+		nil,
+		nil,
+		nil,
+		logger,
+	)
+	if !errors.Is(err, database.ErrEngineTypes) {
+		t.Errorf("Expected ErrEngineTypes, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+// Package expiry provides an index of keys ordered by the time they expire, so that the database
+// engines only need to look at the keys whose deadline has passed rather than survey every key.
+package expiry
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Index is a min-heap of keys ordered by expiry time, holding one entry per key along with its
+// value. It is not safe for concurrent use.
+type Index[V any] struct {
+	entries   entries[V]
+	positions map[string]*entry[V]
+}
+
+// entry is a key in the index. Its position in the heap is kept up to date so that it can be moved
+// or removed without a search.
+type entry[V any] struct {
+	key       string
+	expiresAt time.Time
+	value     V
+	position  int
+}
+
+// NewIndex returns an empty Index.
+func NewIndex[V any]() *Index[V] {
+	return &Index[V]{positions: map[string]*entry[V]{}}
+}
+
+// Set records when the key expires, along with its current value, replacing any earlier entry for
+// the key. A zero expiresAt means the key never expires and removes it from the index.
+func (x *Index[V]) Set(key string, expiresAt time.Time, value V) {
+	if expiresAt.IsZero() {
+		x.Remove(key)
+		return
+	}
+
+	if e, ok := x.positions[key]; ok {
+		e.expiresAt = expiresAt
+		e.value = value
+		heap.Fix(&x.entries, e.position)
+		return
+	}
+
+	e := &entry[V]{key: key, expiresAt: expiresAt, value: value}
+	x.positions[key] = e
+	heap.Push(&x.entries, e)
+}
+
+// Remove drops the key from the index, if it is there.
+func (x *Index[V]) Remove(key string) {
+	e, ok := x.positions[key]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&x.entries, e.position)
+	delete(x.positions, key)
+}
+
+// Pop removes and returns the key expiring first, along with its value, provided it expires no
+// later than now. The boolean reports whether there was such a key.
+func (x *Index[V]) Pop(now time.Time) (string, V, bool) {
+	if len(x.entries) == 0 || x.entries[0].expiresAt.After(now) {
+		var zero V
+		return "", zero, false
+	}
+
+	e, _ := heap.Pop(&x.entries).(*entry[V])
+	delete(x.positions, e.key)
+
+	return e.key, e.value, true
+}
+
+// Len returns the number of keys in the index.
+func (x *Index[V]) Len() int {
+	return len(x.entries)
+}
+
+// Reset empties the index.
+func (x *Index[V]) Reset() {
+	x.entries = nil
+	x.positions = map[string]*entry[V]{}
+}
+
+// entries implements heap.Interface.
+type entries[V any] []*entry[V]
+
+func (h entries[V]) Len() int { return len(h) }
+
+func (h entries[V]) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+
+func (h entries[V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].position = i
+	h[j].position = j
+}
+
+func (h *entries[V]) Push(x any) {
+	e, _ := x.(*entry[V])
+	e.position = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *entries[V]) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,81 @@
+//nolint:testpackage // Allow tests to access the expiry package
+package expiry
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIndex(t *testing.T) {
+	index := NewIndex[int]()
+	start := time.Now()
+
+	// Keys expire one second apart, but are set in a random order
+	order := rand.Perm(100)
+	for _, i := range order {
+		index.Set(strconv.Itoa(i), start.Add(time.Duration(i+1)*time.Second), i)
+	}
+
+	// Moving a key replaces its entry rather than adding another
+	index.Set("0", start.Add(time.Hour), -1)
+	index.Remove("1")
+	index.Remove("missing")
+	index.Set("2", time.Time{}, 2)
+
+	if index.Len() != 98 {
+		t.Fatalf("Expected 98 keys, got %d", index.Len())
+	}
+
+	if _, _, ok := index.Pop(start); ok {
+		t.Errorf("Expected nothing to have expired yet")
+	}
+
+	now := start.Add(50 * time.Second)
+	popped := []int{}
+	for {
+		key, value, ok := index.Pop(now)
+		if !ok {
+			break
+		}
+		if key != strconv.Itoa(value) {
+			t.Errorf("Expected %s to hold its own value, got %d", key, value)
+		}
+		popped = append(popped, value)
+	}
+
+	// 3 to 49 expire by now, in order
+	if len(popped) != 47 {
+		t.Fatalf("Expected 47 expired keys, got %d: %v", len(popped), popped)
+	}
+	for i, value := range popped {
+		if value != i+3 {
+			t.Errorf("Expected %d at %d, got %d", i+3, i, value)
+		}
+	}
+
+	// The moved key now expires last
+	last := ""
+	lastValue := 0
+	for {
+		key, value, ok := index.Pop(start.Add(2 * time.Hour))
+		if !ok {
+			break
+		}
+		last, lastValue = key, value
+	}
+	if last != "0" || lastValue != -1 {
+		t.Errorf("Expected the moved key to expire last with its new value, got %s: %d", last, lastValue)
+	}
+
+	if index.Len() != 0 {
+		t.Errorf("Expected an empty index, got %d keys", index.Len())
+	}
+
+	index.Set("a", start, 1)
+	index.Reset()
+	if _, _, ok := index.Pop(start); ok || index.Len() != 0 {
+		t.Errorf("Expected Reset to empty the index")
+	}
+}
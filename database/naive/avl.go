@@ -7,23 +7,24 @@ import (
 )
 
 // AVL represents an AVL tree with a pointer to the root node.
-type AVL struct {
-	root *Node
+type AVL[D any] struct {
+	root *Node[D]
+	size atomic.Int64 // size counts the nodes in the tree, for readers that don't hold the avl lock.
 }
 
 // NewAVL creates and returns a new instance of an AVL tree.
-func NewAVL() *AVL {
-	return &AVL{}
+func NewAVL[D any]() *AVL[D] {
+	return &AVL[D]{}
 }
 
 // TODO can we use *[]string instead
-func (tree *AVL) Survey(evict func(data any) bool) []string {
+func (tree *AVL[D]) Survey(evict func(data D) bool) []string {
 	return tree.root.surveyAVL(evict, []string{})
 }
 
 // surveyAVL traverses the tree in an in-order manner (descending order) and collects the keys
 // that return true when applying the user-defined evict function on the node's data.
-func (node *Node) surveyAVL(evict func(data any) bool, keys []string) []string {
+func (node *Node[D]) surveyAVL(evict func(data D) bool, keys []string) []string {
 	if node == nil {
 		return keys
 	}
@@ -40,19 +41,38 @@ func (node *Node) surveyAVL(evict func(data any) bool, keys []string) []string {
 }
 
 // GetKeys retrieves all keys from the AVL tree in sorted descending order.
-func (tree *AVL) GetKeys() []string {
+func (tree *AVL[D]) GetKeys() []string {
 	keys := tree.root.inorderDesc([]string{})
 	return keys
 }
 
 // Delete removes a node from the AVL tree with the given key.
-func (tree *AVL) Delete(key string) {
+func (tree *AVL[D]) Delete(key string) {
+	if tree.contains(key) {
+		tree.size.Add(-1)
+	}
 	tree.root = tree.root.deleteAVL(key)
 }
 
+// contains reports whether the tree holds the key.
+func (tree *AVL[D]) contains(key string) bool {
+	node := tree.root
+	for node != nil {
+		switch {
+		case key < node.key:
+			node = node.left
+		case key > node.key:
+			node = node.right
+		default:
+			return true
+		}
+	}
+	return false
+}
+
 // deleteAVL searches for the the node to delete, removes it from the tree while maintaining height
 // invariance through rebalancing operations.
-func (node *Node) deleteAVL(key string) *Node {
+func (node *Node[D]) deleteAVL(key string) *Node[D] {
 	if node == nil {
 		return nil
 	}
@@ -69,8 +89,9 @@ func (node *Node) deleteAVL(key string) *Node {
 			return node.left
 		}
 
-		// Find node successor
-		successorNode := findAndRemoveMinimum(node.right)
+		// Find and detach the node's successor
+		var successorNode *Node[D]
+		node.right, successorNode = node.right.removeMinimum()
 
 		// Update this node to mirror the successor
 		node.key = successorNode.key
@@ -104,17 +125,48 @@ func (node *Node) deleteAVL(key string) *Node {
 	return node
 }
 
+// clone returns a copy of the subtree rooted at this node, sharing only the data.
+func (node *Node[D]) clone() *Node[D] {
+	if node == nil {
+		return nil
+	}
+
+	copied := &Node[D]{
+		key:   node.key,
+		data:  node.data,
+		left:  node.left.clone(),
+		right: node.right.clone(),
+	}
+	copied.height.Store(node.height.Load())
+
+	return copied
+}
+
+// walk calls visit for every node of the subtree rooted at this node, in no particular order.
+func (node *Node[D]) walk(visit func(node *Node[D])) {
+	if node == nil {
+		return
+	}
+
+	visit(node)
+	node.left.walk(visit)
+	node.right.walk(visit)
+}
+
 // Insert adds a new node with the given key and data to the AVL tree. It ensures that the tree
 // remains balanced after the insertion.
-func (tree *AVL) Insert(key string, data any) {
+func (tree *AVL[D]) Insert(key string, data D) {
+	if !tree.contains(key) {
+		tree.size.Add(1)
+	}
 	tree.root = tree.root.insertAVL(key, data)
 }
 
 // insertAVL adds a new node with the given key and data to the tree rooted at the current node.
 // It ensures the AVL tree properties are maintained by performing necessary rotations.
-func (node *Node) insertAVL(key string, data any) *Node {
+func (node *Node[D]) insertAVL(key string, data D) *Node[D] {
 	if node == nil {
-		return &Node{
+		return &Node[D]{
 			key:    key,
 			data:   data,
 			height: atomic.Int32{}, // Leaves have a height of 0
@@ -122,7 +174,8 @@ func (node *Node) insertAVL(key string, data any) *Node {
 	}
 
 	if node.key == key {
-		// Nothing further to do so we can safely return
+		// Callbacks may return a new value rather than mutating the old one, so refresh the data
+		node.data = data
 		return node
 	}
 
@@ -145,34 +198,28 @@ func (node *Node) insertAVL(key string, data any) *Node {
 	return node
 }
 
-// findAndRemoveMinimum finds the minimum node from the given root,
-// removes it from the tree, and updates the height of each node
-// back to the root.
-func findAndRemoveMinimum(root *Node) *Node {
-	if root.left != nil {
-		successorNode := findAndRemoveMinimum(root.left)
-
-		// Delete the successor node
-		if successorNode.key == root.left.key {
-			root.left = nil
-		}
-
-		// Update the node's height
-		root.height.Store(
-			1 + max(root.left.getHeight(), root.right.getHeight()),
-		)
+// removeMinimum detaches the minimum node from the subtree rooted at this node, updating heights
+// and rebalancing on the way back up. It returns the new root of the subtree and the detached node.
+func (node *Node[D]) removeMinimum() (*Node[D], *Node[D]) {
+	if node.left == nil {
+		// The minimum's right subtree, if any, takes its place
+		return node.right, node
+	}
 
-		// TODO: rebalancing is not required because ...
+	var minimum *Node[D]
+	node.left, minimum = node.left.removeMinimum()
 
-		return successorNode
-	}
+	// Update the node's height because the left subtree may have shrunk
+	node.height.Store(
+		1 + max(node.left.getHeight(), node.right.getHeight()),
+	)
 
-	return root
+	return node.balance(), minimum
 }
 
 // balance calculates the node balance factor and applies
 // balacing operations if required.
-func (node *Node) balance() *Node {
+func (node *Node[D]) balance() *Node[D] {
 	balanceFactor := node.getBalanceFactor()
 
 	// Conditions under which balanceFactor itself would not lead to a balancing operation:
@@ -183,30 +230,26 @@ func (node *Node) balance() *Node {
 
 	// TODO: Optimize this
 	//nolint:gomnd // 2 is the threshold for AVL balancing
+	// The child's balance factor must be read before rotating: after a rotation node.left or
+	// node.right refer to different nodes.
 	if balanceFactor == 2 {
-		// Left-Left ==> Right Rotation
-		if node.left.getBalanceFactor() == 1 || node.left.getBalanceFactor() == 0 {
-			node = node.rotateRight()
-		}
-
-		// Left-right ==> Left Rotation followed by Right Rotation
 		if node.left.getBalanceFactor() == -1 {
+			// Left-right ==> Left Rotation followed by Right Rotation
 			node.left = node.left.rotateLeft()
-			node = node.rotateRight()
 		}
+
+		// Left-Left ==> Right Rotation
+		node = node.rotateRight()
 	}
 
 	if balanceFactor == -2 {
-		// Right-Right ==> Left Rotation
-		if node.right.getBalanceFactor() == -1 || node.right.getBalanceFactor() == 0 {
-			node = node.rotateLeft()
-		}
-
-		// Right-Left ==> Right Rotation followed by Left Rotation
 		if node.right.getBalanceFactor() == 1 {
+			// Right-Left ==> Right Rotation followed by Left Rotation
 			node.right = node.right.rotateRight()
-			node = node.rotateLeft()
 		}
+
+		// Right-Right ==> Left Rotation
+		node = node.rotateLeft()
 	}
 
 	return node
@@ -216,7 +259,7 @@ func (node *Node) balance() *Node {
 // a left-heavy imbalance.
 //
 //nolint:revive // so that the diagram makes sense
-func (a *Node) rotateRight() *Node {
+func (a *Node[D]) rotateRight() *Node[D] {
 	/*
 					 A
 					/ \
@@ -254,7 +297,7 @@ func (a *Node) rotateRight() *Node {
 // right-heavy imbalance.
 //
 //nolint:revive // so that the diagram makes sense
-func (a *Node) rotateLeft() *Node {
+func (a *Node[D]) rotateLeft() *Node[D] {
 	/*
 			 A
 			/ \
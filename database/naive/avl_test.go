@@ -2,12 +2,14 @@
 package naive
 
 import (
+	"math/rand"
 	"sort"
+	"strconv"
 	"testing"
 )
 
 //nolint:stylecheck // Allow helper function name
-func (node *Node) avlHeightTestHelper(t *testing.T) int32 {
+func (node *Node[D]) avlHeightTestHelper(t *testing.T) int32 {
 	if node == nil {
 		if node.getHeight() != -1 {
 			t.Errorf("Expected height of nil node to be -1, got %d", node.getHeight())
@@ -46,7 +48,7 @@ func TestAVL(t *testing.T) {
 		"T", "X", "G", "L", "E", "Q", "M", "H", "O", "I", "B", "Z", "A", "V", "S", "R", "K", "P",
 		"C", "D", "U", "F", "N", "W", "Y", "J",
 	}
-	avl := NewAVL()
+	avl := NewAVL[any]()
 
 	for _, k := range keys {
 		avl.Insert(k, nil)
@@ -91,7 +93,7 @@ func TestAVLDelete(t *testing.T) {
 	     O   Q
 	*/
 
-	avl := NewAVL()
+	avl := NewAVL[any]()
 
 	for _, k := range keys {
 		avl.Insert(k, nil)
@@ -136,3 +138,81 @@ func TestAVLDelete(t *testing.T) {
 		}
 	}
 }
+
+func TestAVLDeleteRandom(t *testing.T) {
+	avl := NewAVL[any]()
+
+	keys := make([]string, 200)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	for _, k := range keys {
+		avl.Insert(k, nil)
+	}
+
+	// Delete half of the keys in a different random order
+	deleted := map[string]bool{}
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	for _, k := range keys[:len(keys)/2] {
+		avl.Delete(k)
+		deleted[k] = true
+
+		// Check the height and balance factor of each node
+		avl.root.avlHeightTestHelper(t)
+	}
+
+	expected := []string{}
+	for _, k := range keys {
+		if !deleted[k] {
+			expected = append(expected, k)
+		}
+	}
+	sort.Strings(expected)
+
+	result := avl.GetKeys()
+	if len(expected) != len(result) {
+		t.Fatalf("Expected and result slices differ in length; expected: %d, got: %d", len(expected), len(result))
+	}
+
+	for i, key := range expected {
+		if key != result[i] {
+			t.Errorf("Key mismatch at index %d; expected: %s, got: %s", i, key, result[i])
+		}
+	}
+}
+
+func TestAVLUpsertAndClone(t *testing.T) {
+	avl := NewAVL[int]()
+
+	for i, k := range []string{"M", "F", "T", "B", "H"} {
+		avl.Insert(k, i)
+	}
+
+	// Inserting an existing key replaces its data rather than adding a node
+	avl.Insert("F", 10)
+	avl.Insert("H", 20)
+	if size := avl.size.Load(); size != 5 {
+		t.Errorf("Expected a size of 5, got %d", size)
+	}
+
+	clone := avl.root.clone()
+	avl.Insert("F", 30)
+	avl.Delete("B")
+
+	// The clone keeps the data it was taken with, and is untouched by later changes to the tree
+	data := map[string]int{}
+	clone.walk(func(node *Node[int]) { data[node.key] = node.data })
+
+	expected := map[string]int{"M": 0, "F": 10, "T": 2, "B": 3, "H": 20}
+	if len(data) != len(expected) {
+		t.Fatalf("Expected %d keys in the clone, got %v", len(expected), data)
+	}
+	for key, value := range expected {
+		if data[key] != value {
+			t.Errorf("Expected %s to be %d in the clone, got %d", key, value, data[key])
+		}
+	}
+	clone.avlHeightTestHelper(t)
+}
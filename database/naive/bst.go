@@ -3,38 +3,71 @@
 package naive
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 )
 
+// BfThreshold is the balance factor from which a node counts towards the balance factor sum, and
+// above which a rebalancing BST rotates the node.
 const BfThreshold int32 = 2
 
 // BST represents a BST tree with a pointer to the root node.
-type BST struct {
-	root             *Node
+//
+// Every node has two locks. Node.lock guards the node's key and children and is taken top-down,
+// hand-over-hand, by traversals. Node.dataLock guards the node's data and is held by callers while
+// they work on it. A data lock may be taken while holding the same node's traversal lock, but no
+// traversal lock is ever waited on while holding a data lock, and several data locks are always
+// taken in ascending key order. Together these rules rule out deadlocks.
+//
+// A rebalancing BST rotates the nodes InSearch passes on its way down whose balance factor exceeds
+// BfThreshold, which keeps the tree balanced without a shadow tree. A rotation holds the lock
+// guarding the link to the rotated node as well as the traversal locks of the nodes it moves, so
+// no traversal can be passing through them.
+//
+// A lock-free BST keeps its nodes in lfNodes whose child links are loaded atomically, so searches
+// take no traversal locks and the root lock is no longer a point every search contends on. Only the
+// node a new key hangs from is locked to link it, and removals lock the nodes whose links they
+// change. Rotations would move nodes under such searches, so a BST cannot be both.
+type BST[D any] struct {
+	root             *Node[D]
 	rootLock         sync.Mutex
+	lfRoot           atomic.Pointer[lfNode[D]] // lfRoot is the root of a lock-free BST, in place of root.
 	balanceFactorSum *atomic.Int64
+	maxHeight        atomic.Int32 // maxHeight is the largest root height observed by InSearch.
+	size             atomic.Int64 // size counts the nodes in the tree.
+	rebalance        bool         // rebalance enables rotations in InSearch. It must be set before first use.
+	rotations        atomic.Int64 // rotations counts the rotations performed by InSearch.
+	lockFree         bool         // lockFree enables lock-free searches. It must be set before first use.
 }
 
 // NewBST creates and returns a new instance of Binary Search Tree.
-func NewBST() *BST {
-	return &BST{
+func NewBST[D any]() *BST[D] {
+	return &BST[D]{
 		rootLock:         sync.Mutex{},
 		balanceFactorSum: &atomic.Int64{},
 	}
 }
 
 // GetKeys retrieves all keys from the BST tree in sorted descending order.
-func (tree *BST) GetKeys() []string {
+func (tree *BST[D]) GetKeys() []string {
+	if tree.lockFree {
+		return tree.lfRoot.Load().inorderDesc([]string{})
+	}
+
 	keys := tree.root.inorderDesc([]string{})
 	return keys
 }
 
 // Search retrieves the node with the given key from the BST tree. If the node does not exist, it returns nil.
 // This function is thread-safe and uses hand-over-hand locking to ensure that the tree is properly
-// locked during the search process. However, users of this function MUST release the lock on the
-// returned node after they are done with it.
-func (tree *BST) Search(key string) *Node {
+// locked during the search process. However, users of this function MUST release the data lock on
+// the returned node after they are done with it.
+func (tree *BST[D]) Search(key string) *Node[D] {
+	if tree.lockFree {
+		return tree.lfSearch(key)
+	}
+
 	tree.rootLock.Lock()
 
 	if tree.root == nil {
@@ -42,10 +75,17 @@ func (tree *BST) Search(key string) *Node {
 		return nil
 	}
 
-	return tree.root.searchBST(&tree.rootLock, key)
+	node := tree.root.searchBST(&tree.rootLock, key)
+	if node != nil {
+		// Trade the node's traversal lock for its data lock
+		node.dataLock.Lock()
+		node.lock.Unlock()
+	}
+
+	return node
 }
 
-func (node *Node) searchBST(parentLock *sync.Mutex, key string) *Node {
+func (node *Node[D]) searchBST(parentLock *sync.Mutex, key string) *Node[D] {
 	// Try and obtain this node's lock
 	node.lock.Lock()
 
@@ -56,17 +96,20 @@ func (node *Node) searchBST(parentLock *sync.Mutex, key string) *Node {
 		return node
 	}
 
-	var result *Node
+	var result *Node[D]
 
 	if key < node.key {
 		if node.left == nil {
+			// The key does not exist so we are done with this node
+			node.lock.Unlock()
 			return nil
 		}
 		result = node.left.searchBST(&node.lock, key)
-	}
-
-	if key > node.key {
+	} else {
+		// key > node.key: node.key must not be reread here as node.lock may have been handed over
 		if node.right == nil {
+			// The key does not exist so we are done with this node
+			node.lock.Unlock()
 			return nil
 		}
 		result = node.right.searchBST(&node.lock, key)
@@ -76,7 +119,7 @@ func (node *Node) searchBST(parentLock *sync.Mutex, key string) *Node {
 }
 
 // updateHeight atomically updates the height of the node based on the height of its left and right children.
-func (node *Node) updateHeight(leftHeight int32, rightHeight int32) {
+func (node *Node[D]) updateHeight(leftHeight int32, rightHeight int32) {
 	oldHeight := node.getHeight()
 	newHeight := 1 + max(leftHeight, rightHeight)
 
@@ -91,34 +134,40 @@ func (node *Node) updateHeight(leftHeight int32, rightHeight int32) {
 }
 
 // newBSTNode creates and returns a new instance of a BST node with the given key.
-func newBSTNode(key string) *Node {
-	return &Node{
+func newBSTNode[D any](key string) *Node[D] {
+	return &Node[D]{
 		key:    key,
 		lock:   sync.Mutex{},
-		data:   nil,
 		height: atomic.Int32{},
+		empty:  true,
 	}
 }
 
 // Insert adds a new node with the given key and data to the BST tree.
 // This function is thread-safe.
-func (tree *BST) Insert(key string) {
+func (tree *BST[D]) Insert(key string) {
+	if tree.lockFree {
+		_, _ = tree.lfResolve(context.Background(), key)
+		return
+	}
+
 	tree.rootLock.Lock()
 
 	if tree.root == nil {
-		tree.root = newBSTNode(key)
+		tree.root = newBSTNode[D](key)
+		tree.size.Add(1)
 		tree.rootLock.Unlock()
 		return
 	}
 
 	// tree.rootLock will be released through hand-over-hand locking
-	_ = tree.root.insertBST(&tree.rootLock, key)
+	_ = tree.root.insertBST(&tree.rootLock, &tree.size, key)
 }
 
 // insertBST adds a new node with the given key to the tree and returns the height of the tree and the new node.
 // This function is thread-safe and uses hand-over-hand locking to ensure that the tree is properly
 // locked during the insertion process.
-func (node *Node) insertBST(parentLock *sync.Mutex, key string) int32 {
+func (node *Node[D]) insertBST(parentLock *sync.Mutex, size *atomic.Int64, key string) int32 {
 	// Try and obtain this node's lock
 	node.lock.Lock()
 
@@ -139,7 +188,8 @@ func (node *Node) insertBST(parentLock *sync.Mutex, key string) int32 {
 
 	if key < node.key {
 		if node.left == nil {
-			node.left = newBSTNode(key)
+			node.left = newBSTNode[D](key)
+			size.Add(1)
 
 			// We have to update this node's height because we've just performed an insertion
 			node.updateHeight(node.left.getHeight(), node.right.getHeight())
@@ -151,12 +201,12 @@ func (node *Node) insertBST(parentLock *sync.Mutex, key string) int32 {
 		rightHeight = node.right.getHeight()
 
 		// node.lock will be released in the recursive call
-		leftHeight = node.left.insertBST(&node.lock, key)
-	}
-
-	if key > node.key {
+		leftHeight = node.left.insertBST(&node.lock, size, key)
+	} else {
+		// key > node.key: node.key must not be reread here as node.lock may have been handed over
 		if node.right == nil {
-			node.right = newBSTNode(key)
+			node.right = newBSTNode[D](key)
+			size.Add(1)
 
 			// We have to update this node's height because we've just performed an insertion
 			node.updateHeight(node.left.getHeight(), node.right.getHeight())
@@ -168,7 +218,7 @@ func (node *Node) insertBST(parentLock *sync.Mutex, key string) int32 {
 		leftHeight = node.left.getHeight()
 
 		// node.lock will be released in the recursive call
-		rightHeight = node.right.insertBST(&node.lock, key)
+		rightHeight = node.right.insertBST(&node.lock, size, key)
 	}
 
 	node.updateHeight(leftHeight, rightHeight)
@@ -177,34 +227,113 @@ func (node *Node) insertBST(parentLock *sync.Mutex, key string) int32 {
 
 // InSearch retrieves the node with the given key from the BST tree. If the node does not exist, it creates a new node.
 // This function is thread-safe and uses hand-over-hand locking to ensure that the tree is properly
-// locked during the search process. However, users of this function MUST release the lock on the
-// returned node after they are done with it.
-func (tree *BST) InSearch(key string) *Node {
-	tree.rootLock.Lock()
+// locked during the search process. However, users of this function MUST release the data lock on
+// the returned node after they are done with it.
+// If the context is done while waiting on a lock, every lock is released and a *WaitError is returned.
+func (tree *BST[D]) InSearch(ctx context.Context, key string) (*Node[D], error) {
+	if tree.lockFree {
+		return tree.lfInSearch(ctx, key)
+	}
+
+	node, err := tree.inSearch(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trade the node's traversal lock for its data lock
+	if err = lockContext(ctx, "data lock", &node.dataLock); err != nil {
+		node.lock.Unlock()
+		return nil, err
+	}
+	node.lock.Unlock()
+
+	return node, nil
+}
+
+// Resolve is like InSearch but returns the node without holding any of its locks. By the time the
+// caller locks it, the node may have been removed or handed another key, which must be checked.
+func (tree *BST[D]) Resolve(ctx context.Context, key string) (*Node[D], error) {
+	if tree.lockFree {
+		return tree.lfResolve(ctx, key)
+	}
+
+	node, err := tree.inSearch(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	node.lock.Unlock()
+
+	return node, nil
+}
+
+// inSearch finds or creates the node with the given key and returns it with its traversal lock held.
+func (tree *BST[D]) inSearch(ctx context.Context, key string) (*Node[D], error) {
+	if err := lockContext(ctx, "root lock", &tree.rootLock); err != nil {
+		return nil, err
+	}
 
 	if tree.root == nil {
-		tree.root = newBSTNode(key)
-		tree.rootLock.Unlock()
+		root := newBSTNode[D](key)
+		root.lock.Lock()
 
-		tree.root.lock.Lock()
-		return tree.root
+		tree.root = root
+		tree.size.Add(1)
+		tree.rootLock.Unlock()
+		return root, nil
 	}
 
 	// tree.rootLock will be released through hand-over-hand locking
-	_, node, balanceFactor := tree.root.inSearchBST(&tree.rootLock, key)
+	height, node, balanceFactor, err := tree.root.inSearchBST(ctx, &tree.rootLock, &tree.root, tree, key)
+	if err != nil {
+		return nil, err
+	}
 
-	// Atomically update the global balance factor sum
+	tree.observe(balanceFactor, height)
+	return node, nil
+}
+
+// observe adds the balance factor a search summed up on its way down to the global sum, and
+// records the height of the tree it saw if it is the tallest yet.
+func (tree *BST[D]) observe(balanceFactor int32, height int32) {
 	tree.balanceFactorSum.Add(int64(balanceFactor))
+	for observed := tree.maxHeight.Load(); height > observed; observed = tree.maxHeight.Load() {
+		if tree.maxHeight.CompareAndSwap(observed, height) {
+			break
+		}
+	}
+}
 
-	return node
+// replace makes root, with size nodes, the tree's new root. No one else may be using the tree.
+func (tree *BST[D]) replace(root *Node[D], size int64) {
+	if tree.lockFree {
+		tree.lfRoot.Store(newLFTree(root))
+	} else {
+		tree.root = root
+	}
+	tree.size.Store(size)
 }
 
 // inSearchBST retrieves the node with the given key from the BST tree. If the node does not exist,
 // it creates a new node. This function is thread-safe and uses hand-over-hand locking to ensure
-// that the tree is properly locked during the search process.
-func (node *Node) inSearchBST(parentLock *sync.Mutex, key string) (int32, *Node, int32) {
+// that the tree is properly locked during the search process. link is the pointer through which
+// this node was reached, guarded by parentLock.
+func (node *Node[D]) inSearchBST(
+	ctx context.Context,
+	parentLock *sync.Mutex,
+	link **Node[D],
+	tree *BST[D],
+	key string,
+) (int32, *Node[D], int32, error) {
 	// Try and obtain this node's lock
-	node.lock.Lock()
+	if err := lockContext(ctx, "node lock", &node.lock); err != nil {
+		parentLock.Unlock()
+		return 0, nil, 0, err
+	}
+
+	// The link to this node is still guarded, so this is the one chance to rotate it
+	if tree.rebalance {
+		node = node.rebalanceBST(link, &tree.rotations)
+	}
 
 	// Good now release the prior lock
 	parentLock.Unlock()
@@ -219,17 +348,19 @@ func (node *Node) inSearchBST(parentLock *sync.Mutex, key string) (int32, *Node,
 			balanceFactor = 0
 		}
 
-		return node.getHeight(), node, balanceFactor
+		return node.getHeight(), node, balanceFactor, nil
 	}
 
 	var leftHeight int32
 	var rightHeight int32
-	var returnedNode *Node
+	var returnedNode *Node[D]
 	var balanceFactor int32
+	var err error
 
 	if key < node.key {
 		if node.left == nil {
-			node.left = newBSTNode(key)
+			node.left = newBSTNode[D](key)
+			tree.size.Add(1)
 
 			// We have to update this node's height because we've just performed an insertion
 			node.updateHeight(node.left.getHeight(), node.right.getHeight())
@@ -238,17 +369,17 @@ func (node *Node) inSearchBST(parentLock *sync.Mutex, key string) (int32, *Node,
 
 			// We have to release the lock on this node because we're done with it
 			node.lock.Unlock()
-			return node.getHeight(), node.left, 0
+			return node.getHeight(), node.left, 0, nil
 		}
 		rightHeight = node.right.getHeight()
 
 		// node.lock will be released in the recursive call
-		leftHeight, returnedNode, balanceFactor = node.left.inSearchBST(&node.lock, key)
-	}
-
-	if key > node.key {
+		leftHeight, returnedNode, balanceFactor, err = node.left.inSearchBST(ctx, &node.lock, &node.left, tree, key)
+	} else {
+		// key > node.key: node.key must not be reread here as node.lock may have been handed over
 		if node.right == nil {
-			node.right = newBSTNode(key)
+			node.right = newBSTNode[D](key)
+			tree.size.Add(1)
 
 			// We have to update this node's height because we've just performed an insertion
 			node.updateHeight(node.left.getHeight(), node.right.getHeight())
@@ -257,12 +388,16 @@ func (node *Node) inSearchBST(parentLock *sync.Mutex, key string) (int32, *Node,
 
 			// We have to release the lock on this node because we're done with it
 			node.lock.Unlock()
-			return node.getHeight(), node.right, 0
+			return node.getHeight(), node.right, 0, nil
 		}
 		leftHeight = node.left.getHeight()
 
 		// node.lock will be released in the recursive call
-		rightHeight, returnedNode, balanceFactor = node.right.inSearchBST(&node.lock, key)
+		rightHeight, returnedNode, balanceFactor, err = node.right.inSearchBST(ctx, &node.lock, &node.right, tree, key)
+	}
+
+	if err != nil {
+		return 0, nil, 0, err
 	}
 
 	node.updateHeight(leftHeight, rightHeight)
@@ -273,5 +408,298 @@ func (node *Node) inSearchBST(parentLock *sync.Mutex, key string) (int32, *Node,
 		balanceFactorPrime = 0
 	}
 
-	return node.getHeight(), returnedNode, balanceFactor + balanceFactorPrime
+	return node.getHeight(), returnedNode, balanceFactor + balanceFactorPrime, nil
+}
+
+// rebalanceBST rotates the subtree rooted at this node if the node's balance factor exceeds
+// BfThreshold, and returns the root of the subtree, which is this node if nothing was rotated. The
+// caller must hold the lock guarding link, the pointer through which this node was reached, and
+// this node's lock. On return it holds the lock of the returned node instead of this node's.
+// Rotations store the heights they compute, as heights are otherwise only ever raised.
+func (node *Node[D]) rebalanceBST(link **Node[D], rotations *atomic.Int64) *Node[D] {
+	// A nil child has a height of -1, so the taller side is never nil
+	balanceFactor := node.getBalanceFactor()
+	if absInt32(balanceFactor) <= BfThreshold {
+		return node
+	}
+
+	var root *Node[D]
+
+	if balanceFactor > 0 {
+		child := node.left
+		child.lock.Lock()
+
+		if child.getBalanceFactor() < 0 {
+			// Left-right case: the child's right subtree rises to the top
+			root = child.right
+			root.lock.Lock()
+
+			child.right = root.left
+			node.left = root.right
+			root.left = child
+			root.right = node
+
+			child.storeHeight()
+			child.lock.Unlock()
+		} else {
+			root = child
+			node.left = child.right
+			child.right = node
+		}
+	} else {
+		child := node.right
+		child.lock.Lock()
+
+		if child.getBalanceFactor() > 0 {
+			// Right-left case: the child's left subtree rises to the top
+			root = child.left
+			root.lock.Lock()
+
+			child.left = root.right
+			node.right = root.left
+			root.right = child
+			root.left = node
+
+			child.storeHeight()
+			child.lock.Unlock()
+		} else {
+			root = child
+			node.right = child.left
+			child.left = node
+		}
+	}
+
+	node.storeHeight()
+	root.storeHeight()
+	node.lock.Unlock()
+
+	*link = root
+	rotations.Add(1)
+
+	return root
+}
+
+// storeHeight sets the height of the node from the heights of its children, even if that lowers it.
+func (node *Node[D]) storeHeight() {
+	node.height.Store(1 + max(node.left.getHeight(), node.right.getHeight()))
+}
+
+// Delete removes the node with the given key from the BST tree and reports whether it existed.
+// This function is thread-safe and uses hand-over-hand locking. A node is only unlinked while its
+// locks and the lock guarding the link to it are held, and since traversals acquire a node's lock
+// while holding that same link lock, no traversal can be waiting on the removed node. Holders of a
+// pointer from Resolve check Node.removed once they have the data lock.
+// A node with two children is kept in place and takes over its in-order successor's key and data.
+// onRemove, if not nil, is called with the removed data while the locks are still held. If it
+// returns an error the node is left in place and the error is returned.
+// Heights are not lowered by a deletion, so they become upper bounds.
+func (tree *BST[D]) Delete(key string, onRemove func(data D) error) (bool, error) {
+	return tree.remove(key, nil, onRemove)
+}
+
+// Reap is like Delete but only removes the node if stale reports its data as stale, and leaves the
+// node alone if anyone holds its data lock, as the data is then in use and about to change.
+func (tree *BST[D]) Reap(key string, stale func(data D) bool, onRemove func(data D) error) (bool, error) {
+	return tree.remove(key, func(node *Node[D]) bool { return stale(node.data) }, onRemove)
+}
+
+// Discard is like Reap but only removes the node if it is still empty, as a search that created it
+// left it when its caller stored nothing. onRemove is called with the zero value.
+func (tree *BST[D]) Discard(key string, onRemove func(data D) error) (bool, error) {
+	return tree.remove(key, func(node *Node[D]) bool { return node.empty }, onRemove)
+}
+
+// remove unlinks the node with the given key as described by Delete. If stale is not nil the node
+// is only removed if its data lock is free and stale reports the node as stale.
+func (tree *BST[D]) remove(key string, stale func(node *Node[D]) bool, onRemove func(data D) error) (bool, error) {
+	if tree.lockFree {
+		return tree.lfRemove(key, stale, onRemove)
+	}
+
+	// parentLock guards link, the pointer through which node was reached
+	parentLock := &tree.rootLock
+	link := &tree.root
+
+	parentLock.Lock()
+
+	for {
+		node := *link
+		if node == nil {
+			parentLock.Unlock()
+			return false, nil
+		}
+
+		// Try and obtain this node's lock
+		node.lock.Lock()
+
+		if node.key == key {
+			if stale == nil {
+				// Wait for anyone working on the node's data to finish
+				node.dataLock.Lock()
+			} else if !node.dataLock.TryLock() {
+				// Someone is working on the node's data, so it is about to be refreshed
+				node.lock.Unlock()
+				parentLock.Unlock()
+				return false, nil
+			} else if !stale(node) {
+				node.dataLock.Unlock()
+				node.lock.Unlock()
+				parentLock.Unlock()
+				return false, nil
+			}
+
+			var err error
+			if onRemove != nil {
+				err = onRemove(node.data)
+			}
+
+			if err == nil {
+				node.unlink(link)
+				tree.size.Add(-1)
+			}
+
+			node.dataLock.Unlock()
+			node.lock.Unlock()
+			parentLock.Unlock()
+			return err == nil, err
+		}
+
+		// Good now release the prior lock
+		parentLock.Unlock()
+
+		parentLock = &node.lock
+		if key < node.key {
+			link = &node.left
+		} else {
+			link = &node.right
+		}
+	}
+}
+
+// unlink removes this node from the tree through link. This node's locks and the lock guarding
+// link must be held.
+func (node *Node[D]) unlink(link **Node[D]) {
+	switch {
+	case node.left == nil:
+		*link = node.right
+		node.removed = true
+		return
+	case node.right == nil:
+		*link = node.left
+		node.removed = true
+		return
+	}
+
+	// Find the successor, the leftmost node of the right subtree. This node stays locked throughout,
+	// so successorLock always guards successorLink.
+	successorLock := &node.lock
+	successorLink := &node.right
+	successor := node.right
+	successor.lock.Lock()
+
+	for successor.left != nil {
+		next := successor.left
+		next.lock.Lock()
+
+		if successorLock != &node.lock {
+			successorLock.Unlock()
+		}
+
+		successorLock = &successor.lock
+		successorLink = &successor.left
+		successor = next
+	}
+
+	// Wait for anyone working on the successor's data to finish
+	successor.dataLock.Lock()
+
+	// The successor has no left child so its right subtree takes its place
+	*successorLink = successor.right
+	successor.removed = true
+
+	// Update this node to mirror the successor
+	node.key = successor.key
+	node.data = successor.data
+	node.empty = successor.empty
+
+	successor.dataLock.Unlock()
+	successor.lock.Unlock()
+	if successorLock != &node.lock {
+		successorLock.Unlock()
+	}
+}
+
+// Scan calls visit, in ascending key order, for each key in the range [start, end) until visit
+// returns false. An empty end leaves the range unbounded above. Each node is locked only while its
+// key, data or children are read, and visit is called with no locks held, so the scan is not a
+// point-in-time view: keys inserted, deleted or rotated concurrently may or may not be visited,
+// but no key is visited twice.
+func (tree *BST[D]) Scan(ctx context.Context, start string, end string, visit func(key string, data D) bool) error {
+	if tree.lockFree {
+		_, err := tree.lfRoot.Load().lfScan(ctx, start, end, visit)
+		return err
+	}
+
+	if err := lockContext(ctx, "root lock", &tree.rootLock); err != nil {
+		return err
+	}
+	root := tree.root
+	tree.rootLock.Unlock()
+
+	_, err := root.scanBST(ctx, start, end, visit)
+	return err
+}
+
+// scanBST performs an in-order traversal of the subtree rooted at this node, skipping subtrees that
+// fall outside [start, end). Each subtree is scanned within the bounds set by the keys above it, as
+// a node moved by a rotation or a deletion may otherwise be reached twice. It returns false once
+// visit asks to stop.
+func (node *Node[D]) scanBST(
+	ctx context.Context,
+	start string,
+	end string,
+	visit func(key string, data D) bool,
+) (bool, error) {
+	if node == nil {
+		return true, nil
+	}
+
+	if err := lockContext(ctx, "node lock", &node.lock); err != nil {
+		return false, err
+	}
+	key, left, right := node.key, node.left, node.right
+	node.lock.Unlock()
+
+	// Smaller keys can only be in range if this key is past the start
+	if key > start {
+		leftEnd := end
+		if end == "" || key < end {
+			leftEnd = key
+		}
+
+		if more, err := left.scanBST(ctx, start, leftEnd, visit); !more || err != nil {
+			return false, err
+		}
+	}
+
+	if key >= start && (end == "" || key < end) {
+		if err := lockContext(ctx, "data lock", &node.dataLock); err != nil {
+			return false, err
+		}
+		data, current := node.data, !node.removed && !node.empty && node.key == key
+		node.dataLock.Unlock()
+
+		// Skip the node if a concurrent deletion got to it first, or nothing was stored in it yet
+		if current && !visit(key, data) {
+			return false, nil
+		}
+	}
+
+	// Larger keys can only be in range if this key is before the end. The smallest key after this
+	// one is the key followed by a zero byte
+	if end == "" || key < end {
+		return right.scanBST(ctx, max(start, key+"\x00"), end, visit)
+	}
+
+	return true, nil
 }
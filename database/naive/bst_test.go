@@ -2,6 +2,9 @@
 package naive
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math/rand"
 	"sort"
 	"strconv"
@@ -12,7 +15,7 @@ import (
 
 // TestBSTHeightCalulcations tests the height of the BST after concurrent inserts.
 func TestInsertBST(t *testing.T) {
-	bst := NewBST()
+	bst := NewBST[any]()
 
 	var wg sync.WaitGroup
 	const numInserts = 100
@@ -56,7 +59,7 @@ func TestInsertBSTWithRandomKeys(t *testing.T) {
 	}
 	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
 
-	bst := NewBST()
+	bst := NewBST[any]()
 
 	var wg sync.WaitGroup
 	concurrencyLevel := 6
@@ -94,7 +97,7 @@ func TestInsertBSTWithRandomKeys(t *testing.T) {
 	}
 }
 
-func (node *Node) heightTestHelper(t *testing.T, count int) (int32, int) {
+func (node *Node[D]) heightTestHelper(t *testing.T, count int) (int32, int) {
 	if node == nil {
 		if node.getHeight() != -1 {
 			t.Errorf("Expected height of nil node to be -1, got %d", node.getHeight())
@@ -124,7 +127,7 @@ func (node *Node) heightTestHelper(t *testing.T, count int) (int32, int) {
 }
 
 func TestInSearchBST(t *testing.T) {
-	bst := NewBST()
+	bst := NewBST[any]()
 
 	var wg sync.WaitGroup
 	const numInserts = 100
@@ -142,11 +145,15 @@ func TestInSearchBST(t *testing.T) {
 				} else {
 					key = strconv.Itoa(goroutineID*numInserts + j)
 				}
-				node := bst.InSearch(key)
+				node, err := bst.InSearch(context.Background(), key)
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+					return
+				}
 
 				time.Sleep(time.Duration(rand.Intn(100)) * time.Nanosecond)
 
-				node.lock.Unlock()
+				node.dataLock.Unlock()
 			}
 		}(i)
 	}
@@ -164,3 +171,296 @@ func TestInSearchBST(t *testing.T) {
 		t.Errorf("Total differences %d", count)
 	}
 }
+
+func TestDeleteBST(t *testing.T) {
+	bst := NewBST[any]()
+
+	const numKeys = 500
+	const concurrencyLevel = 10
+
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	for _, key := range keys {
+		bst.Insert(key)
+	}
+
+	// Concurrently delete every other key while looking up the rest
+	var wg sync.WaitGroup
+	for i := 0; i < concurrencyLevel; i++ {
+		wg.Add(1)
+		go func(goroutineID int) {
+			defer wg.Done()
+			for j := goroutineID; j < numKeys; j += concurrencyLevel {
+				if j%2 == 0 {
+					if deleted, _ := bst.Delete(keys[j], nil); !deleted {
+						t.Errorf("Expected %s to be deleted", keys[j])
+					}
+					continue
+				}
+
+				node, err := bst.InSearch(context.Background(), keys[j])
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+					return
+				}
+				node.dataLock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	expected := []string{}
+	for j := 1; j < numKeys; j += 2 {
+		expected = append(expected, keys[j])
+	}
+	sort.Strings(expected)
+
+	result := bst.GetKeys()
+	if len(expected) != len(result) {
+		t.Fatalf("Expected and result slices differ in length; expected: %d, got: %d", len(expected), len(result))
+	}
+
+	for i, expectedKey := range expected {
+		if expectedKey != result[i] {
+			t.Errorf("Key mismatch at index %d; expected: %s, got: %s", i, expectedKey, result[i])
+		}
+	}
+
+	if deleted, _ := bst.Delete(keys[0], nil); deleted {
+		t.Errorf("Expected %s to be gone already", keys[0])
+	}
+}
+
+func TestRebalancingBST(t *testing.T) {
+	bst := NewBST[any]()
+	bst.rebalance = true
+
+	const numKeys = 1000
+	const concurrencyLevel = 10
+
+	// Ascending keys degenerate a plain BST into a list
+	for i := 0; i < numKeys; i++ {
+		node, err := bst.InSearch(context.Background(), fmt.Sprintf("%04d", i))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		node.dataLock.Unlock()
+	}
+
+	if height := bst.root.getHeight(); height > 20 {
+		t.Errorf("Expected rotations to keep the height of %d keys down, got %d", numKeys, height)
+	}
+	if bst.rotations.Load() == 0 {
+		t.Errorf("Expected rotations")
+	}
+
+	// Rotations must not lose or misplace keys while others search and delete concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < concurrencyLevel; i++ {
+		wg.Add(1)
+		go func(goroutineID int) {
+			defer wg.Done()
+			for j := goroutineID; j < numKeys; j += concurrencyLevel {
+				if j%3 == 0 {
+					if deleted, _ := bst.Delete(fmt.Sprintf("%04d", j), nil); !deleted {
+						t.Errorf("Expected %04d to be deleted", j)
+					}
+					continue
+				}
+
+				node, err := bst.InSearch(context.Background(), fmt.Sprintf("%04d", numKeys+j))
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+					return
+				}
+				node.dataLock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	expected := []string{}
+	for i := 0; i < numKeys; i++ {
+		if i%3 != 0 {
+			expected = append(expected, fmt.Sprintf("%04d", i))
+		}
+	}
+	for i := 0; i < numKeys; i++ {
+		if i%3 != 0 {
+			expected = append(expected, fmt.Sprintf("%04d", numKeys+i))
+		}
+	}
+
+	result := bst.GetKeys()
+	if len(expected) != len(result) {
+		t.Fatalf("Expected and result slices differ in length; expected: %d, got: %d", len(expected), len(result))
+	}
+
+	for i, expectedKey := range expected {
+		if expectedKey != result[i] {
+			t.Errorf("Key mismatch at index %d; expected: %s, got: %s", i, expectedKey, result[i])
+		}
+	}
+
+	if size := bst.size.Load(); size != int64(len(expected)) {
+		t.Errorf("Expected a size of %d, got %d", len(expected), size)
+	}
+}
+
+func TestLockFreeBST(t *testing.T) {
+	bst := NewBST[any]()
+	bst.lockFree = true
+
+	const numKeys = 1000
+	const concurrencyLevel = 10
+
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%04d", i)
+	}
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	for _, key := range keys {
+		bst.Insert(key)
+	}
+
+	// Scans must stay in ascending order without repeats while nodes are unlinked and replaced
+	stop := make(chan struct{})
+	var scanner sync.WaitGroup
+	scanner.Add(1)
+	go func() {
+		defer scanner.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			previous := ""
+			err := bst.Scan(context.Background(), "", "", func(key string, _ any) bool {
+				if key <= previous {
+					t.Errorf("Expected %q to come after %q", key, previous)
+					return false
+				}
+				previous = key
+				return true
+			})
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+		}
+	}()
+
+	// Delete every third key while inserting new keys and looking up the rest
+	var wg sync.WaitGroup
+	for i := 0; i < concurrencyLevel; i++ {
+		wg.Add(1)
+		go func(goroutineID int) {
+			defer wg.Done()
+			for j := goroutineID; j < numKeys; j += concurrencyLevel {
+				if j%3 == 0 {
+					if deleted, _ := bst.Delete(keys[j], nil); !deleted {
+						t.Errorf("Expected %s to be deleted", keys[j])
+					}
+					continue
+				}
+
+				for _, key := range []string{keys[j], fmt.Sprintf("%04d", numKeys+j)} {
+					node, err := bst.InSearch(context.Background(), key)
+					if err != nil {
+						t.Errorf("Unexpected error: %v", err)
+						return
+					}
+					if node.key != key || node.removed {
+						t.Errorf("Expected the node of %s, got %s (removed: %t)", key, node.key, node.removed)
+					}
+					node.dataLock.Unlock()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	scanner.Wait()
+
+	expected := []string{}
+	for j := 0; j < numKeys; j++ {
+		if j%3 != 0 {
+			expected = append(expected, keys[j], fmt.Sprintf("%04d", numKeys+j))
+		}
+	}
+	sort.Strings(expected)
+
+	result := bst.GetKeys()
+	if len(expected) != len(result) {
+		t.Fatalf("Expected and result slices differ in length; expected: %d, got: %d", len(expected), len(result))
+	}
+
+	for i, expectedKey := range expected {
+		if expectedKey != result[i] {
+			t.Errorf("Key mismatch at index %d; expected: %s, got: %s", i, expectedKey, result[i])
+		}
+	}
+
+	if size := bst.size.Load(); size != int64(len(expected)) {
+		t.Errorf("Expected a size of %d, got %d", len(expected), size)
+	}
+	if bst.root != nil || bst.maxHeight.Load() == 0 {
+		t.Errorf("Expected only the lock-free tree to be used, and its height to be observed")
+	}
+}
+
+func TestReapBST(t *testing.T) {
+	bst := NewBST[int]()
+
+	// Negative data is stale
+	stale := func(data int) bool { return data < 0 }
+
+	for i, data := range []int{-1, 1, -1, -1} {
+		node, err := bst.InSearch(context.Background(), strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		node.data = data
+		node.dataLock.Unlock()
+	}
+
+	// A node someone is working on is left alone
+	busy := bst.Search("2")
+	if reaped, _ := bst.Reap("2", stale, nil); reaped {
+		t.Errorf("Expected a locked node not to be reaped")
+	}
+	busy.dataLock.Unlock()
+
+	if reaped, _ := bst.Reap("1", stale, nil); reaped {
+		t.Errorf("Expected a fresh node not to be reaped")
+	}
+
+	if reaped, _ := bst.Reap("missing", stale, nil); reaped {
+		t.Errorf("Expected a missing node not to be reaped")
+	}
+
+	errRefused := errors.New("refused")
+	if reaped, err := bst.Reap("3", stale, func(_ int) error { return errRefused }); reaped || !errors.Is(err, errRefused) {
+		t.Errorf("Expected the node to be kept when onRemove fails, got %t, %v", reaped, err)
+	}
+
+	for _, key := range []string{"0", "2", "3"} {
+		if reaped, err := bst.Reap(key, stale, nil); !reaped || err != nil {
+			t.Errorf("Expected %s to be reaped, got %t, %v", key, reaped, err)
+		}
+	}
+
+	if keys := bst.GetKeys(); len(keys) != 1 || keys[0] != "1" {
+		t.Errorf("Expected only the fresh key to remain, got %v", keys)
+	}
+	if size := bst.size.Load(); size != 1 {
+		t.Errorf("Expected a size of 1, got %d", size)
+	}
+}
@@ -0,0 +1,225 @@
+//nolint:testpackage // Allow tests to access the naive package
+package naive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+// bucket is immutable once stored: the copy-on-write callback always returns a new one.
+type bucket struct {
+	count int
+}
+
+func cowCallback(current *bucket, params int) (*bucket, int, error) {
+	next := &bucket{count: params}
+	if current != nil {
+		next.count += current.count
+	}
+	return next, next.count, nil
+}
+
+func newCOWDB(opts ...Option) *DB[*bucket, int, int] {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	evict := func(_ *bucket) bool { return false }
+
+	return NewDB(cowCallback, evict, nil, nil, nil, logger, opts...)
+}
+
+// expectCounts checks the count of every key, where a count of zero means the key must not exist.
+func expectCounts(t *testing.T, db *DB[*bucket, int, int], expected map[string]int) {
+	t.Helper()
+
+	for key, count := range expected {
+		data, ok, _ := db.Peek(key)
+		switch {
+		case count == 0 && ok:
+			t.Errorf("Expected %s not to exist, got %d", key, data.count)
+		case count != 0 && !ok:
+			t.Errorf("Expected %s to be at %d, but it does not exist", key, count)
+		case count != 0 && data.count != count:
+			t.Errorf("Expected %s to be at %d, got %d", key, count, data.count)
+		}
+	}
+}
+
+func TestCOWUpdatesSurviveASwitchover(t *testing.T) {
+	db := newCOWDB(WithSwapPolicy(AllPolicy{}))
+	defer db.Shutdown()
+
+	ctx := context.Background()
+	expected := map[string]int{}
+
+	// Every update replaces the data, so the AVL tree must keep the latest value of each key
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%02d", i%10)
+		if _, err := db.Calculate(ctx, key, 1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		expected[key]++
+	}
+
+	if err := db.switchover(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectCounts(t, db, expected)
+}
+
+func TestCOWUntouchedKeysSurviveSwitchovers(t *testing.T) {
+	db := newCOWDB(WithSwapPolicy(AllPolicy{}))
+	defer db.Shutdown()
+
+	ctx := context.Background()
+	expected := map[string]int{}
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		if _, err := db.Calculate(ctx, key, i+1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		expected[key] = i + 1
+	}
+
+	// Only some of the keys are touched between switchovers, the rest must carry over untouched
+	for round := 0; round < 3; round++ {
+		if err := db.switchover(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		key := fmt.Sprintf("key%02d", round)
+		if _, err := db.Calculate(ctx, key, 100); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		expected[key] += 100
+	}
+
+	if err := db.switchover(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectCounts(t, db, expected)
+}
+
+func TestCOWTxnAndDeleteSurviveASwitchover(t *testing.T) {
+	db := newCOWDB(WithSwapPolicy(AllPolicy{}))
+	defer db.Shutdown()
+
+	ctx := context.Background()
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := db.Calculate(ctx, key, 1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	commit := func(_ []int) bool { return true }
+	if _, _, err := db.CalculateMany(ctx, []string{"a", "b", "a"}, []int{1, 1, 1}, commit); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if deleted, err := db.Delete("c"); err != nil || !deleted {
+		t.Fatalf("Expected c to be deleted: %v", err)
+	}
+
+	if err := db.switchover(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectCounts(t, db, map[string]int{"a": 3, "b": 2, "c": 0})
+}
+
+func TestCOWConcurrentSwitchovers(t *testing.T) {
+	// Swap as often as possible while the keys are being updated
+	db := newCOWDB(WithSwapPolicy(BalanceFactorPolicy{Threshold: 0}), WithQueue(DefaultQueueSize, OverflowCoalesce))
+	defer db.Shutdown()
+
+	const numKeys = 50
+	const concurrencyLevel = 8
+	const rounds = 20
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrencyLevel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				for i := 0; i < numKeys; i++ {
+					if _, err := db.Calculate(context.Background(), fmt.Sprintf("key%02d", i), 1); err != nil {
+						t.Errorf("Unexpected error: %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := db.switchover(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := map[string]int{}
+	for i := 0; i < numKeys; i++ {
+		expected[fmt.Sprintf("key%02d", i)] = concurrencyLevel * rounds
+	}
+	expectCounts(t, db, expected)
+
+	if swaps := db.Swaps(); swaps["balance-factor"] == 0 {
+		t.Errorf("Expected switchovers while the keys were updated, got %v", swaps)
+	}
+}
+
+func TestCOWUpdatesDuringARebuildSurvive(t *testing.T) {
+	db := newCOWDB(WithSwapPolicy(AllPolicy{}))
+	defer db.Shutdown()
+
+	ctx := context.Background()
+	expected := map[string]int{}
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		if _, err := db.Calculate(ctx, key, 1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		expected[key]++
+	}
+
+	db.swapLock.Lock()
+	if err := db.swap(); err != nil {
+		db.swapLock.Unlock()
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Calculations carry on before the AVL tree is rebuilt, and their updates are held back
+	for i := 10; i < 30; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		if _, err := db.Calculate(ctx, key, 1); err != nil {
+			db.swapLock.Unlock()
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		expected[key]++
+	}
+	if _, err := db.Delete("key00"); err != nil {
+		db.swapLock.Unlock()
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected["key00"] = 0
+
+	db.rwLock.Lock()
+	err := db.flush()
+	db.rwLock.Unlock()
+	if err != nil {
+		db.swapLock.Unlock()
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	db.rebuildAVL()
+	db.swapLock.Unlock()
+
+	// The next switchover swaps in the rebuilt tree, which must have every update
+	if err = db.switchover(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectCounts(t, db, expected)
+}
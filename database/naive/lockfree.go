@@ -0,0 +1,415 @@
+package naive
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+)
+
+// lfNode is a node of a lock-free BST. Its child links are loaded atomically, so searches take no
+// locks at all. The key, data and locks live in the wrapped Node, whose own children are unused:
+// its lock guards the lfNode's links for writers and its data lock is used as in a locking BST.
+// Keys never change in place, so a Node that takes over the position of a removed one is wrapped in
+// a new lfNode, and the lfNode it leaves behind is detached.
+type lfNode[D any] struct {
+	node     *Node[D]
+	left     atomic.Pointer[lfNode[D]]
+	right    atomic.Pointer[lfNode[D]]
+	height   atomic.Int32
+	detached bool // Detached is set under node.lock once the lfNode is unlinked from the tree.
+}
+
+// newLFNode wraps the node in a new lfNode.
+func newLFNode[D any](node *Node[D]) *lfNode[D] {
+	return &lfNode[D]{node: node}
+}
+
+// newLFTree wraps every node of the tree rooted at node, which must not be in use, in an lfNode.
+func newLFTree[D any](node *Node[D]) *lfNode[D] {
+	if node == nil {
+		return nil
+	}
+
+	wrapped := newLFNode(node)
+	wrapped.left.Store(newLFTree(node.left))
+	wrapped.right.Store(newLFTree(node.right))
+	wrapped.height.Store(node.height.Load())
+
+	return wrapped
+}
+
+// getHeight atomically returns the height of the node, or -1 if the node is nil.
+func (node *lfNode[D]) getHeight() int32 {
+	if node == nil {
+		return -1
+	}
+	return node.height.Load()
+}
+
+// raiseHeight atomically raises the height of the node to height, if it is lower.
+func (node *lfNode[D]) raiseHeight(height int32) {
+	for observed := node.height.Load(); height > observed; observed = node.height.Load() {
+		if node.height.CompareAndSwap(observed, height) {
+			return
+		}
+	}
+}
+
+// getBalanceFactor returns the magnitude of the node's balance factor, or zero if it is below
+// BfThreshold.
+func (node *lfNode[D]) getBalanceFactor() int32 {
+	balanceFactor := absInt32(node.left.Load().getHeight() - node.right.Load().getHeight())
+	if balanceFactor < BfThreshold {
+		return 0
+	}
+	return balanceFactor
+}
+
+// find returns the node holding the key, the node it hangs from and the link between them. If the
+// key does not exist, the returned node is nil and the link is the one the key would hang from.
+func (tree *BST[D]) find(key string) (*lfNode[D], *lfNode[D], *atomic.Pointer[lfNode[D]]) {
+	var parent *lfNode[D]
+	link := &tree.lfRoot
+
+	for node := link.Load(); node != nil; node = link.Load() {
+		if node.node.key == key {
+			return node, parent, link
+		}
+
+		parent = node
+		if key < node.node.key {
+			link = &node.left
+		} else {
+			link = &node.right
+		}
+	}
+
+	return nil, parent, link
+}
+
+// lfSearch is Search for a lock-free BST. A node removed between being found and having its data
+// locked is looked up again.
+func (tree *BST[D]) lfSearch(key string) *Node[D] {
+	for {
+		found, _, _ := tree.find(key)
+		if found == nil {
+			return nil
+		}
+
+		found.node.dataLock.Lock()
+		if !found.node.removed {
+			return found.node
+		}
+		found.node.dataLock.Unlock()
+	}
+}
+
+// lfInSearch is InSearch for a lock-free BST. A node removed between being found and having its
+// data locked is looked up again.
+func (tree *BST[D]) lfInSearch(ctx context.Context, key string) (*Node[D], error) {
+	for {
+		found, err := tree.lfResolve(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = lockContext(ctx, "data lock", &found.dataLock); err != nil {
+			return nil, err
+		}
+		if !found.removed {
+			return found, nil
+		}
+		found.dataLock.Unlock()
+	}
+}
+
+// lfResolve is Resolve for a lock-free BST. No lock is taken unless the key is new, and then only
+// the lock of the node it hangs from.
+func (tree *BST[D]) lfResolve(ctx context.Context, key string) (*Node[D], error) {
+	// Most trees are shallow enough for the path not to escape to the heap
+	var stack [32]*lfNode[D]
+
+	for {
+		path := stack[:0]
+		var balanceFactor int32
+
+		node := tree.lfRoot.Load()
+		for node != nil && node.node.key != key {
+			path = append(path, node)
+			balanceFactor += node.getBalanceFactor()
+
+			if key < node.node.key {
+				node = node.left.Load()
+			} else {
+				node = node.right.Load()
+			}
+		}
+
+		if node != nil {
+			tree.observe(balanceFactor+node.getBalanceFactor(), tree.lfRoot.Load().getHeight())
+			return node.node, nil
+		}
+
+		node, err := tree.lfInsert(ctx, path, key)
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			// The tree changed under the search, so try again
+			continue
+		}
+
+		tree.observe(balanceFactor, tree.lfRoot.Load().getHeight())
+		return node.node, nil
+	}
+}
+
+// lfInsert hangs a new node with the key from the last node of path, the nodes a search passed on
+// its way down, and raises their heights. The link is set under the lock of the node it hangs from,
+// so it cannot land on a node being unlinked. lfInsert returns nil if the link was taken or the
+// node detached meanwhile.
+func (tree *BST[D]) lfInsert(ctx context.Context, path []*lfNode[D], key string) (*lfNode[D], error) {
+	leaf := newLFNode(newBSTNode[D](key))
+
+	if len(path) == 0 {
+		// The root has no node to be detached from, so the link alone decides
+		if !tree.lfRoot.CompareAndSwap(nil, leaf) {
+			return nil, nil
+		}
+
+		tree.size.Add(1)
+		return leaf, nil
+	}
+
+	parent := path[len(path)-1]
+	if err := lockContext(ctx, "node lock", &parent.node.lock); err != nil {
+		return nil, err
+	}
+
+	link := &parent.right
+	if key < parent.node.key {
+		link = &parent.left
+	}
+
+	linked := !parent.detached && link.CompareAndSwap(nil, leaf)
+	parent.node.lock.Unlock()
+
+	if !linked {
+		return nil, nil
+	}
+	tree.size.Add(1)
+
+	for i, node := range path {
+		node.raiseHeight(int32(len(path) - i))
+	}
+
+	return leaf, nil
+}
+
+// lfRemove is remove for a lock-free BST. The node is found without locks, then the lock guarding
+// the link to it is taken and the link checked, as the node may have been unlinked or its parent
+// detached meanwhile.
+func (tree *BST[D]) lfRemove(key string, stale func(node *Node[D]) bool, onRemove func(data D) error) (bool, error) {
+	for {
+		node, parent, link := tree.find(key)
+		if node == nil {
+			return false, nil
+		}
+
+		parentLock := &tree.rootLock
+		if parent != nil {
+			parentLock = &parent.node.lock
+		}
+		parentLock.Lock()
+
+		if (parent != nil && parent.detached) || link.Load() != node {
+			parentLock.Unlock()
+			continue
+		}
+
+		successorParent, successor, ok := node.tryLockUnlink()
+		if !ok {
+			parentLock.Unlock()
+			runtime.Gosched()
+			continue
+		}
+
+		unlock := func() {
+			node.unlockUnlink(successorParent, successor)
+			parentLock.Unlock()
+		}
+
+		if stale == nil {
+			// Wait for anyone working on the node's data to finish
+			node.node.dataLock.Lock()
+		} else if !node.node.dataLock.TryLock() {
+			// Someone is working on the node's data, so it is about to be refreshed
+			unlock()
+			return false, nil
+		} else if !stale(node.node) {
+			node.node.dataLock.Unlock()
+			unlock()
+			return false, nil
+		}
+
+		var err error
+		if onRemove != nil {
+			err = onRemove(node.node.data)
+		}
+
+		if err == nil {
+			node.unlink(link, successorParent, successor)
+			tree.size.Add(-1)
+		}
+
+		node.node.dataLock.Unlock()
+		unlock()
+		return err == nil, err
+	}
+}
+
+// tryLockUnlink takes the locks unlinking this node needs besides the one guarding the link to it:
+// its own and, if it has two children, those of its in-order successor and of the node the
+// successor hangs from, which are returned. A successor moves above the nodes it passed when it
+// takes over a removed node's position, so these locks cannot be taken in a fixed order and are
+// only tried. tryLockUnlink reports false, holding none of them, if a lock is taken or the
+// successor changed before it was locked.
+func (node *lfNode[D]) tryLockUnlink() (*lfNode[D], *lfNode[D], bool) {
+	if !node.node.lock.TryLock() {
+		return nil, nil, false
+	}
+
+	right := node.right.Load()
+	if node.left.Load() == nil || right == nil {
+		return nil, nil, true
+	}
+
+	// The successor is the leftmost node of the right subtree
+	parent, successor := node, right
+	for next := successor.left.Load(); next != nil; next = successor.left.Load() {
+		parent, successor = successor, next
+	}
+
+	if parent != node && !parent.node.lock.TryLock() {
+		node.node.lock.Unlock()
+		return nil, nil, false
+	}
+
+	if !successor.node.lock.TryLock() {
+		node.unlockUnlink(parent, nil)
+		return nil, nil, false
+	}
+
+	linked := node.right.Load() == successor
+	if parent != node {
+		linked = !parent.detached && parent.left.Load() == successor
+	}
+
+	if !linked || successor.detached || successor.left.Load() != nil {
+		node.unlockUnlink(parent, successor)
+		return nil, nil, false
+	}
+
+	return parent, successor, true
+}
+
+// unlockUnlink releases the locks taken by tryLockUnlink.
+func (node *lfNode[D]) unlockUnlink(successorParent *lfNode[D], successor *lfNode[D]) {
+	if successor != nil {
+		successor.node.lock.Unlock()
+	}
+	if successorParent != nil && successorParent != node {
+		successorParent.node.lock.Unlock()
+	}
+	node.node.lock.Unlock()
+}
+
+// unlink removes this node from the tree through link. The lock guarding link, the locks taken by
+// tryLockUnlink and this node's data lock must be held.
+func (node *lfNode[D]) unlink(link *atomic.Pointer[lfNode[D]], successorParent *lfNode[D], successor *lfNode[D]) {
+	switch {
+	case successor == nil && node.left.Load() == nil:
+		link.Store(node.right.Load())
+	case successor == nil:
+		link.Store(node.left.Load())
+	default:
+		// The successor takes over this position in a new lfNode. It can be reached from both
+		// positions until the old one is unlinked, so a search never misses it
+		replacement := newLFNode(successor.node)
+		replacement.left.Store(node.left.Load())
+		if successorParent == node {
+			replacement.right.Store(successor.right.Load())
+		} else {
+			replacement.right.Store(node.right.Load())
+		}
+		replacement.height.Store(1 + max(replacement.left.Load().getHeight(), replacement.right.Load().getHeight()))
+
+		link.Store(replacement)
+		if successorParent != node {
+			successorParent.left.Store(successor.right.Load())
+		}
+		successor.detached = true
+	}
+
+	node.detached = true
+	node.node.removed = true
+}
+
+// lfScan is scanBST for a lock-free BST. Only data locks are taken, while the data is read.
+func (node *lfNode[D]) lfScan(
+	ctx context.Context,
+	start string,
+	end string,
+	visit func(key string, data D) bool,
+) (bool, error) {
+	if node == nil {
+		return true, nil
+	}
+
+	key := node.node.key
+
+	// Smaller keys can only be in range if this key is past the start
+	if key > start {
+		leftEnd := end
+		if end == "" || key < end {
+			leftEnd = key
+		}
+
+		if more, err := node.left.Load().lfScan(ctx, start, leftEnd, visit); !more || err != nil {
+			return false, err
+		}
+	}
+
+	if key >= start && (end == "" || key < end) {
+		if err := lockContext(ctx, "data lock", &node.node.dataLock); err != nil {
+			return false, err
+		}
+		data, current := node.node.data, !node.node.removed && !node.node.empty
+		node.node.dataLock.Unlock()
+
+		// Skip the node if a concurrent deletion got to it first, or nothing was stored in it yet
+		if current && !visit(key, data) {
+			return false, nil
+		}
+	}
+
+	// Larger keys can only be in range if this key is before the end
+	if end == "" || key < end {
+		return node.right.Load().lfScan(ctx, max(start, key+"\x00"), end, visit)
+	}
+
+	return true, nil
+}
+
+// inorderDesc collects the keys of the subtree rooted at this node in ascending order.
+func (node *lfNode[D]) inorderDesc(keys []string) []string {
+	if node == nil {
+		return keys
+	}
+
+	keys = node.left.Load().inorderDesc(keys)
+	keys = append(keys, node.node.key)
+	keys = node.right.Load().inorderDesc(keys)
+
+	return keys
+}
@@ -2,51 +2,223 @@ package naive
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"log/slog"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/dominicfollett/argus-db/database/admission"
+	"github.com/dominicfollett/argus-db/database/expiry"
+	"github.com/dominicfollett/argus-db/database/snapshot"
+	"github.com/dominicfollett/argus-db/database/wal"
 )
 
+// TriggerThreshold is the threshold of the default BalanceFactorPolicy.
 const TriggerThreshold float64 = 50
 
-type DB struct {
-	bst         *BST
-	avl         *AVL
-	callback    func(data any, params any) (any, any, error)
-	evict       func(data any) bool
-	avlChannel  chan Message
-	rwLock      *sync.RWMutex
-	avlLock     *sync.Mutex
-	totalOps    *atomic.Int64
-	stopRoutine context.CancelFunc
-	wg          *sync.WaitGroup
-	logger      *slog.Logger
-}
-
-func NewDB(
-	callback func(data any, params any) (any, any, error),
-	evict func(data any) bool,
-	logger *slog.Logger) *DB {
+// FlushTimeout bounds how long a switchover waits for the AVL goroutine to catch up while
+// calculations are paused. A switchover that times out is abandoned and tried again on a later
+// trigger.
+const FlushTimeout = 100 * time.Millisecond
+
+// DefaultReapInterval is how often the reaper removes expired keys from the BST by default.
+const DefaultReapInterval = 1 * time.Second
+
+type DB[D, P, R any] struct {
+	bst          *BST[D]
+	avl          *AVL[D]
+	callback     func(data D, params P) (D, R, error)
+	evict        func(data D) bool
+	expiresAt    func(data D) time.Time
+	expiry       *expiry.Index[D] // expiry orders the AVL tree's keys by expiry time, if expiresAt is set.
+	codec        snapshot.Codec[D]
+	journal      wal.Journal[D]
+	queue        *avlQueue[D]       // queue carries updates from the BST to the AVL goroutine.
+	limiter      *admission.Tracker // limiter bounds the keys held, if limits are set.
+	rwLock       *sync.RWMutex
+	avlLock      *sync.Mutex
+	rebuilding   bool         // rebuilding is set under the avl lock while switchover rebuilds the AVL tree.
+	pending      []Message[D] // pending holds the updates that arrive while rebuilding, under the avl lock.
+	swapLock     sync.Mutex   // swapLock keeps switchovers and restores from running at the same time.
+	totalOps     *atomic.Int64
+	rebalance    bool         // rebalance replaces the shadow AVL tree with rotations in the BST.
+	lastSwap     atomic.Int64 // lastSwap is the time of the last switchover, in Unix nanoseconds.
+	policy       SwapPolicy
+	swapsLock    sync.Mutex
+	swaps        map[string]int64 // swaps counts the switchovers by the policy that fired.
+	trigger      chan struct{}    // trigger signals the switchover goroutine that the policy fired.
+	reapInterval time.Duration
+	stopRoutine  context.CancelFunc
+	routines     *sync.WaitGroup // routines waits for the switchover and reaper goroutines.
+	wg           *sync.WaitGroup
+	logger       *slog.Logger
+}
+
+// config holds the optional DB settings.
+type config struct {
+	policy       SwapPolicy
+	rebalance    bool
+	lockFree     bool
+	reapInterval time.Duration
+	queueSize    int
+	overflow     OverflowPolicy
+	limits       *admission.Limits
+}
+
+// Option configures optional DB settings.
+type Option func(c *config)
+
+// WithSwapPolicy sets the policy deciding when the BST is replaced by the AVL tree. The default is a
+// BalanceFactorPolicy with a threshold of TriggerThreshold. A nil policy is ignored.
+func WithSwapPolicy(policy SwapPolicy) Option {
+	return func(c *config) {
+		if policy != nil {
+			c.policy = policy
+		}
+	}
+}
+
+// WithRebalancing keeps the BST balanced by rotating it in place as it is searched, instead of
+// maintaining a shadow AVL tree and swapping it in. This saves the memory of the second tree and the
+// switchover pauses, at the cost of rotations on the request path. Swap policies are ignored.
+func WithRebalancing() Option {
+	return func(c *config) {
+		c.rebalance = true
+	}
+}
+
+// WithLockFreeReads searches the BST without locks, loading its child pointers atomically and only
+// locking the node a request works on, so the root is no longer a point every request contends on.
+// Rotations would move nodes under such searches, so WithRebalancing takes precedence.
+func WithLockFreeReads() Option {
+	return func(c *config) {
+		c.lockFree = true
+	}
+}
+
+// WithReapInterval sets how often the reaper removes expired keys from the BST. Non-positive values
+// are ignored.
+func WithReapInterval(interval time.Duration) Option {
+	return func(c *config) {
+		if interval > 0 {
+			c.reapInterval = interval
+		}
+	}
+}
+
+// WithQueue sets the number of updates the queue to the AVL goroutine holds, and what happens to
+// updates published while it is full. The default is DefaultQueueSize and OverflowBlock. Sizes
+// smaller than one are ignored.
+func WithQueue(size int, overflow OverflowPolicy) Option {
+	return func(c *config) {
+		if size > 0 {
+			c.queueSize = size
+		}
+		c.overflow = overflow
+	}
+}
+
+// WithLimits bounds the number of keys held and their estimated size. New keys that need room evict
+// the keys the limits' policy picks, or are handled by its fallback if they cannot be admitted.
+func WithLimits(limits admission.Limits) Option {
+	return func(c *config) {
+		c.limits = &limits
+	}
+}
+
+func NewDB[D, P, R any](
+	callback func(data D, params P) (D, R, error),
+	evict func(data D) bool,
+	expiresAt func(data D) time.Time,
+	codec snapshot.Codec[D],
+	journal wal.Journal[D],
+	logger *slog.Logger,
+	opts ...Option) *DB[D, P, R] {
 	logger.Info("initializing naive DB...")
 
+	c := &config{
+		policy:       BalanceFactorPolicy{Threshold: TriggerThreshold},
+		reapInterval: DefaultReapInterval,
+		queueSize:    DefaultQueueSize,
+		overflow:     OverflowBlock,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
 	totalOps := atomic.Int64{}
 	totalOps.Store(1)
 
 	context, cancel := context.WithCancel(context.Background())
 
-	db := &DB{
-		bst:         NewBST(),
-		avl:         NewAVL(),
-		callback:    callback,
-		evict:       evict,
-		avlChannel:  make(chan Message),
-		avlLock:     &sync.Mutex{},
-		rwLock:      &sync.RWMutex{},
-		totalOps:    &totalOps,
-		stopRoutine: cancel,
-		wg:          &sync.WaitGroup{},
-		logger:      logger,
+	db := &DB[D, P, R]{
+		bst:          NewBST[D](),
+		avl:          NewAVL[D](),
+		callback:     callback,
+		evict:        evict,
+		expiresAt:    expiresAt,
+		codec:        codec,
+		journal:      journal,
+		queue:        newAVLQueue[D](c.queueSize, c.overflow),
+		avlLock:      &sync.Mutex{},
+		rwLock:       &sync.RWMutex{},
+		totalOps:     &totalOps,
+		rebalance:    c.rebalance,
+		policy:       c.policy,
+		swaps:        map[string]int64{},
+		trigger:      make(chan struct{}, 1),
+		reapInterval: c.reapInterval,
+		stopRoutine:  cancel,
+		routines:     &sync.WaitGroup{},
+		wg:           &sync.WaitGroup{},
+		logger:       logger,
+	}
+	db.lastSwap.Store(time.Now().UnixNano())
+	db.bst.lockFree = c.lockFree && !c.rebalance
+
+	if expiresAt != nil {
+		db.expiry = expiry.NewIndex[D]()
+	}
+
+	if c.limits != nil {
+		db.limiter = admission.NewTracker(*c.limits)
+	}
+
+	// Start the reaper
+	db.routines.Add(1)
+	go func() {
+		defer db.routines.Done()
+
+		db.logger.Info("Starting reaper", "interval", db.reapInterval)
+
+		ticker := time.NewTicker(db.reapInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-context.Done():
+				db.logger.Info("Reaper stopped. Exiting")
+				return
+			case <-ticker.C:
+				reaped, err := db.reap(context)
+				if err != nil && context.Err() == nil {
+					db.logger.Warn("reaper, pass abandoned", "error", err)
+				}
+				if reaped > 0 {
+					db.logger.Debug("reaper, records evicted", "count", reaped)
+				}
+			}
+		}
+	}()
+
+	if db.rebalance {
+		// There is no shadow tree to maintain or swap in
+		db.bst.rebalance = true
+		return db
 	}
 
 	db.wg.Add(1)
@@ -54,28 +226,41 @@ func NewDB(
 	go func() {
 		defer db.wg.Done()
 
-		db.logger.Info("Starting AVL goroutine")
-		// We'll use channel closure to signal the end of the go routine
-		for message := range db.avlChannel {
-			db.avlLock.Lock()
+		db.logger.Info("Starting AVL goroutine", "queue size", c.queueSize, "overflow", c.overflow)
+		// We'll use closing the queue to signal the end of the go routine
+		for {
+			messages, ok := db.queue.pop()
+			if !ok {
+				break
+			}
 
-			db.avl.Insert(message.key, message.data)
+			db.avlLock.Lock()
 
-			// Run eviction job
-			keys := db.avl.Survey(db.evict)
-			for _, key := range keys {
-				db.avl.Delete(key)
+			for _, message := range messages {
+				switch {
+				case message.ack != nil:
+					// Messages are applied in order, so every earlier message has been applied by now
+					close(message.ack)
+				case message.batch != nil:
+					for _, update := range message.batch {
+						db.apply(update)
+					}
+				default:
+					db.apply(message)
+				}
 			}
 
+			db.evictAVL()
+
 			db.avlLock.Unlock()
 		}
-		db.logger.Info("Channel closed. Exiting AVL goroutine.")
+		db.logger.Info("Queue closed. Exiting AVL goroutine.")
 	}()
 
 	// Start the switchover goroutine
-	db.wg.Add(1)
+	db.routines.Add(1)
 	go func() {
-		defer db.wg.Done()
+		defer db.routines.Done()
 
 		db.logger.Info("Starting switchover routine")
 		for {
@@ -83,103 +268,875 @@ func NewDB(
 			case <-context.Done():
 				db.logger.Info("Switchover routine stopped. Exiting")
 				return
-			default:
-				triggerMetric := float64(db.bst.balanceFactorSum.Load()) / float64(db.totalOps.Load())
-
-				if triggerMetric > TriggerThreshold /* || time threshold reached? || size(avl) << size(bst)? */ {
-					db.logger.Debug("switchover routine, threshold exceeded", "trigger metric", triggerMetric)
-
-					// Obtain the r/w lock to pause calculations
-					db.rwLock.Lock()
-
-					// Wait for the AVL routine channel to be empty.
-					// TODO: I am really in two minds about this
-					for len(db.avlChannel) > 0 {
-						time.Sleep(
-							// This is a bit to arbitary for my liking
-							time.Duration(len(db.avlChannel)) * 1000 * time.Nanosecond,
-						)
-					}
+			case <-db.trigger:
+				// An earlier switchover may have reset the stats since the trigger was sent
+				stats := db.stats()
+				policy, ok := db.policy.ShouldSwap(stats)
+				if !ok {
+					continue
+				}
 
-					// Obtain the avl lock to pause avl inserts
-					db.avlLock.Lock()
-					db.logger.Debug("switchover routine, naive db locks obtained")
+				db.logger.Debug("switchover routine, policy fired", "policy", policy, "stats", stats)
+				if err := db.switchover(); err != nil {
+					db.logger.Warn("switchover routine, switchover abandoned", "policy", policy, "error", err)
+					continue
+				}
 
-					// Swap out the BST and AVL trees
-					// What happens to the old BST?
-					db.bst.root = db.avl.root
-					db.logger.Debug("switchover routine, tree successfully replaced")
+				db.swapsLock.Lock()
+				db.swaps[policy]++
+				db.swapsLock.Unlock()
 
-					// Create a new AVL tree
-					db.avl = NewAVL()
+				db.logger.Info("switchover routine, trees swapped", "policy", policy)
+			}
+		}
+	}()
 
-					// TODO: is there a way to clear the avlChannel?
+	return db
+}
 
-					// Reset the balance factor sum
-					db.bst.balanceFactorSum.Store(0)
+// apply writes a single update to the AVL tree, and to the expiry index if there is one, or holds it
+// back while the AVL tree is being rebuilt. The caller must hold the avl lock.
+func (db *DB[D, P, R]) apply(message Message[D]) {
+	if db.rebuilding {
+		db.pending = append(db.pending, message)
+		return
+	}
 
-					// Reset the totalOps counter
-					db.totalOps.Store(1)
-					db.logger.Debug("switchover routine, metrics reset")
+	if message.deleted {
+		db.avl.Delete(message.key)
+		if db.expiry != nil {
+			db.expiry.Remove(message.key)
+		}
+		return
+	}
 
-					// Release the r/w lock
-					db.rwLock.Unlock()
-					// Release the avl lock
-					db.avlLock.Unlock()
+	db.avl.Insert(message.key, message.data)
+	if db.expiry != nil {
+		db.expiry.Set(message.key, db.expiresAt(message.data), message.data)
+	}
+}
 
-					db.logger.Debug("switchover routine, naive db locks released")
-				}
-			}
+// evictAVL removes the expired keys from the AVL tree. With an expiry index only the keys whose
+// time has passed are handed to evict, otherwise the whole tree is surveyed. A key evict declines
+// despite its time having passed stays in the tree until it is next updated. The caller must hold
+// the avl lock.
+func (db *DB[D, P, R]) evictAVL() {
+	if db.rebuilding {
+		// The keys are evicted from the rebuilt tree once it is in place
+		return
+	}
 
-			time.Sleep(1 * time.Second)
+	if db.expiry == nil {
+		keys := db.avl.Survey(db.evict)
+		for _, key := range keys {
+			db.avl.Delete(key)
+			db.untrack(key)
 		}
-	}()
+		return
+	}
 
-	return db
+	now := time.Now()
+	for {
+		key, data, ok := db.expiry.Pop(now)
+		if !ok {
+			return
+		}
+
+		if db.evict(data) {
+			db.avl.Delete(key)
+			db.untrack(key)
+		}
+	}
 }
 
-// Shutdown closes the AVL channel to stop the AVL goroutine it calls the cancel function
-// 'stopRoutine' to tell the switchover routine to exit.
-func (db *DB) Shutdown() {
-	// Wait until everyone has released the r/w lock / finished their operations
+// stats gathers what the swap policy decides on. Every figure is read atomically, but they are not
+// read together, so they may disagree slightly under concurrent operations.
+func (db *DB[D, P, R]) stats() SwapStats {
+	return SwapStats{
+		BalanceFactorSum: db.bst.balanceFactorSum.Load(),
+		Ops:              db.totalOps.Load(),
+		MaxHeight:        db.bst.maxHeight.Load(),
+		BSTSize:          db.bst.size.Load(),
+		AVLSize:          db.avl.size.Load(),
+		SinceSwap:        time.Duration(time.Now().UnixNano() - db.lastSwap.Load()),
+	}
+}
+
+// Swaps returns how many switchovers each swap policy has triggered, keyed by the name the policy
+// reported.
+func (db *DB[D, P, R]) Swaps() map[string]int64 {
+	db.swapsLock.Lock()
+	defer db.swapsLock.Unlock()
+
+	swaps := make(map[string]int64, len(db.swaps))
+	for policy, n := range db.swaps {
+		swaps[policy] = n
+	}
+	return swaps
+}
+
+// Rotations returns how many rotations a rebalancing DB has performed.
+func (db *DB[D, P, R]) Rotations() int64 {
+	return db.bst.rotations.Load()
+}
+
+// countOps adds n operations to the total and signals the switchover goroutine if the swap policy
+// fires. The signal never blocks: one pending signal is enough.
+func (db *DB[D, P, R]) countOps(n int64) {
+	db.totalOps.Add(n)
+
+	if db.rebalance {
+		return
+	}
+
+	if _, ok := db.policy.ShouldSwap(db.stats()); ok {
+		select {
+		case db.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// publish queues the message for the AVL goroutine. If the queue is full the overflow policy
+// decides whether to wait, giving up with a *WaitError if the context is done first, or to drop the
+// message. A rebalancing DB has no AVL goroutine, so there is nothing to send.
+func (db *DB[D, P, R]) publish(ctx context.Context, message Message[D]) error {
+	if db.rebalance {
+		return nil
+	}
+
+	return db.queue.push(ctx, message)
+}
+
+// QueueStats describes the queue to the AVL goroutine. A rebalancing DB has no queue, and reports
+// the zero value.
+func (db *DB[D, P, R]) QueueStats() QueueStats {
+	if db.rebalance {
+		return QueueStats{}
+	}
+
+	return db.queue.stats()
+}
+
+// flush waits, for up to FlushTimeout, until the AVL goroutine has applied every message sent
+// before it. The caller must hold the r/w lock so that no further messages are sent meanwhile.
+func (db *DB[D, P, R]) flush() error {
+	if db.rebalance {
+		return nil
+	}
+
+	timer := time.NewTimer(FlushTimeout)
+	defer timer.Stop()
+
+	ack := make(chan struct{})
+	if err := db.queue.ack(ack); err != nil {
+		return err
+	}
+
+	select {
+	case <-ack:
+		return nil
+	case <-timer.C:
+		return &WaitError{Op: "avl ack", Err: context.DeadlineExceeded}
+	}
+}
+
+// switchover replaces the BST with the AVL tree, and carries on with a new AVL tree rebuilt from
+// it, so that keys untouched until the next switchover are not lost. Calculations are only paused
+// while the AVL goroutine catches up and the trees are swapped; the AVL tree is rebuilt afterwards,
+// while the updates that arrive meanwhile are held back. If catching up takes longer than
+// FlushTimeout the switchover is abandoned and a *WaitError returned. An AVL tree that missed
+// dropped updates can't stand in for the BST, so it is only rebuilt, for the next switchover to swap.
+func (db *DB[D, P, R]) switchover() error {
+	db.swapLock.Lock()
+	defer db.swapLock.Unlock()
+
+	if err := db.swap(); err != nil {
+		return err
+	}
+
+	db.rebuildAVL()
+	return nil
+}
+
+// swap is the part of switchover that pauses calculations: it replaces the BST with the AVL tree,
+// unless that is stale, and leaves the AVL tree holding back updates until it is rebuilt. The
+// caller must hold the swap lock.
+func (db *DB[D, P, R]) swap() error {
+	// Obtain the r/w lock to pause calculations
 	db.rwLock.Lock()
-	defer db.rwLock.Unlock()
 
-	// Signal to the switchover goroutine to stop
-	db.logger.Info("terminating the switchover routine")
+	// Wait for the AVL goroutine to apply everything already sent
+	if err := db.flush(); err != nil {
+		db.rwLock.Unlock()
+		return err
+	}
+
+	// Obtain the avl lock to pause avl inserts
+	db.avlLock.Lock()
+	db.logger.Debug("switchover routine, naive db locks obtained")
+
+	// Updates were dropped, so the AVL tree can't stand in for the BST
+	stale := db.queue.stale.Swap(false)
+	if stale {
+		db.logger.Info("switchover routine, rebuilding the stale AVL tree from the BST")
+	} else {
+		// Swap out the BST and AVL trees
+		// What happens to the old BST?
+		db.bst.replace(db.avl.root, db.avl.size.Load())
+		db.logger.Debug("switchover routine, tree successfully replaced")
+
+		db.resetStats()
+		db.logger.Debug("switchover routine, metrics reset")
+	}
+
+	// The BST now owns the nodes, so the AVL tree lets go of them and holds back updates until it
+	// is rebuilt. The tree itself is kept, as its size is read without the avl lock
+	db.avl.root = nil
+	db.rebuilding = true
+
+	// Release the r/w lock
+	db.rwLock.Unlock()
+	// Release the avl lock
+	db.avlLock.Unlock()
+	db.logger.Debug("switchover routine, naive db locks released")
+	return nil
+}
+
+// rebuildAVL rebuilds the AVL tree, and the expiry index if there is one, from the BST while
+// calculations carry on, then applies the updates held back meanwhile. The BST is scanned under
+// its own locks, and every update it misses is among those held back or still queued. Only a
+// switchover or a restore replaces the BST, so the caller must hold the swap lock rather than the
+// r/w lock, which would hold up calculations behind a waiting snapshot.
+func (db *DB[D, P, R]) rebuildAVL() {
+	rebuilt := NewAVL[D]()
+	var index *expiry.Index[D]
+	if db.expiry != nil {
+		index = expiry.NewIndex[D]()
+	}
+
+	_ = db.bst.Scan(context.Background(), "", "", func(key string, data D) bool {
+		rebuilt.Insert(key, data)
+		if index != nil {
+			index.Set(key, db.expiresAt(data), data)
+		}
+		return true
+	})
+
+	db.avlLock.Lock()
+	defer db.avlLock.Unlock()
+
+	db.avl.root = rebuilt.root
+	db.avl.size.Store(rebuilt.size.Load())
+	if index != nil {
+		db.expiry = index
+	}
+
+	db.rebuilding = false
+	for _, message := range db.pending {
+		db.apply(message)
+	}
+	db.pending = nil
+
+	db.evictAVL()
+	db.logger.Debug("switchover routine, AVL tree rebuilt", "size", db.avl.size.Load())
+}
+
+// resetStats starts counting the swap policy's stats afresh. The caller must hold the r/w lock.
+func (db *DB[D, P, R]) resetStats() {
+	// Reset the balance factor sum
+	db.bst.balanceFactorSum.Store(0)
+	db.bst.maxHeight.Store(0)
+
+	// Reset the totalOps counter
+	db.totalOps.Store(1)
+
+	db.lastSwap.Store(time.Now().UnixNano())
+}
+
+// Shutdown calls the cancel function 'stopRoutine' to tell the switchover routine and the reaper to
+// exit, then closes the AVL queue to stop the AVL goroutine.
+func (db *DB[D, P, R]) Shutdown() {
+	// Signal to the switchover goroutine and the reaper to stop, and wait for any switchover or
+	// reaping in progress, which need both the r/w lock and the AVL queue
+	db.logger.Info("terminating the switchover routine and the reaper")
 	db.stopRoutine()
+	db.routines.Wait()
 
-	// Close the channel to signal the end of the goroutine
+	// Wait until everyone has released the r/w lock / finished their operations
+	db.rwLock.Lock()
+	defer db.rwLock.Unlock()
+
+	// Close the queue to signal the end of the goroutine
 	db.logger.Info("terminating the avl routine")
-	close(db.avlChannel)
+	db.queue.close()
 
 	db.wg.Wait()
 	db.logger.Info("naive db shutdown complete")
 }
 
-func (db *DB) Calculate(key string, params any) (any, error) {
-	db.rwLock.RLock()
+// reap removes the keys evict reports as expired from the BST, and from the AVL tree through the AVL
+// channel. Keys whose data lock is held are left for a later pass, as whoever holds it is about to
+// refresh their data. The r/w lock is only held while the BST is scanned and then while each key
+// is removed, so a pass holds up switchovers no longer than a scan would. Removals are not
+// journaled: expired keys are left out when the journal is replayed anyway. reap returns the
+// number of keys removed.
+func (db *DB[D, P, R]) reap(ctx context.Context) (int, error) {
+	if err := rLockContext(ctx, "r/w lock", db.rwLock); err != nil {
+		return 0, err
+	}
+
+	expired := []string{}
+	err := db.bst.Scan(ctx, "", "", func(key string, data D) bool {
+		if db.evict(data) {
+			expired = append(expired, key)
+		}
+		return true
+	})
+	db.rwLock.RUnlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	reaped := 0
+	for _, key := range expired {
+		if err = rLockContext(ctx, "r/w lock", db.rwLock); err != nil {
+			return reaped, err
+		}
+
+		var removed bool
+		removed, err = db.bst.Reap(key, db.evict, func(_ D) error {
+			if err := db.publish(ctx, Message[D]{key: key, deleted: true}); err != nil {
+				return err
+			}
+			db.untrack(key)
+			return nil
+		})
+		db.rwLock.RUnlock()
+
+		if err != nil {
+			return reaped, err
+		}
+		if removed {
+			reaped++
+		}
+	}
+
+	return reaped, nil
+}
+
+// Calculate applies the callback to the data stored under key and stores the data it returns.
+// If the context is done while waiting on the r/w lock, a node lock or the AVL queue, Calculate
+// gives up and returns a *WaitError wrapping the context's error.
+func (db *DB[D, P, R]) Calculate(ctx context.Context, key string, params P) (R, error) {
+	var zero R
+
+	if err := rLockContext(ctx, "r/w lock", db.rwLock); err != nil {
+		return zero, err
+	}
 	// We must absolutely unlock the r/w lock before we return
 	defer db.rwLock.RUnlock()
 
-	node := db.bst.InSearch(key)
-	// We must absolutely unlock the node before we return
-	defer node.lock.Unlock()
+	refused, err := db.admit(ctx, key)
+	if err != nil {
+		return zero, err
+	}
+	if len(refused) > 0 {
+		// The key is treated as new, but not stored
+		var none D
+		_, result, err := db.callback(none, params)
+		return result, err
+	}
+
+	node, err := db.bst.InSearch(ctx, key)
+	if err != nil {
+		return zero, err
+	}
+	// We must absolutely unlock the node before we return, and not leave it behind if it was
+	// created for data that was never stored
+	defer func() {
+		empty := node.empty
+		node.dataLock.Unlock()
+		if empty {
+			db.discard(key)
+		}
+	}()
 
 	// Apply the callback defined by the user of this DB
+	previous, empty := node.data, node.empty
 	data, result, err := db.callback(node.data, params)
 	if err != nil {
 		db.logger.Info("naive db calculate, callback function failed", "error", err)
-		return false, err
+		return result, err
+	}
+
+	if err = db.record(wal.Record[D]{Key: key, Data: data}); err != nil {
+		return zero, err
 	}
 
 	// Update the node's data
-	node.data = data
+	node.data, node.empty = data, false
+	db.touch(key, data)
 
-	// Publish the message to the avlChannel for the goroutine to pick up
-	db.avlChannel <- Message{key: key, data: data}
+	// Publish the message to the AVL queue for the goroutine to pick up
+	if err = db.publish(ctx, Message[D]{key: key, data: data}); err != nil {
+		// The AVL tree never saw this update, so roll the node back to keep both trees in step.
+		// Note that data the callback mutated in place cannot be rolled back this way.
+		node.data, node.empty = previous, empty
+		db.unrecord(wal.Record[D]{Key: key, Data: previous, Deleted: empty})
+		return zero, err
+	}
 
 	// Increment the totalOps counter
-	db.totalOps.Add(1)
+	db.countOps(1)
 	return result, nil
 }
+
+// Peek returns the data stored under key without applying the callback or publishing to the AVL
+// channel. The boolean reports whether the key exists. Callers must treat the data as read-only.
+func (db *DB[D, P, R]) Peek(key string) (D, bool, error) {
+	db.rwLock.RLock()
+	defer db.rwLock.RUnlock()
+
+	node := db.bst.Search(key)
+	if node == nil {
+		var zero D
+		return zero, false, nil
+	}
+	defer node.dataLock.Unlock()
+
+	// A node a failed calculation created is about to be discarded
+	return node.data, !node.empty, nil
+}
+
+// Delete removes the key and reports whether it existed. The removal is published to the AVL
+// channel while the node is still locked, so the AVL goroutine sees it in the same order as any
+// Calculate on the key, and the key does not reappear after the next switchover.
+func (db *DB[D, P, R]) Delete(key string) (bool, error) {
+	db.rwLock.RLock()
+	defer db.rwLock.RUnlock()
+
+	return db.bst.Delete(key, func(_ D) error {
+		if err := db.record(wal.Record[D]{Key: key, Deleted: true}); err != nil {
+			return err
+		}
+
+		if err := db.publish(context.Background(), Message[D]{key: key, deleted: true}); err != nil {
+			return err
+		}
+		db.untrack(key)
+		return nil
+	})
+}
+
+// Scan calls fn, in ascending key order, for up to limit keys in the range [start, end) until fn
+// returns false. An empty end leaves the range unbounded above and a limit of zero or less means no
+// limit. fn is called without any node locks held, but switchovers are paused until the scan ends.
+// The scan is not a point-in-time view of the tree.
+func (db *DB[D, P, R]) Scan(
+	ctx context.Context,
+	start string,
+	end string,
+	limit int,
+	fn func(key string, data D) bool,
+) error {
+	if err := rLockContext(ctx, "r/w lock", db.rwLock); err != nil {
+		return err
+	}
+	defer db.rwLock.RUnlock()
+
+	visited := 0
+	return db.bst.Scan(ctx, start, end, func(key string, data D) bool {
+		visited++
+		return fn(key, data) && (limit <= 0 || visited < limit)
+	})
+}
+
+// ScanPrefix is like Scan over every key that starts with prefix.
+func (db *DB[D, P, R]) ScanPrefix(ctx context.Context, prefix string, limit int, fn func(key string, data D) bool) error {
+	return db.Scan(ctx, prefix, PrefixEnd(prefix), limit, fn)
+}
+
+// CalculateMany applies the callback to each key in turn, with the params at the same index.
+// Without commit, every key is calculated independently as by Calculate. With commit, the keys are
+// calculated in a single Txn and the new data is only stored if commit(results) returns true. The
+// callback must then return new values rather than mutate the data it is given. A key may appear more
+// than once, in which case each occurrence sees the data left by the one before. The boolean reports
+// whether every result was stored.
+func (db *DB[D, P, R]) CalculateMany(
+	ctx context.Context,
+	keys []string,
+	params []P,
+	commit func(results []R) bool,
+) ([]R, bool, error) {
+	if len(keys) != len(params) {
+		return nil, false, fmt.Errorf("naive db calculate many: %d keys but %d params", len(keys), len(params))
+	}
+
+	results := make([]R, len(keys))
+
+	if commit == nil {
+		for i, key := range keys {
+			result, err := db.Calculate(ctx, key, params[i])
+			if err != nil {
+				return results[:i], false, err
+			}
+			results[i] = result
+		}
+		return results, true, nil
+	}
+
+	committed, err := db.Txn(ctx, keys, func(data map[string]D) (bool, error) {
+		for i, key := range keys {
+			next, result, err := db.callback(data[key], params[i])
+			if err != nil {
+				db.logger.Info("naive db calculate many, callback function failed", "error", err)
+				return false, err
+			}
+
+			data[key] = next
+			results[i] = result
+		}
+
+		return commit(results), nil
+	})
+
+	return results, committed, err
+}
+
+// Txn runs fn over the data of every key as a single transaction. The nodes of the keys are locked
+// in ascending key order and fn is handed a map holding a copy of each key's data, with the zero
+// value for new keys. If fn returns true the map's values are journaled, stored and published to the
+// AVL tree as one batch; otherwise, or if fn fails, every change is discarded. Entries fn adds for other keys
+// are ignored. fn must not call back into the DB, and must not mutate the data it is given in place.
+// If the context is done before the batch is published, nothing is stored and a *WaitError is
+// returned. The boolean reports whether the changes were stored.
+func (db *DB[D, P, R]) Txn(ctx context.Context, keys []string, fn func(data map[string]D) (bool, error)) (bool, error) {
+	if err := rLockContext(ctx, "r/w lock", db.rwLock); err != nil {
+		return false, err
+	}
+	// We must absolutely unlock the r/w lock before we return
+	defer db.rwLock.RUnlock()
+
+	// Keys that cannot be admitted are handed to fn as new keys, but not stored
+	refused, err := db.admit(ctx, keys...)
+	if err != nil {
+		return false, err
+	}
+	if len(refused) > 0 {
+		keys = slices.DeleteFunc(slices.Clone(keys), func(key string) bool {
+			return slices.Contains(refused, key)
+		})
+	}
+
+	nodes, unlock, err := db.lockNodes(ctx, keys)
+	if err != nil {
+		return false, err
+	}
+	// We must absolutely unlock the nodes before we return, and not leave behind those created for
+	// data that was never stored
+	defer func() {
+		empty := []string{}
+		for key, node := range nodes {
+			if node.empty {
+				empty = append(empty, key)
+			}
+		}
+		unlock()
+		for _, key := range empty {
+			db.discard(key)
+		}
+	}()
+
+	data := make(map[string]D, len(nodes))
+	for key, node := range nodes {
+		data[key] = node.data
+	}
+
+	ok, err := fn(data)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	batch := make([]Message[D], 0, len(nodes))
+	records := make([]wal.Record[D], 0, len(nodes))
+	for key := range nodes {
+		batch = append(batch, Message[D]{key: key, data: data[key]})
+		records = append(records, wal.Record[D]{Key: key, Data: data[key]})
+	}
+
+	if err = db.record(records...); err != nil {
+		return false, err
+	}
+
+	// Nothing has been stored yet, so giving up here leaves both trees as they were
+	if err = db.publish(ctx, Message[D]{batch: batch}); err != nil {
+		for i := range records {
+			node := nodes[records[i].Key]
+			records[i].Data, records[i].Deleted = node.data, node.empty
+		}
+		db.unrecord(records...)
+		return false, err
+	}
+
+	for key, node := range nodes {
+		node.data, node.empty = data[key], false
+		db.touch(key, node.data)
+	}
+
+	db.countOps(int64(len(nodes)))
+	return true, nil
+}
+
+// admit makes room for the keys that are not stored yet, if the DB is bounded, by removing the keys
+// the tracker picks. A key in use, or used since it was picked, is left alone and tracked again when
+// its data is stored. admit returns the keys that could not be admitted, or an error wrapping
+// admission.ErrFull if the fallback is to deny them. The caller must hold the r/w lock, but no node
+// locks.
+func (db *DB[D, P, R]) admit(ctx context.Context, keys ...string) ([]string, error) {
+	if db.limiter == nil {
+		return nil, nil
+	}
+
+	victims, refused, err := db.limiter.Admit(keys...)
+	if err != nil {
+		return nil, fmt.Errorf("naive db admit: %w", err)
+	}
+
+	evicted := 0
+	for _, victim := range victims {
+		removed, err := db.bst.Reap(victim, func(_ D) bool { return !db.limiter.Tracked(victim) }, func(_ D) error {
+			if err := db.record(wal.Record[D]{Key: victim, Deleted: true}); err != nil {
+				return err
+			}
+			return db.publish(ctx, Message[D]{key: victim, deleted: true})
+		})
+		if err != nil {
+			return nil, err
+		}
+		if removed {
+			evicted++
+		}
+	}
+
+	if evicted > 0 {
+		db.logger.Debug("naive db, keys evicted to make room", "count", evicted)
+	}
+	return refused, nil
+}
+
+// discard removes the key's node if it is still empty, having been created by a calculation that
+// stored nothing, as it would otherwise linger with no data until the next switchover. The AVL
+// tree never saw the node, so there is nothing to publish. The caller must hold the r/w lock, but
+// not the node's data lock.
+func (db *DB[D, P, R]) discard(key string) {
+	if removed, _ := db.bst.Discard(key, nil); removed {
+		db.untrack(key)
+	}
+}
+
+// touch tells the tracker, if the DB is bounded, that the key's data was stored. The caller must
+// hold the node's data lock.
+func (db *DB[D, P, R]) touch(key string, data D) {
+	if db.limiter != nil {
+		db.track(db.limiter, key, data)
+	}
+}
+
+// track tells the tracker that the key was used, with the data it now holds.
+func (db *DB[D, P, R]) track(tracker *admission.Tracker, key string, data D) {
+	var expiresAt time.Time
+	if db.expiresAt != nil {
+		expiresAt = db.expiresAt(data)
+	}
+	tracker.Touch(key, expiresAt, admission.DataBytes(data))
+}
+
+// untrack tells the tracker, if the DB is bounded, that the key was removed.
+func (db *DB[D, P, R]) untrack(key string) {
+	if db.limiter != nil {
+		db.limiter.Remove(key)
+	}
+}
+
+// LimitStats describes the keys held by a bounded DB, and reports false if the DB is unbounded.
+func (db *DB[D, P, R]) LimitStats() (admission.Stats, bool) {
+	if db.limiter == nil {
+		return admission.Stats{}, false
+	}
+	return db.limiter.Stats(), true
+}
+
+// record appends the records to the journal, if there is one, before they are committed.
+func (db *DB[D, P, R]) record(records ...wal.Record[D]) error {
+	if db.journal == nil {
+		return nil
+	}
+
+	if err := db.journal.Append(records...); err != nil {
+		db.logger.Error("naive db could not journal changes", "error", err)
+		return fmt.Errorf("naive db journal: %w", err)
+	}
+	return nil
+}
+
+// unrecord appends the records restoring the data of changes that were journaled but then rolled
+// back, so that replaying the journal does not bring them back. A key that did not exist before is
+// restored by a deletion.
+func (db *DB[D, P, R]) unrecord(records ...wal.Record[D]) {
+	if err := db.record(records...); err != nil {
+		db.logger.Error("naive db could not journal a rollback, replay may restore it", "error", err)
+	}
+}
+
+// lockNodes finds or creates the node of every distinct key and takes their data locks in ascending
+// key order. A node may be removed or handed another key between being resolved and being locked,
+// in which case every lock is released and the keys are resolved again. The returned function
+// releases the data locks.
+func (db *DB[D, P, R]) lockNodes(ctx context.Context, keys []string) (map[string]*Node[D], func(), error) {
+	distinct := slices.Clone(keys)
+	slices.Sort(distinct)
+	distinct = slices.Compact(distinct)
+
+	for {
+		nodes := make(map[string]*Node[D], len(distinct))
+		for _, key := range distinct {
+			node, err := db.bst.Resolve(ctx, key)
+			if err != nil {
+				return nil, nil, err
+			}
+			nodes[key] = node
+		}
+
+		locked := make([]*Node[D], 0, len(distinct))
+		unlock := func() {
+			for _, node := range locked {
+				node.dataLock.Unlock()
+			}
+		}
+
+		stale := false
+		for _, key := range distinct {
+			node := nodes[key]
+			if err := lockContext(ctx, "data lock", &node.dataLock); err != nil {
+				unlock()
+				return nil, nil, err
+			}
+			locked = append(locked, node)
+
+			if node.removed || node.key != key {
+				stale = true
+				break
+			}
+		}
+
+		if !stale {
+			return nodes, unlock, nil
+		}
+
+		unlock()
+	}
+}
+
+// Snapshot writes every key and its data to w in the snapshot format. Calculations are paused until
+// the snapshot has been written, so it is a point-in-time view of the database.
+func (db *DB[D, P, R]) Snapshot(w io.Writer) error {
+	db.rwLock.Lock()
+	defer db.rwLock.Unlock()
+
+	sw, err := snapshot.NewWriter(w, db.codec)
+	if err != nil {
+		return err
+	}
+
+	var writeErr error
+	err = db.bst.Scan(context.Background(), "", "", func(key string, data D) bool {
+		writeErr = sw.Write(key, data)
+		return writeErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	return sw.Close()
+}
+
+// Restore replaces the contents of the database with the snapshot read from r, leaving out the
+// entries evict reports as expired. The snapshot is verified in full before anything is replaced.
+func (db *DB[D, P, R]) Restore(r io.Reader) error {
+	entries, err := snapshot.ReadAll(r, db.codec)
+	if err != nil {
+		return err
+	}
+
+	// The snapshot may hold more keys than the limits allow. Track them on the side, the current keys
+	// stay tracked should the restore fail.
+	var staged *admission.Tracker
+	trimmed := map[string]bool{}
+	if db.limiter != nil {
+		staged = db.limiter.Staged()
+		for _, entry := range entries {
+			if !db.evict(entry.Data) {
+				db.track(staged, entry.Key, entry.Data)
+			}
+		}
+		for _, key := range staged.Trim() {
+			trimmed[key] = true
+		}
+	}
+
+	// The BST and the AVL tree must not share nodes, so build a balanced tree for each
+	bst := NewAVL[D]()
+	avl := NewAVL[D]()
+	index := expiry.NewIndex[D]()
+	restored := 0
+	for _, entry := range entries {
+		if db.evict(entry.Data) || trimmed[entry.Key] {
+			continue
+		}
+		bst.Insert(entry.Key, entry.Data)
+		if !db.rebalance {
+			avl.Insert(entry.Key, entry.Data)
+			if db.expiresAt != nil {
+				index.Set(entry.Key, db.expiresAt(entry.Data), entry.Data)
+			}
+		}
+		restored++
+	}
+
+	db.swapLock.Lock()
+	defer db.swapLock.Unlock()
+
+	db.rwLock.Lock()
+	defer db.rwLock.Unlock()
+
+	// Nothing already sent to the AVL goroutine may land in the restored tree
+	if err = db.flush(); err != nil {
+		return err
+	}
+
+	db.avlLock.Lock()
+	defer db.avlLock.Unlock()
+
+	if staged != nil {
+		db.limiter.Replace(staged)
+	}
+	db.bst.replace(bst.root, bst.size.Load())
+	db.avl.root = avl.root
+	db.avl.size.Store(avl.size.Load())
+	if db.expiry != nil {
+		db.expiry = index
+	}
+	// The restored trees are complete, whatever was dropped before
+	db.queue.stale.Store(false)
+
+	db.resetStats()
+
+	db.logger.Info("naive db restored from snapshot",
+		"restored", restored, "expired", len(entries)-restored-len(trimmed), "trimmed", len(trimmed))
+	return nil
+}
@@ -0,0 +1,1271 @@
+//nolint:testpackage // Allow tests to access the naive package
+package naive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dominicfollett/argus-db/database/admission"
+	"github.com/dominicfollett/argus-db/database/snapshot"
+	"github.com/dominicfollett/argus-db/database/wal"
+)
+
+func newCountingDB(opts ...Option) *DB[int, int, int] {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	callback := func(data int, params int) (int, int, error) {
+		return data + params, data + params, nil
+	}
+	evict := func(_ int) bool { return false }
+
+	return NewDB(callback, evict, nil, nil, nil, logger, opts...)
+}
+
+func TestCalculateDeadlineOnRWLock(t *testing.T) {
+	db := newCountingDB()
+	defer db.Shutdown()
+
+	// Simulate a switchover in progress
+	db.rwLock.Lock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := db.Calculate(ctx, "key", 1)
+	db.rwLock.Unlock()
+
+	var waitErr *WaitError
+	if !errors.As(err, &waitErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a WaitError wrapping context.DeadlineExceeded, got %v", err)
+	}
+
+	// The lock must be usable again once the abandoned waiter has drained
+	if _, err = db.Calculate(context.Background(), "key", 1); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestCalculateDeadlineOnNodeLock(t *testing.T) {
+	db := newCountingDB()
+	defer db.Shutdown()
+
+	if _, err := db.Calculate(context.Background(), "key", 1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Hold the node lock as if another caller were running its callback
+	node, err := db.bst.InSearch(context.Background(), "key")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = db.Calculate(ctx, "key", 1)
+	node.dataLock.Unlock()
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	result, err := db.Calculate(context.Background(), "key", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result != 2 {
+		t.Errorf("Expected the timed out calculation to leave no trace, got %d", result)
+	}
+}
+
+func TestCalculateDeadlineOnAVLQueue(t *testing.T) {
+	db := newCountingDB(WithQueue(1, OverflowBlock))
+	defer db.Shutdown()
+
+	// Stall the AVL goroutine so that nothing drains the queue. It can take one update off the queue
+	// before it stalls, so it takes two to fill it
+	db.avlLock.Lock()
+
+	for _, key := range []string{"other", "key"} {
+		if _, err := db.Calculate(context.Background(), key, 1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := db.Calculate(ctx, "key", 1)
+	db.avlLock.Unlock()
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// The node must have been rolled back
+	result, err := db.Calculate(context.Background(), "key", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result != 2 {
+		t.Errorf("Expected the timed out calculation to be rolled back, got %d", result)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	db := newCountingDB()
+	defer db.Shutdown()
+
+	for _, key := range []string{"m", "c", "x"} {
+		if _, err := db.Calculate(context.Background(), key, 1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Misses must not leave any node locked behind
+	for _, key := range []string{"a", "d", "z"} {
+		if _, ok, err := db.Peek(key); ok || err != nil {
+			t.Errorf("Expected %s to be missing, got ok: %t, error: %v", key, ok, err)
+		}
+	}
+
+	data, ok, err := db.Peek("c")
+	if !ok || err != nil {
+		t.Fatalf("Expected c to exist, got ok: %t, error: %v", ok, err)
+	}
+	if data != 1 {
+		t.Errorf("Expected 1, got %d", data)
+	}
+
+	// Peeking must not have changed anything
+	result, err := db.Calculate(context.Background(), "c", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result != 2 {
+		t.Errorf("Expected 2, got %d", result)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db := newCountingDB()
+	defer db.Shutdown()
+
+	for _, key := range []string{"m", "c", "x", "a", "e"} {
+		if _, err := db.Calculate(context.Background(), key, 1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	deleted, err := db.Delete("c")
+	if !deleted || err != nil {
+		t.Fatalf("Expected c to be deleted, got deleted: %t, error: %v", deleted, err)
+	}
+
+	deleted, err = db.Delete("c")
+	if deleted || err != nil {
+		t.Errorf("Expected c to be gone already, got deleted: %t, error: %v", deleted, err)
+	}
+
+	if err = db.switchover(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, ok, _ := db.Peek("c"); ok {
+		t.Errorf("Expected c not to reappear after a switchover")
+	}
+
+	for _, key := range []string{"m", "x", "a", "e"} {
+		if data, ok, _ := db.Peek(key); !ok || data != 1 {
+			t.Errorf("Expected %s to survive the switchover, got ok: %t, data: %d", key, ok, data)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	db := newCountingDB()
+	defer db.Shutdown()
+
+	keys := []string{"t1:b", "t2:a", "t1:a", "t10:a", "u", "t1:c", "s", "t1:"}
+	for _, key := range keys {
+		if _, err := db.Calculate(context.Background(), key, 1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	collect := func(scan func(fn func(key string, data int) bool) error) []string {
+		result := []string{}
+		err := scan(func(key string, _ int) bool {
+			result = append(result, key)
+			return true
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name     string
+		scan     func(fn func(key string, data int) bool) error
+		expected []string
+	}{
+		{"prefix", func(fn func(string, int) bool) error {
+			return db.ScanPrefix(context.Background(), "t1:", 0, fn)
+		}, []string{"t1:", "t1:a", "t1:b", "t1:c"}},
+		{"prefix with limit", func(fn func(string, int) bool) error {
+			return db.ScanPrefix(context.Background(), "t1:", 2, fn)
+		}, []string{"t1:", "t1:a"}},
+		{"range", func(fn func(string, int) bool) error {
+			return db.Scan(context.Background(), "t1", "t1:b", 0, fn)
+		}, []string{"t10:a", "t1:", "t1:a"}},
+		{"unbounded", func(fn func(string, int) bool) error {
+			return db.Scan(context.Background(), "t2", "", 0, fn)
+		}, []string{"t2:a", "u"}},
+	}
+
+	for _, test := range tests {
+		result := collect(test.scan)
+		if len(result) != len(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, result)
+			continue
+		}
+		for i := range result {
+			if result[i] != test.expected[i] {
+				t.Errorf("%s: expected %v, got %v", test.name, test.expected, result)
+				break
+			}
+		}
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := map[string]string{
+		"":          "",
+		"a":         "b",
+		"tenant42:": "tenant42;",
+		"a\xff":     "b",
+		"\xff\xff":  "",
+	}
+
+	for prefix, expected := range tests {
+		if result := PrefixEnd(prefix); result != expected {
+			t.Errorf("PrefixEnd(%q): expected %q, got %q", prefix, expected, result)
+		}
+	}
+}
+
+func TestCalculateMany(t *testing.T) {
+	db := newCountingDB()
+	defer db.Shutdown()
+
+	ctx := context.Background()
+
+	// A rejected batch must leave every key untouched
+	results, committed, err := db.CalculateMany(ctx, []string{"b", "a"}, []int{1, 2}, func(_ []int) bool { return false })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if committed || results[0] != 1 || results[1] != 2 {
+		t.Errorf("Expected uncommitted results [1 2], got %v, %v", results, committed)
+	}
+	if data, _, _ := db.Peek("a"); data != 0 {
+		t.Errorf("Expected a rejected batch to leave a at 0, got %d", data)
+	}
+
+	// Repeated keys see the data left by the previous occurrence
+	results, committed, err = db.CalculateMany(ctx, []string{"b", "a", "b"}, []int{1, 2, 3}, func(_ []int) bool { return true })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !committed || results[0] != 1 || results[1] != 2 || results[2] != 4 {
+		t.Errorf("Expected committed results [1 2 4], got %v, %v", results, committed)
+	}
+	if data, _, _ := db.Peek("b"); data != 4 {
+		t.Errorf("Expected b to be 4, got %d", data)
+	}
+
+	if _, _, err = db.CalculateMany(ctx, []string{"a"}, []int{1, 2}, nil); err == nil {
+		t.Error("Expected an error for mismatched keys and params")
+	}
+}
+
+func TestCalculateManyOverlapping(t *testing.T) {
+	db := newCountingDB()
+	defer db.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	batches := [][]string{{"a", "b", "c"}, {"c", "b", "a"}, {"b", "c"}, {"c", "a"}}
+	commit := func(_ []int) bool { return true }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for _, keys := range batches {
+			wg.Add(1)
+			go func(keys []string) {
+				defer wg.Done()
+
+				params := make([]int, len(keys))
+				for j := range params {
+					params[j] = 1
+				}
+
+				if _, _, err := db.CalculateMany(ctx, keys, params, commit); err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			}(keys)
+		}
+	}
+	wg.Wait()
+
+	for key, expected := range map[string]int{"a": 150, "b": 150, "c": 200} {
+		if data, _, _ := db.Peek(key); data != expected {
+			t.Errorf("Expected %s to be %d, got %d", key, expected, data)
+		}
+	}
+}
+
+func TestTxn(t *testing.T) {
+	db := newCountingDB()
+	defer db.Shutdown()
+
+	ctx := context.Background()
+
+	// Move 3 from the user to the org, as long as the user can afford it
+	transfer := func(data map[string]int) (bool, error) {
+		if data["user"] < 3 {
+			return false, nil
+		}
+		data["user"] -= 3
+		data["org"] += 3
+		return true, nil
+	}
+
+	if committed, err := db.Txn(ctx, []string{"user", "org"}, transfer); committed || err != nil {
+		t.Fatalf("Expected the transfer to be discarded, got committed: %t, error: %v", committed, err)
+	}
+
+	if _, err := db.Calculate(ctx, "user", 5); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if committed, err := db.Txn(ctx, []string{"user", "org"}, transfer); !committed || err != nil {
+		t.Fatalf("Expected the transfer to be committed, got committed: %t, error: %v", committed, err)
+	}
+
+	failure := errors.New("failure")
+	_, err := db.Txn(ctx, []string{"user", "org"}, func(data map[string]int) (bool, error) {
+		data["user"] = 100
+		return true, failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("Expected the callback's error, got %v", err)
+	}
+
+	// Both updates must have reached the AVL tree, and only them
+	if err = db.switchover(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for key, expected := range map[string]int{"user": 2, "org": 3} {
+		if data, ok, _ := db.Peek(key); !ok || data != expected {
+			t.Errorf("Expected %s to be %d after a switchover, got ok: %t, data: %d", key, expected, ok, data)
+		}
+	}
+}
+
+func TestFailedCalculationLeavesNoNode(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	failure := errors.New("failure")
+
+	// Negative params are refused by the callback
+	callback := func(data int, params int) (int, int, error) {
+		if params < 0 {
+			return data, 0, failure
+		}
+		return data + params, data + params, nil
+	}
+	evict := func(_ int) bool { return false }
+
+	for name, opts := range map[string][]Option{
+		"shadow":     nil,
+		"rebalance":  {WithRebalancing()},
+		"lock-free":  {WithLockFreeReads()},
+		"all-policy": {WithSwapPolicy(AllPolicy{})},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts = append(opts, WithLimits(admission.Limits{MaxKeys: 10}))
+			db := NewDB(callback, evict, nil, nil, nil, logger, opts...)
+			defer db.Shutdown()
+
+			ctx := context.Background()
+			if _, err := db.Calculate(ctx, "kept", 1); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			for i := 0; i < 20; i++ {
+				if _, err := db.Calculate(ctx, fmt.Sprintf("new%02d", i), -1); !errors.Is(err, failure) {
+					t.Fatalf("Expected the callback's error, got %v", err)
+				}
+			}
+			if _, err := db.Calculate(ctx, "kept", -1); !errors.Is(err, failure) {
+				t.Fatalf("Expected the callback's error, got %v", err)
+			}
+			_, _, err := db.CalculateMany(ctx, []string{"kept", "txn"}, []int{1, -1}, func(_ []int) bool { return true })
+			if !errors.Is(err, failure) {
+				t.Fatalf("Expected the callback's error, got %v", err)
+			}
+
+			// Only the key whose data was stored is left, in both trees
+			if !db.rebalance {
+				if err = db.switchover(); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+
+			keys := []string{}
+			if err = db.Scan(ctx, "", "", 0, func(key string, _ int) bool { keys = append(keys, key); return true }); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(keys) != 1 || keys[0] != "kept" || db.bst.size.Load() != 1 {
+				t.Errorf("Expected only kept to be left, got %v and %d nodes", keys, db.bst.size.Load())
+			}
+			if data, ok, _ := db.Peek("kept"); !ok || data != 1 {
+				t.Errorf("Expected kept to be left at 1, got ok: %t, data: %d", ok, data)
+			}
+			if stats, _ := db.LimitStats(); stats.Keys != 1 {
+				t.Errorf("Expected only kept to be tracked, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestEmptyNodesAreHidden(t *testing.T) {
+	for name, opts := range map[string][]Option{"locking": nil, "lock-free": {WithLockFreeReads()}} {
+		t.Run(name, func(t *testing.T) {
+			db := newCountingDB(opts...)
+			defer db.Shutdown()
+
+			ctx := context.Background()
+			if _, err := db.Calculate(ctx, "stored", 1); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			// A node as a failed calculation leaves it, just before discarding it
+			node, err := db.bst.InSearch(ctx, "empty")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			node.dataLock.Unlock()
+
+			if _, ok, _ := db.Peek("empty"); ok {
+				t.Errorf("Expected an empty node not to be found")
+			}
+
+			keys := []string{}
+			if err = db.Scan(ctx, "", "", 0, func(key string, _ int) bool { keys = append(keys, key); return true }); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(keys) != 1 || keys[0] != "stored" {
+				t.Errorf("Expected only the stored key to be scanned, got %v", keys)
+			}
+		})
+	}
+}
+
+func TestTxnDeadlineOnAVLQueue(t *testing.T) {
+	db := newCountingDB(WithQueue(1, OverflowBlock))
+	defer db.Shutdown()
+
+	// Stall the AVL goroutine so that nothing drains the queue. It can take one update off the queue
+	// before it stalls, so it takes two to fill it
+	db.avlLock.Lock()
+
+	for _, key := range []string{"a", "c"} {
+		if _, err := db.Calculate(context.Background(), key, 1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := db.Txn(ctx, []string{"a", "b"}, func(data map[string]int) (bool, error) {
+		data["a"]++
+		data["b"]++
+		return true, nil
+	})
+	db.avlLock.Unlock()
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	for key, expected := range map[string]int{"a": 1, "b": 0} {
+		if data, _, _ := db.Peek(key); data != expected {
+			t.Errorf("Expected %s to be left at %d, got %d", key, expected, data)
+		}
+	}
+}
+
+func TestRolledBackNewKeysAreNotReplayed(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	callback := func(data int, params int) (int, int, error) { return data + params, data + params, nil }
+	evict := func(_ int) bool { return false }
+	dir := t.TempDir()
+
+	journal, err := wal.Open[int](dir, intCodec{}, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	db := NewDB(callback, evict, nil, intCodec{}, journal, logger, WithQueue(1, OverflowBlock))
+
+	// Stall the AVL goroutine so that nothing drains the queue, which takes two updates to fill
+	db.avlLock.Lock()
+	for _, key := range []string{"a", "c"} {
+		if _, err = db.Calculate(context.Background(), key, 1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// New keys whose updates were journaled, then rolled back as they could not be published
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err = db.Calculate(ctx, "fresh", 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = db.Txn(ctx, []string{"a", "b"}, func(data map[string]int) (bool, error) {
+		data["a"]++
+		data["b"]++
+		return true, nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	db.avlLock.Unlock()
+	db.Shutdown()
+	if err = journal.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	journal, err = wal.Open[int](dir, intCodec{}, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer journal.Close()
+
+	replayed := NewDB(callback, evict, nil, intCodec{}, nil, logger)
+	defer replayed.Shutdown()
+	if err = journal.Replay(replayed.Restore); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for key, exists := range map[string]bool{"a": true, "b": false, "c": true, "fresh": false} {
+		if data, ok, _ := replayed.Peek(key); ok != exists || (exists && data != 1) {
+			t.Errorf("Expected %s to exist: %t, got ok: %t, data: %d", key, exists, ok, data)
+		}
+	}
+}
+
+type intCodec struct{}
+
+func (intCodec) Encode(data int) ([]byte, error) { return []byte(strconv.Itoa(data)), nil }
+
+func (intCodec) Decode(b []byte) (int, error) { return strconv.Atoi(string(b)) }
+
+func TestSnapshotRestore(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	callback := func(data int, params int) (int, int, error) { return data + params, data + params, nil }
+	// Negative counts stand in for expired entries
+	evict := func(data int) bool { return data < 0 }
+
+	source := NewDB(callback, evict, nil, intCodec{}, nil, logger)
+	defer source.Shutdown()
+
+	for key, params := range map[string]int{"a": 1, "b": 2, "expired": -1} {
+		if _, err := source.Calculate(context.Background(), key, params); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := source.Snapshot(&buffer); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	target := NewDB(callback, evict, nil, intCodec{}, nil, logger)
+	defer target.Shutdown()
+
+	if _, err := target.Calculate(context.Background(), "stale", 1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := target.Restore(&buffer); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for key, expected := range map[string]int{"a": 1, "b": 2} {
+		if data, ok, _ := target.Peek(key); !ok || data != expected {
+			t.Errorf("Expected %s to be restored as %d, got ok: %t, data: %d", key, expected, ok, data)
+		}
+	}
+
+	for _, key := range []string{"expired", "stale"} {
+		if _, ok, _ := target.Peek(key); ok {
+			t.Errorf("Expected %s not to be restored", key)
+		}
+	}
+
+	// The restored keys must survive a switchover
+	if err := target.switchover(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if data, ok, _ := target.Peek("a"); !ok || data != 1 {
+		t.Errorf("Expected a to survive a switchover, got ok: %t, data: %d", ok, data)
+	}
+
+	withoutCodec := newCountingDB()
+	defer withoutCodec.Shutdown()
+
+	if err := withoutCodec.Snapshot(&buffer); !errors.Is(err, snapshot.ErrNoCodec) {
+		t.Errorf("Expected ErrNoCodec, got %v", err)
+	}
+}
+
+func TestSwitchoverTrigger(t *testing.T) {
+	db := newCountingDB()
+	defer db.Shutdown()
+
+	// Keys inserted in ascending order degenerate the BST into a list
+	for i := 0; i < 200; i++ {
+		if _, err := db.Calculate(context.Background(), fmt.Sprintf("key%04d", i), 1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// The switchover resets the metric, and rebuilds the BST from the balanced AVL tree
+	deadline := time.Now().Add(time.Second)
+	for db.Swaps()["balance-factor"] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a switchover, the stats are %+v", db.stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSwitchoverPolicy(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	callback := func(data int, params int) (int, int, error) {
+		return data + params, data + params, nil
+	}
+	evict := func(data int) bool {
+		return data < 0
+	}
+
+	// Expired keys pile up in the BST but not in the AVL tree
+	db := NewDB(callback, evict, nil, nil, nil, logger, WithSwapPolicy(SizeRatioPolicy{Ratio: 2}))
+	defer db.Shutdown()
+
+	for i := 0; i < 100; i++ {
+		if _, err := db.Calculate(context.Background(), fmt.Sprintf("expired%03d", i), -1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for db.Swaps()["size-ratio"] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a switchover, the stats are %+v", db.stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if swaps := db.Swaps(); swaps["balance-factor"] != 0 {
+		t.Errorf("Expected only the configured policy to fire, got %v", swaps)
+	}
+}
+
+func TestSwitchoverWritePause(t *testing.T) {
+	db := newCountingDB()
+	defer db.Shutdown()
+
+	for i := 0; i < 100; i++ {
+		if _, err := db.Calculate(context.Background(), strconv.Itoa(i), 1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Hold the switchover after the trees are swapped, before the AVL tree is rebuilt
+	db.swapLock.Lock()
+	if err := db.swap(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Calculations carry on meanwhile; the deadline only keeps a regression from hanging the test
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, key := range []string{"0", "50", "99", "new"} {
+		if _, err := db.Calculate(ctx, key, 1); err != nil {
+			t.Fatalf("Expected %s to be calculated while the AVL tree waits to be rebuilt, got %v", key, err)
+		}
+	}
+	if err := db.flush(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	db.avlLock.Lock()
+	rebuilding, pending := db.rebuilding, len(db.pending)
+	db.avlLock.Unlock()
+	if !rebuilding || pending == 0 {
+		t.Errorf("Expected the updates to be held back for the rebuild, got rebuilding: %t, %d pending", rebuilding, pending)
+	}
+
+	db.rebuildAVL()
+	db.swapLock.Unlock()
+
+	// The rebuilt AVL tree caught up with the updates held back, so the next switchover keeps them
+	if err := db.switchover(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for key, expected := range map[string]int{"0": 2, "1": 1, "50": 2, "99": 2, "new": 1} {
+		if data, ok, err := db.Peek(key); err != nil || !ok || data != expected {
+			t.Errorf("Expected %s to be %d, got %d, ok: %t, error: %v", key, expected, data, ok, err)
+		}
+	}
+}
+
+func TestRebalancing(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	callback := func(data int, params int) (int, int, error) {
+		return data + params, data + params, nil
+	}
+	evict := func(_ int) bool { return false }
+
+	db := NewDB(callback, evict, nil, nil, nil, logger, WithRebalancing())
+	defer db.Shutdown()
+
+	ctx := context.Background()
+
+	// Scans must stay in ascending order without repeats while rotations move the nodes around
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			previous := ""
+			err := db.Scan(ctx, "", "", 0, func(key string, _ int) bool {
+				if key <= previous {
+					t.Errorf("Expected %q to come after %q", key, previous)
+					return false
+				}
+				previous = key
+				return true
+			})
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		if _, err := db.Calculate(ctx, fmt.Sprintf("key%04d", i), 1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if db.Rotations() == 0 {
+		t.Errorf("Expected rotations")
+	}
+	if swaps := db.Swaps(); len(swaps) != 0 {
+		t.Errorf("Expected no switchovers, got %v", swaps)
+	}
+
+	if result, err := db.Calculate(ctx, "key0500", 1); err != nil || result != 2 {
+		t.Errorf("Expected key0500 to be at 2, got %d: %v", result, err)
+	}
+
+	if deleted, err := db.Delete("key0500"); err != nil || !deleted {
+		t.Errorf("Expected key0500 to be deleted: %v", err)
+	}
+	if _, ok, _ := db.Peek("key0500"); ok {
+		t.Errorf("Expected key0500 to be gone")
+	}
+
+	committed, err := db.Txn(ctx, []string{"key0001", "key0999"}, func(data map[string]int) (bool, error) {
+		data["key0001"] += 10
+		data["key0999"] += 10
+		return true, nil
+	})
+	if err != nil || !committed {
+		t.Fatalf("Expected the transaction to commit: %v", err)
+	}
+	if data, _, _ := db.Peek("key0999"); data != 11 {
+		t.Errorf("Expected key0999 to be at 11, got %d", data)
+	}
+}
+
+func BenchmarkCalculate(b *testing.B) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	callback := func(data int, params int) (int, int, error) {
+		return data + params, data + params, nil
+	}
+	evict := func(_ int) bool { return false }
+
+	for _, bench := range []struct {
+		name string
+		opts []Option
+	}{
+		{"shadow-avl", nil},
+		{"rebalancing", []Option{WithRebalancing()}},
+		{"lockfree", []Option{WithLockFreeReads()}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			db := NewDB(callback, evict, nil, nil, nil, logger, bench.opts...)
+			defer db.Shutdown()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := db.Calculate(context.Background(), strconv.Itoa(i%10000), 1); err != nil {
+						b.Errorf("Unexpected error: %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkCalculateProcs compares the throughput of the hand-over-hand and lock-free searches as
+// GOMAXPROCS grows, where the root lock becomes a point every request contends on.
+func BenchmarkCalculateProcs(b *testing.B) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	callback := func(data int, params int) (int, int, error) {
+		return data + params, data + params, nil
+	}
+	evict := func(_ int) bool { return false }
+
+	for _, bench := range []struct {
+		name string
+		opts []Option
+	}{
+		{"shadow-avl", nil},
+		{"lockfree", []Option{WithLockFreeReads()}},
+	} {
+		for _, procs := range []int{1, 4, 8, 16} {
+			b.Run(fmt.Sprintf("%s/procs=%d", bench.name, procs), func(b *testing.B) {
+				defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+
+				db := NewDB(callback, evict, nil, nil, nil, logger, bench.opts...)
+				defer db.Shutdown()
+
+				// Fill the tree first, so the benchmark measures searches rather than inserts
+				for i := 0; i < 10000; i++ {
+					if _, err := db.Calculate(context.Background(), strconv.Itoa(i), 1); err != nil {
+						b.Fatalf("Unexpected error: %v", err)
+					}
+				}
+				b.ResetTimer()
+
+				b.RunParallel(func(pb *testing.PB) {
+					for i := 0; pb.Next(); i++ {
+						if _, err := db.Calculate(context.Background(), strconv.Itoa(i%10000), 1); err != nil {
+							b.Errorf("Unexpected error: %v", err)
+							return
+						}
+					}
+				})
+				b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+			})
+		}
+	}
+}
+
+func TestLockFreeReads(t *testing.T) {
+	// Swap as often as possible, so searches also cross switchovers
+	db := newCountingDB(WithLockFreeReads(), WithSwapPolicy(BalanceFactorPolicy{Threshold: 0}))
+	defer db.Shutdown()
+
+	const numKeys = 100
+	const concurrencyLevel = 8
+	const rounds = 20
+
+	ctx := context.Background()
+
+	// Every worker deletes its own keys, so the others' keys count every round
+	var wg sync.WaitGroup
+	for w := 0; w < concurrencyLevel; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				for i := 0; i < numKeys; i++ {
+					if _, err := db.Calculate(ctx, fmt.Sprintf("key%03d", i), 1); err != nil {
+						t.Errorf("Unexpected error: %v", err)
+						return
+					}
+				}
+
+				key := fmt.Sprintf("worker%d", worker)
+				if _, err := db.Calculate(ctx, key, 1); err != nil {
+					t.Errorf("Unexpected error: %v", err)
+					return
+				}
+				if deleted, err := db.Delete(key); err != nil || !deleted {
+					t.Errorf("Expected %s to be deleted: %v", key, err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if err := db.switchover(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if data, ok, _ := db.Peek(key); !ok || data != concurrencyLevel*rounds {
+			t.Errorf("Expected %s to be at %d, got %d", key, concurrencyLevel*rounds, data)
+		}
+	}
+
+	keys := 0
+	if err := db.Scan(ctx, "", "", 0, func(_ string, _ int) bool { keys++; return true }); err != nil || keys != numKeys {
+		t.Errorf("Expected %d keys, got %d: %v", numKeys, keys, err)
+	}
+
+	if swaps := db.Swaps(); swaps["balance-factor"] == 0 {
+		t.Errorf("Expected switchovers while the keys were updated, got %v", swaps)
+	}
+}
+
+func TestReaper(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	callback := func(data int, params int) (int, int, error) {
+		return data + params, data + params, nil
+	}
+	evict := func(data int) bool {
+		return data < 0
+	}
+
+	for _, mode := range []struct {
+		name string
+		opts []Option
+	}{
+		{"shadow-avl", nil},
+		{"rebalancing", []Option{WithRebalancing()}},
+		{"lockfree", []Option{WithLockFreeReads()}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			// A swap policy that never fires, so only the reaper can remove keys from the BST
+			opts := append([]Option{WithReapInterval(5 * time.Millisecond), WithSwapPolicy(AllPolicy{})}, mode.opts...)
+			db := NewDB(callback, evict, nil, nil, nil, logger, opts...)
+			defer db.Shutdown()
+
+			ctx := context.Background()
+			for i := 0; i < 100; i++ {
+				params := 1
+				if i%2 == 0 {
+					params = -1
+				}
+				if _, err := db.Calculate(ctx, strconv.Itoa(i), params); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for db.bst.size.Load() > 50 {
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected the expired keys to be reaped, %d keys left", db.bst.size.Load())
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			for i := 0; i < 100; i++ {
+				if _, ok, _ := db.Peek(strconv.Itoa(i)); ok != (i%2 == 1) {
+					t.Errorf("Expected %d to exist: %t, got %t", i, i%2 == 1, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestExpiryIndex(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// The data is the time the key expires, in Unix nanoseconds
+	callback := func(_ int64, params int64) (int64, int64, error) {
+		return params, params, nil
+	}
+	var evictions atomic.Int64
+	evict := func(data int64) bool {
+		evictions.Add(1)
+		return time.Now().UnixNano() >= data
+	}
+	expiresAt := func(data int64) time.Time {
+		return time.Unix(0, data)
+	}
+
+	// Neither the reaper nor a switchover may get in the way
+	db := NewDB(callback, evict, expiresAt, nil, nil, logger, WithReapInterval(time.Hour), WithSwapPolicy(AllPolicy{}))
+	defer db.Shutdown()
+
+	ctx := context.Background()
+	past := time.Now().Add(-time.Second).UnixNano()
+	future := time.Now().Add(time.Hour).UnixNano()
+
+	for i := 0; i < 100; i++ {
+		deadline := future
+		if i%10 == 0 {
+			deadline = past
+		}
+		if _, err := db.Calculate(ctx, strconv.Itoa(i), deadline); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	db.rwLock.Lock()
+	err := db.flush()
+	db.rwLock.Unlock()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Surveying the tree after every write would have called evict thousands of times
+	if n := evictions.Load(); n != 10 {
+		t.Errorf("Expected evict to be called for the 10 expired keys, got %d calls", n)
+	}
+
+	db.avlLock.Lock()
+	defer db.avlLock.Unlock()
+
+	for i := 0; i < 100; i++ {
+		if db.avl.contains(strconv.Itoa(i)) != (i%10 != 0) {
+			t.Errorf("Expected %d in the AVL tree: %t", i, i%10 != 0)
+		}
+	}
+	if db.expiry.Len() != 90 {
+		t.Errorf("Expected 90 indexed keys, got %d", db.expiry.Len())
+	}
+}
+
+func TestDroppedUpdatesRebuildTheAVLTree(t *testing.T) {
+	db := newCountingDB(WithQueue(1, OverflowDrop), WithSwapPolicy(AllPolicy{}))
+	defer db.Shutdown()
+
+	// Stall the AVL goroutine so that updates are dropped
+	db.avlLock.Lock()
+	for i := 0; i < 10; i++ {
+		if _, err := db.Calculate(context.Background(), strconv.Itoa(i), 1); err != nil {
+			db.avlLock.Unlock()
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	db.avlLock.Unlock()
+
+	if stats := db.QueueStats(); stats.Drops == 0 || !stats.Stale {
+		t.Fatalf("Expected dropped updates and a stale tree, got %+v", stats)
+	}
+
+	// Swapping in the AVL tree as it is would lose the dropped updates
+	if err := db.switchover(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if data, ok, _ := db.Peek(strconv.Itoa(i)); !ok || data != 1 {
+			t.Errorf("Expected %d to survive the switchover, got ok: %t, data: %d", i, ok, data)
+		}
+	}
+
+	if stats := db.QueueStats(); stats.Stale {
+		t.Errorf("Expected the rebuilt tree not to be stale, got %+v", stats)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	db := newCountingDB(WithSwapPolicy(AllPolicy{}), WithLimits(admission.Limits{MaxKeys: 10, Policy: admission.LRU}))
+	defer db.Shutdown()
+
+	ctx := context.Background()
+	for i := 0; i < 25; i++ {
+		if _, err := db.Calculate(ctx, strconv.Itoa(i), 1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// The evictions reach the AVL tree, so the keys do not come back after a switchover
+	if err := db.switchover(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i := 0; i < 25; i++ {
+		if _, ok, _ := db.Peek(strconv.Itoa(i)); ok != (i >= 15) {
+			t.Errorf("Expected key %d to exist: %t", i, i >= 15)
+		}
+	}
+
+	stats, ok := db.LimitStats()
+	if !ok || stats.Keys != 10 || stats.Evictions != 15 || db.bst.size.Load() != 10 {
+		t.Errorf("Expected 10 keys and 15 evictions, got %+v and %d keys", stats, db.bst.size.Load())
+	}
+}
+
+func TestLimitsFallback(t *testing.T) {
+	for _, fallback := range []admission.Fallback{admission.Allow, admission.Deny} {
+		t.Run(fallback.String(), func(t *testing.T) {
+			db := newCountingDB(WithLimits(admission.Limits{MaxKeys: 2, Policy: admission.LFU, Fallback: fallback}))
+			defer db.Shutdown()
+
+			// Both keys are in regular use, so there is no room for a new one
+			ctx := context.Background()
+			for _, key := range []string{"a", "b", "a", "b"} {
+				if _, err := db.Calculate(ctx, key, 1); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+
+			result, err := db.Calculate(ctx, "c", 5)
+			switch fallback {
+			case admission.Allow:
+				if err != nil || result != 5 {
+					t.Errorf("Expected c to be calculated as a new key, got %d, %v", result, err)
+				}
+			case admission.Deny:
+				if !errors.Is(err, admission.ErrFull) {
+					t.Errorf("Expected ErrFull, got %v", err)
+				}
+			}
+
+			results, _, err := db.CalculateMany(ctx, []string{"a", "d"}, []int{1, 7}, func(_ []int) bool { return true })
+			switch fallback {
+			case admission.Allow:
+				if err != nil || results[0] != 3 || results[1] != 7 {
+					t.Errorf("Expected a to be stored and d calculated as a new key, got %v, %v", results, err)
+				}
+			case admission.Deny:
+				if !errors.Is(err, admission.ErrFull) {
+					t.Errorf("Expected ErrFull, got %v", err)
+				}
+			}
+
+			for key, exists := range map[string]bool{"a": true, "b": true, "c": false, "d": false} {
+				if _, ok, _ := db.Peek(key); ok != exists {
+					t.Errorf("Expected %s to exist: %t", key, exists)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitsRestore(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	callback := func(data int, params int) (int, int, error) {
+		return data + params, data + params, nil
+	}
+	evict := func(_ int) bool { return false }
+
+	source := NewDB(callback, evict, nil, intCodec{}, nil, logger)
+	defer source.Shutdown()
+
+	for i := 0; i < 5; i++ {
+		if _, err := source.Calculate(context.Background(), strconv.Itoa(i), i); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := source.Snapshot(&buffer); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	target := NewDB(callback, evict, nil, intCodec{}, nil, logger, WithLimits(admission.Limits{MaxKeys: 3}))
+	defer target.Shutdown()
+
+	if err := target.Restore(&buffer); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The snapshot is written in key order, so the first keys count as the least recently used
+	if keys := target.bst.root.inorderDesc(nil); len(keys) != 3 || keys[0] != "2" {
+		t.Errorf("Expected keys 2 to 4 to be restored, got %v", keys)
+	}
+	if keys := target.avl.GetKeys(); len(keys) != 3 {
+		t.Errorf("Expected 3 keys in the AVL tree, got %v", keys)
+	}
+}
+
+func TestLimitsFailedRestore(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	callback := func(data int, params int) (int, int, error) {
+		return data + params, data + params, nil
+	}
+	evict := func(_ int) bool { return false }
+
+	db := NewDB(callback, evict, nil, intCodec{}, nil, logger, WithLimits(admission.Limits{MaxKeys: 3}))
+	defer db.Shutdown()
+
+	if _, err := db.Calculate(context.Background(), "kept", 1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var buffer bytes.Buffer
+	sw, err := snapshot.NewWriter[int](&buffer, intCodec{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := sw.Write(key, 1); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Stall the AVL goroutine, so that the restore times out waiting for it
+	db.avlLock.Lock()
+	err = db.Restore(&buffer)
+	db.avlLock.Unlock()
+
+	var waitErr *WaitError
+	if !errors.As(err, &waitErr) {
+		t.Fatalf("Expected a WaitError, got %v", err)
+	}
+
+	// The failed restore left the tracked keys as they were
+	if !db.limiter.Tracked("kept") || db.limiter.Tracked("a") {
+		t.Errorf("Expected only kept to be tracked")
+	}
+	if stats, _ := db.LimitStats(); stats.Keys != 1 {
+		t.Errorf("Expected 1 key tracked, got %d", stats.Keys)
+	}
+}
@@ -0,0 +1,150 @@
+package naive
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SwapStats describes the trees at the time a SwapPolicy is consulted. Everything is counted since
+// the last switchover.
+type SwapStats struct {
+	BalanceFactorSum int64         // BalanceFactorSum adds up the balance factors seen by lookups.
+	Ops              int64         // Ops counts the operations.
+	MaxHeight        int32         // MaxHeight is the largest BST height observed by a lookup.
+	BSTSize          int64         // BSTSize counts the nodes in the BST.
+	AVLSize          int64         // AVLSize counts the nodes in the AVL tree.
+	SinceSwap        time.Duration // SinceSwap is the time since the last switchover.
+}
+
+// SwapPolicy decides when the BST is replaced by the AVL tree. ShouldSwap is consulted after every
+// operation, so it must be cheap and safe for concurrent use. When it decides to swap it also
+// returns the name of the policy that fired, which is logged and counted.
+type SwapPolicy interface {
+	ShouldSwap(stats SwapStats) (string, bool)
+}
+
+// BalanceFactorPolicy swaps once the average balance factor per operation exceeds Threshold. This is
+// the default policy, with a threshold of TriggerThreshold.
+type BalanceFactorPolicy struct {
+	Threshold float64
+}
+
+func (p BalanceFactorPolicy) ShouldSwap(stats SwapStats) (string, bool) {
+	return "balance-factor", float64(stats.BalanceFactorSum)/float64(max(stats.Ops, 1)) > p.Threshold
+}
+
+// HeightPolicy swaps once a lookup has seen the BST grow taller than Factor times log2 of its size,
+// the height of a balanced tree.
+type HeightPolicy struct {
+	Factor float64
+}
+
+func (p HeightPolicy) ShouldSwap(stats SwapStats) (string, bool) {
+	return "height", float64(stats.MaxHeight) > p.Factor*math.Log2(float64(stats.BSTSize+1))
+}
+
+// ElapsedPolicy swaps once Interval has passed since the last switchover.
+type ElapsedPolicy struct {
+	Interval time.Duration
+}
+
+func (p ElapsedPolicy) ShouldSwap(stats SwapStats) (string, bool) {
+	return "elapsed", stats.SinceSwap > p.Interval
+}
+
+// SizeRatioPolicy swaps once the BST holds more than Ratio times as many nodes as the AVL tree. The
+// AVL tree evicts expired keys as it goes but the BST does not, so this bounds the stale keys the
+// BST accumulates.
+type SizeRatioPolicy struct {
+	Ratio float64
+}
+
+func (p SizeRatioPolicy) ShouldSwap(stats SwapStats) (string, bool) {
+	return "size-ratio", float64(stats.BSTSize) > p.Ratio*float64(max(stats.AVLSize, 1))
+}
+
+// AnyPolicy swaps as soon as any of its policies would, and reports the first that fired.
+type AnyPolicy []SwapPolicy
+
+func (p AnyPolicy) ShouldSwap(stats SwapStats) (string, bool) {
+	for _, policy := range p {
+		if name, ok := policy.ShouldSwap(stats); ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// AllPolicy only swaps once every one of its policies would, and reports them joined with "+".
+type AllPolicy []SwapPolicy
+
+func (p AllPolicy) ShouldSwap(stats SwapStats) (string, bool) {
+	if len(p) == 0 {
+		return "", false
+	}
+
+	names := make([]string, 0, len(p))
+	for _, policy := range p {
+		name, ok := policy.ShouldSwap(stats)
+		if !ok {
+			return "", false
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, "+"), true
+}
+
+// ParseSwapPolicy parses a comma-separated list of policies, any of which triggers a swap, or all
+// of which must when the list is prefixed with "all:". Each policy is written as name=value:
+// balance-factor=50, height=2, elapsed=10m or size-ratio=1.5.
+func ParseSwapPolicy(spec string) (SwapPolicy, error) {
+	spec, all := strings.CutPrefix(spec, "all:")
+
+	policies := []SwapPolicy{}
+	for _, part := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("swap policy %q: expected name=value", part)
+		}
+
+		var policy SwapPolicy
+		var err error
+
+		switch name {
+		case "balance-factor":
+			var threshold float64
+			threshold, err = strconv.ParseFloat(value, 64)
+			policy = BalanceFactorPolicy{Threshold: threshold}
+		case "height":
+			var factor float64
+			factor, err = strconv.ParseFloat(value, 64)
+			policy = HeightPolicy{Factor: factor}
+		case "elapsed":
+			var interval time.Duration
+			interval, err = time.ParseDuration(value)
+			policy = ElapsedPolicy{Interval: interval}
+		case "size-ratio":
+			var ratio float64
+			ratio, err = strconv.ParseFloat(value, 64)
+			policy = SizeRatioPolicy{Ratio: ratio}
+		default:
+			return nil, fmt.Errorf("swap policy %q: unknown policy %q", part, name)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("swap policy %q: %w", part, err)
+		}
+		policies = append(policies, policy)
+	}
+
+	if len(policies) == 1 {
+		return policies[0], nil
+	}
+	if all {
+		return AllPolicy(policies), nil
+	}
+	return AnyPolicy(policies), nil
+}
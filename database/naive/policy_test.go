@@ -0,0 +1,96 @@
+//nolint:testpackage // Allow tests to access the naive package
+package naive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSwapPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   SwapPolicy
+		stats    SwapStats
+		expected string
+		swap     bool
+	}{
+		{"balance factor below", BalanceFactorPolicy{Threshold: 50}, SwapStats{BalanceFactorSum: 500, Ops: 10}, "", false},
+		{"balance factor above", BalanceFactorPolicy{Threshold: 50}, SwapStats{BalanceFactorSum: 510, Ops: 10}, "balance-factor", true},
+		{"balance factor no ops", BalanceFactorPolicy{Threshold: 50}, SwapStats{BalanceFactorSum: 51}, "balance-factor", true},
+		{"height balanced", HeightPolicy{Factor: 2}, SwapStats{MaxHeight: 10, BSTSize: 1023}, "", false},
+		{"height degenerate", HeightPolicy{Factor: 2}, SwapStats{MaxHeight: 100, BSTSize: 1023}, "height", true},
+		{"elapsed recent", ElapsedPolicy{Interval: time.Minute}, SwapStats{SinceSwap: time.Second}, "", false},
+		{"elapsed", ElapsedPolicy{Interval: time.Minute}, SwapStats{SinceSwap: time.Hour}, "elapsed", true},
+		{"size ratio below", SizeRatioPolicy{Ratio: 2}, SwapStats{BSTSize: 20, AVLSize: 10}, "", false},
+		{"size ratio above", SizeRatioPolicy{Ratio: 2}, SwapStats{BSTSize: 21, AVLSize: 10}, "size-ratio", true},
+		{
+			"any",
+			AnyPolicy{ElapsedPolicy{Interval: time.Minute}, SizeRatioPolicy{Ratio: 2}},
+			SwapStats{BSTSize: 21, AVLSize: 10},
+			"size-ratio",
+			true,
+		},
+		{
+			"any none",
+			AnyPolicy{ElapsedPolicy{Interval: time.Minute}, SizeRatioPolicy{Ratio: 2}},
+			SwapStats{BSTSize: 20, AVLSize: 10},
+			"",
+			false,
+		},
+		{
+			"all",
+			AllPolicy{ElapsedPolicy{Interval: time.Minute}, SizeRatioPolicy{Ratio: 2}},
+			SwapStats{BSTSize: 21, AVLSize: 10, SinceSwap: time.Hour},
+			"elapsed+size-ratio",
+			true,
+		},
+		{
+			"all but one",
+			AllPolicy{ElapsedPolicy{Interval: time.Minute}, SizeRatioPolicy{Ratio: 2}},
+			SwapStats{BSTSize: 21, AVLSize: 10},
+			"",
+			false,
+		},
+		{"all empty", AllPolicy{}, SwapStats{}, "", false},
+	}
+
+	for _, test := range tests {
+		name, swap := test.policy.ShouldSwap(test.stats)
+		if swap != test.swap || (swap && name != test.expected) {
+			t.Errorf("%s: expected (%q, %t), got (%q, %t)", test.name, test.expected, test.swap, name, swap)
+		}
+	}
+}
+
+func TestParseSwapPolicy(t *testing.T) {
+	policy, err := ParseSwapPolicy("balance-factor=25")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if policy != (BalanceFactorPolicy{Threshold: 25}) {
+		t.Errorf("Expected a single balance factor policy, got %#v", policy)
+	}
+
+	policy, err = ParseSwapPolicy("height=2, elapsed=10m")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if anyOf, ok := policy.(AnyPolicy); !ok || len(anyOf) != 2 ||
+		anyOf[0] != (HeightPolicy{Factor: 2}) || anyOf[1] != (ElapsedPolicy{Interval: 10 * time.Minute}) {
+		t.Errorf("Expected any of height and elapsed, got %#v", policy)
+	}
+
+	policy, err = ParseSwapPolicy("all:size-ratio=1.5,elapsed=1s")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if allOf, ok := policy.(AllPolicy); !ok || len(allOf) != 2 || allOf[0] != (SizeRatioPolicy{Ratio: 1.5}) {
+		t.Errorf("Expected all of size ratio and elapsed, got %#v", policy)
+	}
+
+	for _, spec := range []string{"", "height", "height=tall", "elapsed=10", "depth=3", "height=2,"} {
+		if _, err = ParseSwapPolicy(spec); err == nil {
+			t.Errorf("Expected an error parsing %q", spec)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package naive
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultQueueSize is the number of updates the AVL queue holds by default.
+const DefaultQueueSize = 1024
+
+// OverflowPolicy decides what happens to an update published to a full AVL queue.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes the publisher wait for room, or for its context to be done.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop drops the update and marks the AVL tree as stale, so that the next switchover
+	// rebuilds it from the BST rather than swapping it in.
+	OverflowDrop
+	// OverflowCoalesce merges every update into the pending update of the same key, so a key takes
+	// up at most one place in the queue and one insert in the AVL tree. Updates to other keys wait
+	// for room as with OverflowBlock.
+	OverflowCoalesce
+)
+
+// String returns the name ParseOverflowPolicy accepts for the policy.
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDrop:
+		return "drop"
+	case OverflowCoalesce:
+		return "coalesce"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+// ParseOverflowPolicy parses "block", "drop" or "coalesce".
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch strings.ToLower(s) {
+	case "block":
+		return OverflowBlock, nil
+	case "drop":
+		return OverflowDrop, nil
+	case "coalesce":
+		return OverflowCoalesce, nil
+	default:
+		return OverflowBlock, fmt.Errorf("unknown overflow policy %q", s)
+	}
+}
+
+// QueueStats describes the AVL queue.
+type QueueStats struct {
+	Depth     int            // Depth is the number of updates waiting to be applied.
+	Capacity  int            // Capacity is the number of updates the queue holds.
+	Policy    OverflowPolicy // Policy is what happens to updates published to a full queue.
+	Drops     int64          // Drops counts the updates dropped since the DB was created.
+	Coalesced int64          // Coalesced counts the updates merged into a pending update.
+	Stale     bool           // Stale reports that updates were dropped since the last switchover.
+}
+
+// avlQueue carries updates from the BST to the AVL goroutine. It replaces an unbuffered channel so
+// that publishers only wait on the AVL goroutine once the queue is full, and then only as far as
+// the overflow policy says. Acknowledgements are never dropped, coalesced or held up by a full queue.
+type avlQueue[D any] struct {
+	lock      sync.Mutex
+	messages  []Message[D]
+	pending   map[string]int // pending locates the queued update of each key, when coalescing.
+	capacity  int
+	policy    OverflowPolicy
+	closed    bool
+	notEmpty  chan struct{} // notEmpty holds a token once there is something to pop.
+	notFull   chan struct{} // notFull holds a token once there may be room to push.
+	drops     atomic.Int64
+	coalesced atomic.Int64
+	stale     atomic.Bool
+}
+
+func newAVLQueue[D any](capacity int, policy OverflowPolicy) *avlQueue[D] {
+	return &avlQueue[D]{
+		pending:  map[string]int{},
+		capacity: capacity,
+		policy:   policy,
+		notEmpty: make(chan struct{}, 1),
+		notFull:  make(chan struct{}, 1),
+	}
+}
+
+// push queues the message. If the queue is full it waits for room, giving up with a *WaitError if
+// the context is done first, unless the policy drops the message instead. A batch is split into
+// its updates when coalescing.
+func (q *avlQueue[D]) push(ctx context.Context, message Message[D]) error {
+	if message.batch != nil && q.policy == OverflowCoalesce {
+		for _, update := range message.batch {
+			if err := q.push(ctx, update); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for {
+		q.lock.Lock()
+
+		if q.closed {
+			q.lock.Unlock()
+			return &WaitError{Op: "avl queue", Err: context.Canceled}
+		}
+
+		if i, ok := q.pending[message.key]; ok && q.policy == OverflowCoalesce && message.batch == nil {
+			q.messages[i] = message
+			q.lock.Unlock()
+			q.coalesced.Add(1)
+			return nil
+		}
+
+		if len(q.messages) < q.capacity {
+			q.enqueue(message)
+			room := len(q.messages) < q.capacity
+			q.lock.Unlock()
+
+			signal(q.notEmpty)
+			// Pass the room on to anyone else waiting for it
+			if room {
+				signal(q.notFull)
+			}
+			return nil
+		}
+
+		if q.policy == OverflowDrop {
+			q.lock.Unlock()
+			q.drops.Add(1)
+			q.stale.Store(true)
+			return nil
+		}
+
+		q.lock.Unlock()
+
+		select {
+		case <-q.notFull:
+		case <-ctx.Done():
+			return &WaitError{Op: "avl queue", Err: ctx.Err()}
+		}
+	}
+}
+
+// ack queues an acknowledgement, which the AVL goroutine closes once every earlier message has
+// been applied.
+func (q *avlQueue[D]) ack(ack chan struct{}) error {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return &WaitError{Op: "avl queue", Err: context.Canceled}
+	}
+	q.messages = append(q.messages, Message[D]{ack: ack})
+	// Later updates must not be merged into ones the acknowledgement covers
+	clear(q.pending)
+	q.lock.Unlock()
+
+	signal(q.notEmpty)
+	return nil
+}
+
+// enqueue appends the message. The caller must hold the lock.
+func (q *avlQueue[D]) enqueue(message Message[D]) {
+	if q.policy == OverflowCoalesce && message.batch == nil && message.ack == nil {
+		q.pending[message.key] = len(q.messages)
+	}
+	q.messages = append(q.messages, message)
+}
+
+// pop waits for messages and returns every one queued, in order. It returns false once the queue
+// has been closed and drained.
+func (q *avlQueue[D]) pop() ([]Message[D], bool) {
+	for {
+		q.lock.Lock()
+
+		if len(q.messages) > 0 {
+			messages := q.messages
+			q.messages = make([]Message[D], 0, len(messages))
+			clear(q.pending)
+			q.lock.Unlock()
+
+			signal(q.notFull)
+			return messages, true
+		}
+
+		if q.closed {
+			q.lock.Unlock()
+			return nil, false
+		}
+
+		q.lock.Unlock()
+		<-q.notEmpty
+	}
+}
+
+// close stops the queue accepting messages. Messages already queued are still popped.
+func (q *avlQueue[D]) close() {
+	q.lock.Lock()
+	q.closed = true
+	q.lock.Unlock()
+
+	signal(q.notEmpty)
+}
+
+// stats describes the queue.
+func (q *avlQueue[D]) stats() QueueStats {
+	q.lock.Lock()
+	depth := len(q.messages)
+	q.lock.Unlock()
+
+	return QueueStats{
+		Depth:     depth,
+		Capacity:  q.capacity,
+		Policy:    q.policy,
+		Drops:     q.drops.Load(),
+		Coalesced: q.coalesced.Load(),
+		Stale:     q.stale.Load(),
+	}
+}
+
+// signal leaves a token in the channel, unless there is one already.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
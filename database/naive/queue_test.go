@@ -0,0 +1,101 @@
+//nolint:testpackage // Allow tests to access the naive package
+package naive
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAVLQueueCoalesce(t *testing.T) {
+	q := newAVLQueue[int](2, OverflowCoalesce)
+	ctx := context.Background()
+
+	for i := 1; i <= 5; i++ {
+		if err := q.push(ctx, Message[int]{key: "a", data: i}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// A batch is split into its updates, and merged into the pending ones
+	batch := Message[int]{batch: []Message[int]{{key: "a", data: 6}, {key: "b", data: 1}}}
+	if err := q.push(ctx, batch); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Updates after an acknowledgement are not merged into the ones it covers
+	ack := make(chan struct{})
+	if err := q.ack(ack); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	stats := q.stats()
+	if stats.Depth != 3 || stats.Coalesced != 5 {
+		t.Errorf("Expected a depth of 3 with 5 updates coalesced, got %+v", stats)
+	}
+
+	messages, ok := q.pop()
+	if !ok || len(messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %v", messages)
+	}
+	if messages[0].key != "a" || messages[0].data != 6 || messages[1].key != "b" || messages[2].ack != ack {
+		t.Errorf("Expected the latest update of a, then b, then the acknowledgement, got %+v", messages)
+	}
+}
+
+func TestAVLQueueDrop(t *testing.T) {
+	q := newAVLQueue[int](1, OverflowDrop)
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := q.push(ctx, Message[int]{key: key}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	stats := q.stats()
+	if stats.Depth != 1 || stats.Drops != 2 || !stats.Stale {
+		t.Errorf("Expected one update queued, two dropped and a stale tree, got %+v", stats)
+	}
+}
+
+func TestAVLQueueBlock(t *testing.T) {
+	q := newAVLQueue[int](1, OverflowBlock)
+
+	if err := q.push(context.Background(), Message[int]{key: "a"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	var waitErr *WaitError
+	if err := q.push(ctx, Message[int]{key: "b"}); !errors.As(err, &waitErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a *WaitError wrapping context.DeadlineExceeded, got %v", err)
+	}
+
+	// A blocked publisher gets in once the queue is popped
+	pushed := make(chan error)
+	go func() {
+		pushed <- q.push(context.Background(), Message[int]{key: "c"})
+	}()
+
+	if messages, _ := q.pop(); len(messages) != 1 || messages[0].key != "a" {
+		t.Errorf("Expected a alone, got %+v", messages)
+	}
+	if err := <-pushed; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Closing the queue turns publishers away but leaves what is queued to be popped
+	q.close()
+	if err := q.push(context.Background(), Message[int]{key: "d"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a closed queue to refuse updates, got %v", err)
+	}
+	if messages, ok := q.pop(); !ok || len(messages) != 1 || messages[0].key != "c" {
+		t.Errorf("Expected c to be popped after closing, got %+v", messages)
+	}
+	if _, ok := q.pop(); ok {
+		t.Errorf("Expected a closed and drained queue to report false")
+	}
+}
@@ -7,23 +7,29 @@ import (
 
 // Node represents a single node within a BST.
 // It contains the key, associated data, height of the node, and pointers to the left and right child nodes.
-type Node struct {
-	lock   sync.Mutex
-	key    string       // Key is the unique identifier for the node.
-	data   any          // Data points to the associated data of the node.
-	height atomic.Int32 // Height is the height of the node within the tree.
-	left   *Node        // Left points to the left child node.
-	right  *Node        // Right points to the right child node.
+type Node[D any] struct {
+	lock     sync.Mutex   // Lock guards the key and children, it is taken hand-over-hand by traversals.
+	dataLock sync.Mutex   // DataLock guards the data, and is held while a callback runs on it.
+	key      string       // Key is the unique identifier for the node.
+	data     D            // Data is the associated data of the node.
+	height   atomic.Int32 // Height is the height of the node within the tree.
+	left     *Node[D]     // Left points to the left child node.
+	right    *Node[D]     // Right points to the right child node.
+	removed  bool         // Removed is set under both locks once the node is unlinked from the tree.
+	empty    bool         // Empty is set on a node created by a search until data is stored in it.
 }
 
-// The message that is passed over the channel.
-type Message struct {
-	key  string
-	data any
+// The message that is passed through the AVL queue.
+type Message[D any] struct {
+	key     string
+	data    D
+	deleted bool          // Deleted marks the removal of the key rather than an update.
+	batch   []Message[D]  // Batch holds the updates of a transaction, applied together in place of key.
+	ack     chan struct{} // Ack, if set, is closed once every earlier message has been applied.
 }
 
 // inorderDesc traverses the tree in an in-order manner (descending order) and collects the keys.
-func (node *Node) inorderDesc(keys []string) []string {
+func (node *Node[D]) inorderDesc(keys []string) []string {
 	if node == nil {
 		return keys
 	}
@@ -37,7 +43,7 @@ func (node *Node) inorderDesc(keys []string) []string {
 
 // getHeight atomically returns the height of the node.
 // If the node is nil, it returns -1, indicating the height of a non-existent node.
-func (node *Node) getHeight() int32 {
+func (node *Node[D]) getHeight() int32 {
 	if node == nil {
 		return -1
 	}
@@ -46,7 +52,7 @@ func (node *Node) getHeight() int32 {
 
 // getBalanceFactor atomically calculates and returns the balance factor of the node.
 // The balance factor is the difference in heights between the left and right subtrees.
-func (node *Node) getBalanceFactor() int32 {
+func (node *Node[D]) getBalanceFactor() int32 {
 	if node == nil {
 		return 0
 	}
@@ -61,3 +67,16 @@ func absInt32(x int32) int32 {
 	}
 	return x
 }
+
+// PrefixEnd returns the smallest key greater than every key starting with prefix, for use as the
+// exclusive end of a scan. It returns "" (unbounded) if there is no such key.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package naive
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// WaitError is returned when an operation gives up waiting on a lock or on the AVL queue because
+// its context was canceled or its deadline expired. It wraps the context's error, so callers can
+// test for context.DeadlineExceeded or context.Canceled with errors.Is.
+type WaitError struct {
+	Op  string // Op names what the operation was waiting on.
+	Err error  // Err is the context's error.
+}
+
+func (e *WaitError) Error() string {
+	return "naive db: gave up waiting on " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *WaitError) Unwrap() error {
+	return e.Err
+}
+
+// spinAttempts is how many times lockContext and rLockContext retry a contended lock, yielding the
+// processor in between, before they hand the wait over to a helper goroutine. Node locks are only
+// held for a callback, so most contended acquisitions succeed while spinning.
+const spinAttempts = 32
+
+// lockContext acquires the mutex unless the context is done first. Uncontended locks are taken
+// without allocating, and briefly contended ones by retrying, checking the context between attempts.
+// Only a lock still held after that is waited on by a helper goroutine, and if the context wins it
+// hands the lock straight back once it eventually acquires it.
+func lockContext(ctx context.Context, op string, m *sync.Mutex) error {
+	if m.TryLock() {
+		return nil
+	}
+
+	// No deadline and no cancellation, so there is nothing to race against
+	if ctx.Done() == nil {
+		m.Lock()
+		return nil
+	}
+
+	return waitContext(ctx, op, m.TryLock, m.Lock, m.Unlock)
+}
+
+// rLockContext acquires a read lock on the r/w mutex unless the context is done first. It follows
+// the same approach as lockContext.
+func rLockContext(ctx context.Context, op string, rw *sync.RWMutex) error {
+	if rw.TryRLock() {
+		return nil
+	}
+
+	if ctx.Done() == nil {
+		rw.RLock()
+		return nil
+	}
+
+	return waitContext(ctx, op, rw.TryRLock, rw.RLock, rw.RUnlock)
+}
+
+// waitContext is the slow path of lockContext and rLockContext, for a lock whose first try failed.
+func waitContext(ctx context.Context, op string, tryLock func() bool, lock func(), unlock func()) error {
+	for i := 0; i < spinAttempts; i++ {
+		if err := ctx.Err(); err != nil {
+			return &WaitError{Op: op, Err: err}
+		}
+
+		runtime.Gosched()
+		if tryLock() {
+			return nil
+		}
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		lock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-acquired
+			unlock()
+		}()
+		return &WaitError{Op: op, Err: ctx.Err()}
+	}
+}
@@ -0,0 +1,77 @@
+//nolint:testpackage // Allow tests to access the naive package
+package naive
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockContext(t *testing.T) {
+	var m sync.Mutex
+	m.Lock()
+
+	// A lock released while spinning is acquired without a helper goroutine
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		runtime.Gosched()
+		m.Unlock()
+	}()
+	if err := lockContext(ctx, "mutex", &m); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// A lock that stays held is given up on once the context is done
+	deadline, cancelDeadline := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelDeadline()
+
+	var waitErr *WaitError
+	if err := lockContext(deadline, "mutex", &m); !errors.As(err, &waitErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a *WaitError wrapping context.DeadlineExceeded, got %v", err)
+	}
+
+	// The lock is still usable once it is released
+	m.Unlock()
+	if err := lockContext(ctx, "mutex", &m); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	m.Unlock()
+}
+
+func TestRLockContext(t *testing.T) {
+	var rw sync.RWMutex
+	rw.Lock()
+
+	deadline, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := rLockContext(deadline, "r/w lock", &rw); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	rw.Unlock()
+	if err := rLockContext(context.Background(), "r/w lock", &rw); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	rw.RUnlock()
+}
+
+func BenchmarkLockContextContended(b *testing.B) {
+	var m sync.Mutex
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := lockContext(ctx, "mutex", &m); err != nil {
+				b.Fatalf("Unexpected error: %v", err)
+			}
+			m.Unlock()
+		}
+	})
+}
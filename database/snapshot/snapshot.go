@@ -0,0 +1,270 @@
+// Package snapshot reads and writes the on-disk snapshot format shared by the database engines.
+//
+// A snapshot starts with the magic bytes "ARGS" and a big-endian uint16 format version. Each entry
+// follows as a tag byte of 1, then the uvarint length and bytes of the key, then the uvarint length
+// and bytes of the data as encoded by a Codec. A tag byte of 0 ends the entries, followed by the
+// uvarint number of entries and a big-endian CRC-32 (IEEE) of every byte before it.
+package snapshot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Version is the format version written by this package.
+const Version uint16 = 1
+
+// maxLength bounds the length of a key or of encoded data, so a corrupt length cannot exhaust memory.
+const maxLength = 1 << 20
+
+const (
+	tagEnd   byte = 0
+	tagEntry byte = 1
+)
+
+//nolint:gochecknoglobals // constant byte sequence, a slice can't be declared const
+var magic = []byte("ARGS")
+
+// ErrNoCodec is returned by engines asked to snapshot or restore without a Codec.
+var ErrNoCodec = errors.New("snapshot: no codec configured")
+
+// ErrFormat is returned when the input is not a snapshot or is truncated.
+var ErrFormat = errors.New("snapshot: invalid format")
+
+// ErrVersion is returned when the snapshot was written in a format version this package can't read.
+var ErrVersion = errors.New("snapshot: unsupported version")
+
+// ErrChecksum is returned when the snapshot does not match its checksum.
+var ErrChecksum = errors.New("snapshot: checksum mismatch")
+
+// Codec converts the data stored under a key to and from bytes.
+type Codec[D any] interface {
+	Encode(data D) ([]byte, error)
+	Decode(b []byte) (D, error)
+}
+
+// Entry is a single key and its data.
+type Entry[D any] struct {
+	Key  string
+	Data D
+}
+
+// Writer writes a snapshot. Close must be called to complete it.
+type Writer[D any] struct {
+	w       *bufio.Writer
+	codec   Codec[D]
+	crc     hash.Hash32
+	entries uint64
+	buffer  []byte
+}
+
+// NewWriter writes the snapshot header to w and returns a Writer for the entries.
+func NewWriter[D any](w io.Writer, codec Codec[D]) (*Writer[D], error) {
+	if codec == nil {
+		return nil, ErrNoCodec
+	}
+
+	sw := &Writer[D]{
+		w:      bufio.NewWriter(w),
+		codec:  codec,
+		crc:    crc32.NewIEEE(),
+		buffer: make([]byte, 0, binary.MaxVarintLen64),
+	}
+
+	header := binary.BigEndian.AppendUint16(append([]byte{}, magic...), Version)
+	if err := sw.write(header); err != nil {
+		return nil, err
+	}
+
+	return sw, nil
+}
+
+// Write appends an entry to the snapshot.
+func (sw *Writer[D]) Write(key string, data D) error {
+	encoded, err := sw.codec.Encode(data)
+	if err != nil {
+		return fmt.Errorf("snapshot: encoding %q: %w", key, err)
+	}
+
+	if len(key) > maxLength || len(encoded) > maxLength {
+		return fmt.Errorf("snapshot: entry of %d and %d bytes exceeds %d bytes", len(key), len(encoded), maxLength)
+	}
+
+	if err = sw.write([]byte{tagEntry}); err != nil {
+		return err
+	}
+	if err = sw.writeBytes([]byte(key)); err != nil {
+		return err
+	}
+	if err = sw.writeBytes(encoded); err != nil {
+		return err
+	}
+
+	sw.entries++
+	return nil
+}
+
+// Close writes the trailer and flushes the snapshot. It does not close the underlying writer.
+func (sw *Writer[D]) Close() error {
+	if err := sw.write([]byte{tagEnd}); err != nil {
+		return err
+	}
+	if err := sw.write(binary.AppendUvarint(sw.buffer[:0], sw.entries)); err != nil {
+		return err
+	}
+
+	// The checksum itself is not part of the checksum
+	if _, err := sw.w.Write(binary.BigEndian.AppendUint32(sw.buffer[:0], sw.crc.Sum32())); err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+
+	if err := sw.w.Flush(); err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	return nil
+}
+
+// writeBytes writes b prefixed with its length.
+func (sw *Writer[D]) writeBytes(b []byte) error {
+	if err := sw.write(binary.AppendUvarint(sw.buffer[:0], uint64(len(b)))); err != nil {
+		return err
+	}
+	return sw.write(b)
+}
+
+func (sw *Writer[D]) write(b []byte) error {
+	sw.crc.Write(b)
+	if _, err := sw.w.Write(b); err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	return nil
+}
+
+// ReadAll reads and verifies a whole snapshot and returns its entries in the order they were
+// written. Nothing is returned unless the snapshot is complete and matches its checksum.
+func ReadAll[D any](r io.Reader, codec Codec[D]) ([]Entry[D], error) {
+	if codec == nil {
+		return nil, ErrNoCodec
+	}
+
+	crc := crc32.NewIEEE()
+	br := bufio.NewReader(r)
+	tr := &teeByteReader{r: br, crc: crc}
+
+	header := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(tr, header); err != nil {
+		return nil, fmt.Errorf("%w: reading header: %w", ErrFormat, err)
+	}
+
+	if string(header[:len(magic)]) != string(magic) {
+		return nil, fmt.Errorf("%w: bad magic bytes", ErrFormat)
+	}
+
+	if version := binary.BigEndian.Uint16(header[len(magic):]); version != Version {
+		return nil, fmt.Errorf("%w: %d", ErrVersion, version)
+	}
+
+	// Nothing is decoded until the checksum has been verified
+	raw := []Entry[[]byte]{}
+	for {
+		tag, err := tr.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading entry: %w", ErrFormat, err)
+		}
+
+		if tag == tagEnd {
+			break
+		}
+		if tag != tagEntry {
+			return nil, fmt.Errorf("%w: unknown tag %d", ErrFormat, tag)
+		}
+
+		key, err := readBytes(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded, err := readBytes(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		raw = append(raw, Entry[[]byte]{Key: string(key), Data: encoded})
+	}
+
+	count, err := binary.ReadUvarint(tr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading entry count: %w", ErrFormat, err)
+	}
+
+	sum := crc.Sum32()
+
+	checksum := make([]byte, 4)
+	if _, err = io.ReadFull(br, checksum); err != nil {
+		return nil, fmt.Errorf("%w: reading checksum: %w", ErrFormat, err)
+	}
+
+	if binary.BigEndian.Uint32(checksum) != sum {
+		return nil, ErrChecksum
+	}
+
+	if count != uint64(len(raw)) {
+		return nil, fmt.Errorf("%w: expected %d entries, read %d", ErrFormat, count, len(raw))
+	}
+
+	entries := make([]Entry[D], 0, len(raw))
+	for _, entry := range raw {
+		data, err := codec.Decode(entry.Data)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot: decoding %q: %w", entry.Key, err)
+		}
+
+		entries = append(entries, Entry[D]{Key: entry.Key, Data: data})
+	}
+
+	return entries, nil
+}
+
+// readBytes reads a length-prefixed byte slice.
+func readBytes(r *teeByteReader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading length: %w", ErrFormat, err)
+	}
+
+	if length > maxLength {
+		return nil, fmt.Errorf("%w: length %d exceeds %d bytes", ErrFormat, length, maxLength)
+	}
+
+	b := make([]byte, length)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFormat, err)
+	}
+
+	return b, nil
+}
+
+// teeByteReader feeds every byte it reads into a checksum.
+type teeByteReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (t *teeByteReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.crc.Write(p[:n])
+	return n, err
+}
+
+func (t *teeByteReader) ReadByte() (byte, error) {
+	b, err := t.r.ReadByte()
+	if err == nil {
+		t.crc.Write([]byte{b})
+	}
+	return b, err
+}
@@ -0,0 +1,88 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/dominicfollett/argus-db/database/snapshot"
+)
+
+type intCodec struct{}
+
+func (intCodec) Encode(data int) ([]byte, error) { return []byte(strconv.Itoa(data)), nil }
+
+func (intCodec) Decode(b []byte) (int, error) { return strconv.Atoi(string(b)) }
+
+func write(t *testing.T, entries []snapshot.Entry[int]) []byte {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	w, err := snapshot.NewWriter[int](&buffer, intCodec{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, entry := range entries {
+		if err = w.Write(entry.Key, entry.Data); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	return buffer.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	entries := []snapshot.Entry[int]{{Key: "a", Data: 1}, {Key: "", Data: 22}, {Key: "tenant:ü", Data: -3}}
+
+	read, err := snapshot.ReadAll[int](bytes.NewReader(write(t, entries)), intCodec{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(read) != len(entries) {
+		t.Fatalf("Expected %d entries, got %d", len(entries), len(read))
+	}
+	for i := range entries {
+		if read[i] != entries[i] {
+			t.Errorf("Expected %+v, got %+v", entries[i], read[i])
+		}
+	}
+
+	if _, err = snapshot.ReadAll[int](bytes.NewReader(write(t, nil)), intCodec{}); err != nil {
+		t.Errorf("Unexpected error reading an empty snapshot: %v", err)
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	valid := write(t, []snapshot.Entry[int]{{Key: "a", Data: 1}, {Key: "b", Data: 2}})
+
+	tests := []struct {
+		name     string
+		snapshot func() []byte
+		err      error
+	}{
+		{"magic", func() []byte { b := bytes.Clone(valid); b[0] = 'X'; return b }, snapshot.ErrFormat},
+		{"version", func() []byte { b := bytes.Clone(valid); b[5] = 9; return b }, snapshot.ErrVersion},
+		{"flipped bit", func() []byte { b := bytes.Clone(valid); b[10] ^= 1; return b }, snapshot.ErrChecksum},
+		{"truncated", func() []byte { return valid[:len(valid)-1] }, snapshot.ErrFormat},
+		{"empty", func() []byte { return nil }, snapshot.ErrFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := snapshot.ReadAll[int](bytes.NewReader(tt.snapshot()), intCodec{}); !errors.Is(err, tt.err) {
+				t.Errorf("Expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	if _, err := snapshot.NewWriter[int](&bytes.Buffer{}, nil); !errors.Is(err, snapshot.ErrNoCodec) {
+		t.Errorf("Expected ErrNoCodec, got %v", err)
+	}
+}
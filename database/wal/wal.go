@@ -0,0 +1,704 @@
+// Package wal provides an append-only write-ahead log of the changes committed to a database engine,
+// so that bucket state survives a crash between snapshots.
+//
+// A log lives in a directory holding a snapshot, written in the format of the snapshot package, and
+// numbered segment files. Every Append is written to the newest segment as a single frame: the
+// big-endian uint32 length and CRC-32 (IEEE) of the payload, followed by the payload itself. The
+// payload is the uvarint number of records, then for each record a kind byte, the uvarint length
+// and bytes of the key and, unless the record is a deletion, the uvarint length and bytes of the
+// encoded data. A frame that is cut short or fails its checksum marks a torn write and ends the
+// segment, so an Append is either replayed whole or not at all.
+//
+// Compaction starts a new segment, writes a snapshot of the database and removes the older
+// segments. Replay restores the snapshot and applies the segments on top of it in order.
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dominicfollett/argus-db/database/snapshot"
+)
+
+// DefaultSyncInterval is how often the log is synced to disk under SyncInterval when no interval is
+// configured.
+const DefaultSyncInterval = 100 * time.Millisecond
+
+const (
+	snapshotName  = "snapshot"
+	segmentPrefix = "wal-"
+	segmentSuffix = ".log"
+
+	// headerSize is the size of a frame's length and checksum.
+	headerSize = 8
+	// maxFrameSize bounds the payload of a frame, so a corrupt length cannot exhaust memory.
+	maxFrameSize = 64 << 20
+	// maxBatch bounds the number of appends written and synced together.
+	maxBatch = 1024
+
+	kindPut    byte = 0
+	kindDelete byte = 1
+)
+
+// ErrClosed is returned by Append and Compact once the log has been closed.
+var ErrClosed = errors.New("wal: log is closed")
+
+// SyncPolicy decides when appended records are synced to disk.
+type SyncPolicy int
+
+const (
+	// SyncInterval syncs the log periodically. A crash loses at most the last interval of changes.
+	SyncInterval SyncPolicy = iota
+	// SyncAlways syncs every append before it returns. Concurrent appends share a sync.
+	SyncAlways
+	// SyncNever leaves syncing to the operating system. A process crash loses nothing, but a
+	// machine crash may.
+	SyncNever
+)
+
+// ParseSyncPolicy parses "always", "interval" or "never".
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return SyncInterval, fmt.Errorf("wal: unknown sync policy %q", s)
+	}
+}
+
+// Record is a single committed change: the new data stored under a key, or its deletion.
+type Record[D any] struct {
+	Key     string
+	Data    D
+	Deleted bool
+}
+
+// Journal receives the changes committed by a database engine. Engines call Append while the keys
+// involved are still locked, so the records of a key are appended in the order they were committed.
+// The records of a single call must be persisted together or not at all. If Append fails the
+// engine must not commit the changes.
+type Journal[D any] interface {
+	Append(records ...Record[D]) error
+}
+
+// config holds the optional Log settings.
+type config struct {
+	sync         SyncPolicy
+	syncInterval time.Duration
+}
+
+// Option configures optional Log settings.
+type Option func(c *config)
+
+// WithSync sets the sync policy. The default is SyncInterval.
+func WithSync(policy SyncPolicy) Option {
+	return func(c *config) {
+		c.sync = policy
+	}
+}
+
+// WithSyncInterval sets how often the log is synced under SyncInterval. Non-positive values are
+// ignored.
+func WithSyncInterval(interval time.Duration) Option {
+	return func(c *config) {
+		if interval > 0 {
+			c.syncInterval = interval
+		}
+	}
+}
+
+// request is an encoded frame waiting to be written, and where to report the outcome.
+type request struct {
+	frame []byte
+	done  chan error
+}
+
+// Log is a write-ahead log. It implements Journal.
+type Log[D any] struct {
+	dir          string
+	codec        snapshot.Codec[D]
+	sync         SyncPolicy
+	syncInterval time.Duration
+	requests     chan request
+	closeLock    sync.RWMutex // closeLock guards closed, and requests against being closed mid-send.
+	closed       bool
+	fileLock     sync.Mutex // fileLock guards file, segment and dirty. file is nil once the log is closed.
+	file         *os.File
+	segment      uint64
+	dirty        bool
+	compactLock  sync.Mutex
+	wg           sync.WaitGroup
+	logger       *slog.Logger
+}
+
+// Open opens the log in dir, creating the directory if need be, and starts a new segment for
+// appends. Replay should be called before the first Append to load what the log already holds.
+func Open[D any](dir string, codec snapshot.Codec[D], logger *slog.Logger, opts ...Option) (*Log[D], error) {
+	if codec == nil {
+		return nil, snapshot.ErrNoCodec
+	}
+
+	c := &config{
+		sync:         SyncInterval,
+		syncInterval: DefaultSyncInterval,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("wal: %w", err)
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	next := uint64(1)
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+
+	file, err := createSegment(dir, next)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log[D]{
+		dir:          dir,
+		codec:        codec,
+		sync:         c.sync,
+		syncInterval: c.syncInterval,
+		requests:     make(chan request, maxBatch),
+		file:         file,
+		segment:      next,
+		logger:       logger,
+	}
+
+	l.wg.Add(1)
+	go l.run()
+
+	return l, nil
+}
+
+// run writes the frames waiting to be written, a batch at a time.
+func (l *Log[D]) run() {
+	defer l.wg.Done()
+
+	var tick <-chan time.Time
+	if l.sync == SyncInterval {
+		ticker := time.NewTicker(l.syncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case req, ok := <-l.requests:
+			if !ok {
+				return
+			}
+
+			// Group commit: whatever else is already waiting shares the write and the sync
+			batch := []request{req}
+		drain:
+			for len(batch) < maxBatch {
+				select {
+				case req, ok := <-l.requests:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, req)
+				default:
+					break drain
+				}
+			}
+
+			err := l.write(batch)
+			for _, req := range batch {
+				req.done <- err
+			}
+		case <-tick:
+			if err := l.flush(); err != nil {
+				l.logger.Error("wal: could not sync log", "error", err)
+			}
+		}
+	}
+}
+
+// write appends the frames of the batch to the current segment with a single write.
+func (l *Log[D]) write(batch []request) error {
+	var buffer bytes.Buffer
+	for _, req := range batch {
+		buffer.Write(req.frame)
+	}
+
+	l.fileLock.Lock()
+	defer l.fileLock.Unlock()
+
+	if _, err := l.file.Write(buffer.Bytes()); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+
+	if l.sync != SyncAlways {
+		l.dirty = true
+		return nil
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	return nil
+}
+
+// flush syncs the current segment if anything was written to it since the last sync.
+func (l *Log[D]) flush() error {
+	l.fileLock.Lock()
+	defer l.fileLock.Unlock()
+
+	if !l.dirty {
+		return nil
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+
+	l.dirty = false
+	return nil
+}
+
+// Append writes the records to the log as a single frame. It returns once they have been written
+// and, under SyncAlways, synced.
+func (l *Log[D]) Append(records ...Record[D]) error {
+	frame, err := l.encode(records)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+
+	l.closeLock.RLock()
+	if l.closed {
+		l.closeLock.RUnlock()
+		return ErrClosed
+	}
+	l.requests <- request{frame: frame, done: done}
+	l.closeLock.RUnlock()
+
+	return <-done
+}
+
+// encode frames the records.
+func (l *Log[D]) encode(records []Record[D]) ([]byte, error) {
+	payload := binary.AppendUvarint(nil, uint64(len(records)))
+
+	for _, record := range records {
+		if record.Deleted {
+			payload = append(payload, kindDelete)
+			payload = appendBytes(payload, []byte(record.Key))
+			continue
+		}
+
+		data, err := l.codec.Encode(record.Data)
+		if err != nil {
+			return nil, fmt.Errorf("wal: encoding %q: %w", record.Key, err)
+		}
+
+		payload = append(payload, kindPut)
+		payload = appendBytes(payload, []byte(record.Key))
+		payload = appendBytes(payload, data)
+	}
+
+	if len(payload) > maxFrameSize {
+		return nil, fmt.Errorf("wal: %d records exceed %d bytes", len(records), maxFrameSize)
+	}
+
+	frame := make([]byte, 0, headerSize+len(payload))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(payload))
+
+	return append(frame, payload...), nil
+}
+
+// decode unpacks the records of a frame's payload.
+func (l *Log[D]) decode(payload []byte) ([]Record[D], error) {
+	r := bytes.NewReader(payload)
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("wal: reading record count: %w", err)
+	}
+
+	records := []Record[D]{}
+	for i := uint64(0); i < count; i++ {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("wal: reading record kind: %w", err)
+		}
+
+		key, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if kind == kindDelete {
+			records = append(records, Record[D]{Key: string(key), Deleted: true})
+			continue
+		}
+
+		encoded, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := l.codec.Decode(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("wal: decoding %q: %w", key, err)
+		}
+
+		records = append(records, Record[D]{Key: string(key), Data: data})
+	}
+
+	return records, nil
+}
+
+// Replay passes restore a snapshot of everything the log holds: its last snapshot with every
+// segment applied on top. Records cut short by a crash are discarded and the segment truncated
+// before them. restore is typically the Restore method of the database being journaled.
+func (l *Log[D]) Replay(restore func(r io.Reader) error) error {
+	state := map[string]D{}
+
+	file, err := os.Open(filepath.Join(l.dir, snapshotName))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("wal: %w", err)
+	default:
+		entries, err := snapshot.ReadAll(file, l.codec)
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			state[entry.Key] = entry.Data
+		}
+	}
+
+	segments, err := listSegments(l.dir)
+	if err != nil {
+		return err
+	}
+
+	l.fileLock.Lock()
+	current := l.segment
+	l.fileLock.Unlock()
+
+	replayed := 0
+	for _, segment := range segments {
+		if segment >= current {
+			break
+		}
+
+		n, err := l.replaySegment(segmentPath(l.dir, segment), state)
+		if err != nil {
+			return err
+		}
+		replayed += n
+	}
+
+	keys := make([]string, 0, len(state))
+	for key := range state {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var buffer bytes.Buffer
+	sw, err := snapshot.NewWriter(&buffer, l.codec)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err = sw.Write(key, state[key]); err != nil {
+			return err
+		}
+	}
+
+	if err = sw.Close(); err != nil {
+		return err
+	}
+
+	l.logger.Info("wal: replayed log", "records", replayed, "keys", len(keys))
+	return restore(&buffer)
+}
+
+// replaySegment applies the records of a segment to state and returns how many there were.
+func (l *Log[D]) replaySegment(path string, state map[string]D) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("wal: %w", err)
+	}
+
+	replayed := 0
+	offset := 0
+	for offset < len(data) {
+		rest := data[offset:]
+		if len(rest) < headerSize {
+			break
+		}
+
+		length := binary.BigEndian.Uint32(rest)
+		if length > maxFrameSize || uint64(len(rest)-headerSize) < uint64(length) {
+			break
+		}
+
+		payload := rest[headerSize : headerSize+int(length)]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(rest[4:]) {
+			break
+		}
+
+		records, err := l.decode(payload)
+		if err != nil {
+			return replayed, fmt.Errorf("%w in %s at offset %d", err, path, offset)
+		}
+
+		for _, record := range records {
+			if record.Deleted {
+				delete(state, record.Key)
+			} else {
+				state[record.Key] = record.Data
+			}
+		}
+
+		replayed += len(records)
+		offset += headerSize + int(length)
+	}
+
+	if offset < len(data) {
+		l.logger.Warn("wal: discarding torn write", "segment", path, "offset", offset, "bytes", len(data)-offset)
+		if err = os.Truncate(path, int64(offset)); err != nil {
+			return replayed, fmt.Errorf("wal: %w", err)
+		}
+	}
+
+	return replayed, nil
+}
+
+// Compact folds the log into a new snapshot written by write, typically the Snapshot method of the
+// database being journaled. The snapshot must include every change appended before Compact was
+// called; changes appended while it runs go to a new segment and are replayed on top of it.
+func (l *Log[D]) Compact(write func(w io.Writer) error) error {
+	l.compactLock.Lock()
+	defer l.compactLock.Unlock()
+
+	segment, err := l.rotate()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(l.dir, snapshotName+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	defer os.Remove(file.Name()) // Fails harmlessly once the file has been renamed
+
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("wal: writing snapshot: %w", err)
+	}
+
+	if err = os.Rename(file.Name(), filepath.Join(l.dir, snapshotName)); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+
+	if err = syncDir(l.dir); err != nil {
+		return err
+	}
+
+	segments, err := listSegments(l.dir)
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, s := range segments {
+		if s >= segment {
+			break
+		}
+		if err = os.Remove(segmentPath(l.dir, s)); err != nil {
+			return fmt.Errorf("wal: %w", err)
+		}
+		removed++
+	}
+
+	l.logger.Debug("wal: compacted log", "removed segments", removed)
+	return nil
+}
+
+// rotate syncs and closes the current segment and starts the next one, whose number it returns.
+func (l *Log[D]) rotate() (uint64, error) {
+	l.fileLock.Lock()
+	defer l.fileLock.Unlock()
+
+	if l.file == nil {
+		return 0, ErrClosed
+	}
+
+	file, err := createSegment(l.dir, l.segment+1)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = l.file.Sync(); err != nil {
+		file.Close()
+		return 0, fmt.Errorf("wal: %w", err)
+	}
+	l.file.Close()
+
+	l.file = file
+	l.segment++
+	l.dirty = false
+
+	return l.segment, nil
+}
+
+// Close stops accepting appends, writes the ones already accepted and syncs and closes the log.
+func (l *Log[D]) Close() error {
+	l.closeLock.Lock()
+	if l.closed {
+		l.closeLock.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.requests)
+	l.closeLock.Unlock()
+
+	l.wg.Wait()
+
+	l.fileLock.Lock()
+	defer l.fileLock.Unlock()
+
+	file := l.file
+	l.file = nil
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("wal: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	return nil
+}
+
+// listSegments returns the numbers of the segments in dir in ascending order.
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("wal: %w", err)
+	}
+
+	segments := []uint64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		n, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, n)
+	}
+
+	slices.Sort(segments)
+	return segments, nil
+}
+
+func segmentPath(dir string, segment uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%020d%s", segmentPrefix, segment, segmentSuffix))
+}
+
+// createSegment creates a new, empty segment for appending.
+func createSegment(dir string, segment uint64) (*os.File, error) {
+	file, err := os.OpenFile(segmentPath(dir, segment), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("wal: %w", err)
+	}
+
+	// Make sure the new segment survives a crash, so segments are never skipped on replay
+	if err = syncDir(dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// syncDir syncs a directory so that the files created in or renamed into it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	defer d.Close()
+
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	return nil
+}
+
+// appendBytes appends b prefixed with its length.
+func appendBytes(buffer []byte, b []byte) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(len(b)))
+	return append(buffer, b...)
+}
+
+// readBytes reads a length-prefixed byte slice.
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("wal: reading length: %w", err)
+	}
+
+	if length > uint64(r.Len()) {
+		return nil, fmt.Errorf("wal: length %d exceeds the %d bytes left", length, r.Len())
+	}
+
+	b := make([]byte, length)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("wal: %w", err)
+	}
+
+	return b, nil
+}
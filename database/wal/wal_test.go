@@ -0,0 +1,238 @@
+//nolint:testpackage // Allow tests to access the wal package
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/dominicfollett/argus-db/database/snapshot"
+)
+
+type intCodec struct{}
+
+func (intCodec) Encode(data int) ([]byte, error) { return []byte(strconv.Itoa(data)), nil }
+
+func (intCodec) Decode(b []byte) (int, error) { return strconv.Atoi(string(b)) }
+
+func openLog(t *testing.T, dir string, opts ...Option) *Log[int] {
+	t.Helper()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	l, err := Open[int](dir, intCodec{}, logger, opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return l
+}
+
+// replay opens the log in dir and returns what it holds.
+func replay(t *testing.T, dir string) map[string]int {
+	t.Helper()
+
+	l := openLog(t, dir)
+	defer l.Close()
+
+	state := map[string]int{}
+	err := l.Replay(func(r io.Reader) error {
+		entries, err := snapshot.ReadAll[int](r, intCodec{})
+		for _, entry := range entries {
+			state[entry.Key] = entry.Data
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	return state
+}
+
+func equal(a map[string]int, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	l := openLog(t, dir, WithSync(SyncAlways))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := l.Append(Record[int]{Key: "key" + strconv.Itoa(i), Data: i}); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	records := []Record[int]{{Key: "a", Data: 1}, {Key: "b", Data: 2}, {Key: "key0", Deleted: true}}
+	if err := l.Append(records...); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := l.Append(Record[int]{Key: "late"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+
+	state := replay(t, dir)
+	if len(state) != 51 || state["a"] != 1 || state["key49"] != 49 {
+		t.Errorf("Expected 51 keys, got %d: %v", len(state), state)
+	}
+	if _, ok := state["key0"]; ok {
+		t.Error("Expected key0 to stay deleted")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	l := openLog(t, dir)
+	for i := 0; i < 3; i++ {
+		if err := l.Append(Record[int]{Key: "a", Data: i}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// The snapshot stands in for the database, which holds everything appended so far
+	err := l.Compact(func(w io.Writer) error {
+		sw, err := snapshot.NewWriter[int](w, intCodec{})
+		if err != nil {
+			return err
+		}
+		if err = sw.Write("a", 2); err != nil {
+			return err
+		}
+		return sw.Close()
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err = l.Append(Record[int]{Key: "b", Data: 7}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	l.Close()
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(segments) != 1 {
+		t.Errorf("Expected compaction to leave a single segment, got %v", segments)
+	}
+
+	if state := replay(t, dir); !equal(state, map[string]int{"a": 2, "b": 7}) {
+		t.Errorf("Expected a=2 and b=7, got %v", state)
+	}
+}
+
+func TestTornWrites(t *testing.T) {
+	tests := []struct {
+		name string
+		tear func(segment []byte, last int) []byte
+		lost bool // lost reports whether the last record is torn, rather than something after it.
+	}{
+		{"truncated header", func(segment []byte, last int) []byte { return segment[:last+3] }, true},
+		{"truncated record", func(segment []byte, _ int) []byte { return segment[:len(segment)-2] }, true},
+		{"flipped bit", func(segment []byte, _ int) []byte {
+			torn := bytes.Clone(segment)
+			torn[len(torn)-1] ^= 1
+			return torn
+		}, true},
+		{"huge length", func(segment []byte, last int) []byte {
+			torn := bytes.Clone(segment)
+			torn[last] = 0xff
+			return torn
+		}, true},
+		{"garbage tail", func(segment []byte, _ int) []byte {
+			return append(bytes.Clone(segment), 0xff, 0x00, 0x13)
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			l := openLog(t, dir)
+			for _, record := range []Record[int]{{Key: "a", Data: 1}, {Key: "b", Data: 2}} {
+				if err := l.Append(record); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+
+			path := segmentPath(dir, l.segment)
+			before, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if err = l.Append(Record[int]{Key: "c", Data: 3}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			l.Close()
+
+			segment, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			// Tear the last record, as a crash in the middle of writing it would
+			if err = os.WriteFile(path, tt.tear(segment, len(before)), 0o644); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			expected := map[string]int{"a": 1, "b": 2}
+			intact := len(segment)
+			if tt.lost {
+				intact = len(before)
+			} else {
+				expected["c"] = 3
+			}
+
+			if state := replay(t, dir); !equal(state, expected) {
+				t.Errorf("Expected %v, got %v", expected, state)
+			}
+
+			// The torn record must have been cut off, so the segment replays cleanly from now on
+			segment, err = os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(segment) != intact {
+				t.Errorf("Expected the segment to be truncated to %d bytes, got %d", intact, len(segment))
+			}
+		})
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for input, expected := range map[string]SyncPolicy{"always": SyncAlways, "interval": SyncInterval, "never": SyncNever} {
+		if policy, err := ParseSyncPolicy(input); err != nil || policy != expected {
+			t.Errorf("Expected %s to parse as %d, got %d, %v", input, expected, policy, err)
+		}
+	}
+
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
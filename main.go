@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net"
 	"net/http"
@@ -12,9 +14,17 @@ import (
 	// _ "net/http/pprof".
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/dominicfollett/argus-db/database"
+	"github.com/dominicfollett/argus-db/database/admission"
+	"github.com/dominicfollett/argus-db/database/concurrent"
+	"github.com/dominicfollett/argus-db/database/naive"
+	"github.com/dominicfollett/argus-db/database/wal"
 	"github.com/dominicfollett/argus-db/service"
 )
 
@@ -23,19 +33,43 @@ const ReadTimeout = 500 * time.Millisecond
 const ReadHeaderTimeout = 500 * time.Millisecond
 const IdleTimeout = 2 * time.Second // TODO: tune this.
 
+// Number of keys listed by /api/v1/keys when no limit is given, and the largest limit accepted.
+const DefaultKeysLimit = 100
+const MaxKeysLimit = 1000
+
+// Largest number of limits accepted by /api/v1/limit/batch.
+const MaxBatchSize = 100
+
 // Server Shutdown timeout.
 const ShutdownTimeout = 10 * time.Second
 
 // Keep it simple - we don't need more than this.
 type Config struct {
-	Host     string
-	Port     string
-	LogLevel slog.Level
-	Engine   string
+	Host         string
+	Port         string
+	LogLevel     slog.Level
+	Engine       string
+	SnapshotPath string // SnapshotPath is where state is saved on shutdown and restored from on startup.
+
+	WALDir             string // WALDir enables the write-ahead log, kept in this directory.
+	WALSync            wal.SyncPolicy
+	WALSyncInterval    time.Duration
+	WALCompactInterval time.Duration
+
+	SwapPolicy naive.SwapPolicy // SwapPolicy decides when the naive engine swaps its trees, nil for the default.
+	QueueSize  int              // QueueSize is the number of updates the naive engine queues for its AVL tree.
+	Overflow   naive.OverflowPolicy
+
+	Shards int // Shards is the number of shards of the concurrent engine.
+
+	Limits admission.Limits // Limits bounds the keys held, when MaxKeys or MaxBytes is set.
 }
 
+// DefaultWALCompactInterval is how often the write-ahead log is folded into a snapshot by default.
+const DefaultWALCompactInterval = 1 * time.Minute
+
 // Keep it simple.
-func loadConfig(getenv func(string) string) *Config {
+func loadConfig(getenv func(string) string) (*Config, error) {
 	levelMap := map[string]slog.Level{
 		"debug": slog.LevelDebug,
 		"info":  slog.LevelInfo,
@@ -48,6 +82,15 @@ func loadConfig(getenv func(string) string) *Config {
 		Port:     "8123",
 		LogLevel: slog.LevelInfo,
 		Engine:   "naive",
+
+		WALSync:            wal.SyncInterval,
+		WALSyncInterval:    wal.DefaultSyncInterval,
+		WALCompactInterval: DefaultWALCompactInterval,
+
+		QueueSize: naive.DefaultQueueSize,
+		Overflow:  naive.OverflowBlock,
+
+		Shards: concurrent.DefaultShards,
 	}
 
 	if host := getenv("HOST"); host != "" {
@@ -62,7 +105,81 @@ func loadConfig(getenv func(string) string) *Config {
 		config.LogLevel = levelMap[logLevel]
 	}
 
-	return config
+	if engine := getenv("ENGINE"); engine != "" {
+		config.Engine = engine
+	}
+
+	config.SnapshotPath = getenv("SNAPSHOT_PATH")
+	config.WALDir = getenv("WAL_DIR")
+
+	var err error
+	if policy := getenv("WAL_SYNC"); policy != "" {
+		if config.WALSync, err = wal.ParseSyncPolicy(policy); err != nil {
+			return nil, err
+		}
+	}
+
+	if interval := getenv("WAL_SYNC_INTERVAL"); interval != "" {
+		if config.WALSyncInterval, err = time.ParseDuration(interval); err != nil {
+			return nil, fmt.Errorf("invalid WAL_SYNC_INTERVAL: %w", err)
+		}
+	}
+
+	if interval := getenv("WAL_COMPACT_INTERVAL"); interval != "" {
+		if config.WALCompactInterval, err = time.ParseDuration(interval); err != nil {
+			return nil, fmt.Errorf("invalid WAL_COMPACT_INTERVAL: %w", err)
+		}
+	}
+
+	if policy := getenv("SWAP_POLICY"); policy != "" {
+		if config.SwapPolicy, err = naive.ParseSwapPolicy(policy); err != nil {
+			return nil, fmt.Errorf("invalid SWAP_POLICY: %w", err)
+		}
+	}
+
+	if size := getenv("AVL_QUEUE_SIZE"); size != "" {
+		if config.QueueSize, err = strconv.Atoi(size); err != nil || config.QueueSize < 1 {
+			return nil, fmt.Errorf("invalid AVL_QUEUE_SIZE: %q", size)
+		}
+	}
+
+	if overflow := getenv("AVL_QUEUE_OVERFLOW"); overflow != "" {
+		if config.Overflow, err = naive.ParseOverflowPolicy(overflow); err != nil {
+			return nil, fmt.Errorf("invalid AVL_QUEUE_OVERFLOW: %w", err)
+		}
+	}
+
+	if shards := getenv("SHARDS"); shards != "" {
+		if config.Shards, err = strconv.Atoi(shards); err != nil || config.Shards < 1 {
+			return nil, fmt.Errorf("invalid SHARDS: %q", shards)
+		}
+	}
+
+	if maxKeys := getenv("MAX_KEYS"); maxKeys != "" {
+		if config.Limits.MaxKeys, err = strconv.Atoi(maxKeys); err != nil || config.Limits.MaxKeys < 1 {
+			return nil, fmt.Errorf("invalid MAX_KEYS: %q", maxKeys)
+		}
+	}
+
+	if maxBytes := getenv("MAX_MEMORY_BYTES"); maxBytes != "" {
+		if config.Limits.MaxBytes, err = strconv.ParseInt(maxBytes, 10, 64); err != nil || config.Limits.MaxBytes < 1 {
+			return nil, fmt.Errorf("invalid MAX_MEMORY_BYTES: %q", maxBytes)
+		}
+	}
+
+	if policy := getenv("EVICTION_POLICY"); policy != "" {
+		if config.Limits.Policy, err = admission.ParsePolicy(policy); err != nil {
+			return nil, fmt.Errorf("invalid EVICTION_POLICY: %w", err)
+		}
+	}
+
+	if fallback := getenv("ADMISSION_FALLBACK"); fallback != "" {
+		if config.Limits.Fallback, err = admission.ParseFallback(fallback); err != nil {
+			return nil, fmt.Errorf("invalid ADMISSION_FALLBACK: %w", err)
+		}
+	}
+
+	return config, nil
 }
 
 func healthHandler(logger *slog.Logger) http.Handler {
@@ -83,10 +200,44 @@ func healthHandler(logger *slog.Logger) http.Handler {
 }
 
 type limitArgs struct {
-	Key      string `json:"key"`
-	Capacity int64  `json:"capacity"`
-	Interval int32  `json:"interval"`
-	Unit     string `json:"unit"`
+	Key        string `json:"key"`
+	Algorithm  string `json:"algorithm"` // Algorithm is "token_bucket" (the default), "sliding_log", "sliding_window", "gcra" or "leaky_bucket".
+	Capacity   int64  `json:"capacity"`
+	Interval   int32  `json:"interval"`
+	Unit       string `json:"unit"`
+	Burst      int64  `json:"burst"`       // Burst is the number of requests a GCRA allows at once, capacity if unset.
+	QueueDepth int64  `json:"queue_depth"` // QueueDepth is the number of requests a leaky bucket queues, capacity if unset.
+	Cost       int64  `json:"cost"`        // Cost is the number of tokens the request consumes, 1 if unset.
+}
+
+// limitResponse is the response to a leaky bucket, which tells allowed clients how long to wait.
+type limitResponse struct {
+	Result  string `json:"result"`
+	DelayMs int64  `json:"delay_ms"`
+}
+
+// request converts the arguments to a service request. If the algorithm is unknown it writes a 400
+// response and returns false.
+func (args limitArgs) request(logger *slog.Logger, w http.ResponseWriter) (service.Request, bool) {
+	algorithm, err := service.ParseAlgorithm(args.Algorithm)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		if _, err = w.Write([]byte(err.Error())); err != nil {
+			logger.Error("[limitArgs] error writing response", "error", err)
+		}
+		return service.Request{}, false
+	}
+
+	return service.Request{
+		Key:        args.Key,
+		Algorithm:  algorithm,
+		Capacity:   args.Capacity,
+		Interval:   args.Interval,
+		Unit:       args.Unit,
+		Burst:      args.Burst,
+		QueueDepth: args.QueueDepth,
+		Cost:       args.Cost,
+	}, true
 }
 
 func limitHandler(logger *slog.Logger, s *service.Service) http.Handler {
@@ -104,53 +255,375 @@ func limitHandler(logger *slog.Logger, s *service.Service) http.Handler {
 
 				// TODO: consider using a pool of buffers with custom decoding, or easyjson or protobuf
 				// Ideas: https://github.com/goccy/go-json
-				// start := time.Now()
 				var args limitArgs
+				if !decodeBody(logger, w, r, &args) {
+					return
+				}
 
-				buffer, err := io.ReadAll(r.Body)
-				if err != nil {
-					logger.Error("error reading request body", "error", err)
-					w.WriteHeader(http.StatusBadRequest)
+				request, ok := args.request(logger, w)
+				if !ok {
+					return
+				}
 
-					_, err = w.Write([]byte("error reading request body"))
-					if err != nil {
-						logger.Error("[limitHandler] error writing response", "error", err)
-					}
+				// Call the service layer
+				decision, err := s.Limit(r.Context(), request)
+				if err != nil {
+					writeServiceError(logger, w, err)
 					return
 				}
 
-				if err = json.Unmarshal(buffer, &args); err != nil {
-					logger.Error("error decoding request body", "error", err)
-					w.WriteHeader(http.StatusBadRequest)
+				// Tell limited clients when to come back, if the algorithm knows
+				if decision.RetryAfter > 0 {
+					seconds := (decision.RetryAfter + time.Second - 1) / time.Second
+					w.Header().Set("Retry-After", strconv.FormatInt(int64(seconds), 10))
+					w.Header().Set("Retry-After-Ms", strconv.FormatInt(ceilMilliseconds(decision.RetryAfter), 10))
+				}
 
-					_, err = w.Write([]byte("error decoding request body"))
+				// A leaky bucket's result comes with the delay, so clients can sleep rather than retry
+				body := []byte(decision.Result)
+				if request.Algorithm == service.LeakyBucket {
+					body, err = json.Marshal(limitResponse{Result: decision.Result, DelayMs: ceilMilliseconds(decision.Delay)})
 					if err != nil {
-						logger.Error("[limitHandler] error writing response", "error", err)
+						logger.Error("error encoding response body", "error", err)
+						w.WriteHeader(http.StatusInternalServerError)
+						return
 					}
-					return
+					w.Header().Set("Content-Type", "application/json")
 				}
-				// duration := time.Since(start)
-				// logger.Info("json.Unmarshal", "duration", duration)
 
-				// Call the service layer
-				result, err := s.Limit(r.Context(), args.Key, args.Capacity, args.Interval, args.Unit)
+				// Write the result
+				w.WriteHeader(http.StatusOK)
+				_, err = w.Write(body)
 				if err != nil {
-					if err.Error() == "request canceled" {
-						logger.Info("request canceled")
-						return
-					}
+					logger.Error("[limitHandler] error writing response", "error", err)
+				}
+			}
+		},
+	)
+}
+
+// ceilMilliseconds returns d in whole milliseconds, rounded up so that clients never come back early.
+func ceilMilliseconds(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// decodeBody reads the JSON request body into v. If that fails it writes a 400 response and
+// returns false.
+func decodeBody(logger *slog.Logger, w http.ResponseWriter, r *http.Request, v any) bool {
+	buffer, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Error("error reading request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+
+		_, err = w.Write([]byte("error reading request body"))
+		if err != nil {
+			logger.Error("[decodeBody] error writing response", "error", err)
+		}
+		return false
+	}
+
+	if err = json.Unmarshal(buffer, v); err != nil {
+		logger.Error("error decoding request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+
+		_, err = w.Write([]byte("error decoding request body"))
+		if err != nil {
+			logger.Error("[decodeBody] error writing response", "error", err)
+		}
+		return false
+	}
+
+	return true
+}
+
+// writeServiceError maps an error from the service layer to a response: a 503 if the request ran
+// out of time, nothing if the client went away, a 400 for an invalid request, cost or refund and a
+// 500 otherwise.
+func writeServiceError(logger *slog.Logger, w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, context.Canceled):
+		logger.Info("request canceled")
+	case errors.Is(err, service.ErrInvalidRequest), errors.Is(err, service.ErrInvalidCost),
+		errors.Is(err, service.ErrInvalidRefund):
+		w.WriteHeader(http.StatusBadRequest)
+		if _, err = w.Write([]byte(err.Error())); err != nil {
+			logger.Error("[writeServiceError] error writing response", "error", err)
+		}
+	default:
+		logger.Error("error calling limiter service", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+type refundArgs struct {
+	Key       string `json:"key"`
+	Tokens    int64  `json:"tokens"`     // Tokens is the number of tokens to give back, 1 if unset.
+	RequestID string `json:"request_id"` // RequestID makes retries of the refund harmless, if set.
+}
+
+// refundHandler gives tokens back to a key, and responds with its status as the key handler does.
+func refundHandler(logger *slog.Logger, s *service.Service) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+
+			var args refundArgs
+			if !decodeBody(logger, w, r, &args) {
+				return
+			}
+
+			if args.Tokens == 0 {
+				args.Tokens = 1
+			}
+
+			refunded, err := s.Refund(r.Context(), args.Key, args.Tokens, args.RequestID)
+			if err != nil {
+				writeServiceError(logger, w, err)
+				return
+			}
+
+			if !refunded {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			writeStatus(w, logger, s, args.Key)
+		},
+	)
+}
+
+type batchArgs struct {
+	Limits       []limitArgs `json:"limits"`
+	AllOrNothing bool        `json:"all_or_nothing"`
+}
+
+type batchResult struct {
+	Key    string `json:"key"`
+	Result string `json:"result"`
+}
+
+type batchResponse struct {
+	Result  string        `json:"result"`
+	Results []batchResult `json:"results"`
+}
+
+// batchHandler checks several rate limits in one request. The overall result is only "OK" if every
+// limit allows the request. With all_or_nothing set, tokens are only consumed in that case.
+func batchHandler(logger *slog.Logger, s *service.Service) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
 
-					logger.Error("error calling limiter service: %v", err)
+			var args batchArgs
+			if !decodeBody(logger, w, r, &args) {
+				return
+			}
+
+			if len(args.Limits) == 0 || len(args.Limits) > MaxBatchSize {
+				w.WriteHeader(http.StatusBadRequest)
+				_, err := fmt.Fprintf(w, "a batch must hold between 1 and %d limits", MaxBatchSize)
+				if err != nil {
+					logger.Error("[batchHandler] error writing response", "error", err)
+				}
+				return
+			}
+
+			requests := make([]service.Request, 0, len(args.Limits))
+			for _, limit := range args.Limits {
+				request, ok := limit.request(logger, w)
+				if !ok {
+					return
+				}
+				requests = append(requests, request)
+			}
+
+			results, verdict, err := s.LimitMany(r.Context(), requests, args.AllOrNothing)
+			if err != nil {
+				writeServiceError(logger, w, err)
+				return
+			}
+
+			response := batchResponse{Result: verdict, Results: make([]batchResult, 0, len(results))}
+			for i, result := range results {
+				response.Results = append(response.Results, batchResult{Key: requests[i].Key, Result: result})
+			}
+
+			buffer, err := json.Marshal(response)
+			if err != nil {
+				logger.Error("error encoding response body", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			_, err = w.Write(buffer)
+			if err != nil {
+				logger.Error("[batchHandler] error writing response", "error", err)
+			}
+		},
+	)
+}
+
+type statusResponse struct {
+	Key             string    `json:"key"`
+	Algorithm       string    `json:"algorithm"`
+	AvailableTokens int64     `json:"available_tokens"`
+	Capacity        int64     `json:"capacity"`
+	ResetsAt        time.Time `json:"resets_at"`
+}
+
+func newStatusResponse(status *service.Status) statusResponse {
+	return statusResponse{
+		Key:             status.Key,
+		Algorithm:       status.Algorithm.String(),
+		AvailableTokens: status.AvailableTokens,
+		Capacity:        status.Capacity,
+		ResetsAt:        status.ResetsAt,
+	}
+}
+
+// limitKeyHandler serves requests addressed to a single key: /api/v1/limit/{key}. A POST to
+// /api/v1/limit/{action} is served by the action's handler instead, so that a key named after an
+// action can still be read and reset.
+func limitKeyHandler(logger *slog.Logger, s *service.Service, actions map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			key := strings.TrimPrefix(r.URL.Path, "/api/v1/limit/")
+			if key == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			switch action, ok := actions[key]; {
+			case ok && r.Method == http.MethodPost:
+				action.ServeHTTP(w, r)
+			case r.Method == http.MethodGet:
+				writeStatus(w, logger, s, key)
+			case r.Method == http.MethodDelete:
+				deleted, err := s.Reset(key)
+				if err != nil {
+					logger.Error("error calling limiter service", "error", err)
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
 
-				// Write the result
-				w.WriteHeader(http.StatusOK)
-				_, err = w.Write([]byte(result))
+				if !deleted {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		},
+	)
+}
+
+// writeStatus writes the JSON status of the key's bucket.
+func writeStatus(w http.ResponseWriter, logger *slog.Logger, s *service.Service, key string) {
+	status, ok, err := s.Status(key)
+	if err != nil {
+		logger.Error("error calling limiter service", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	buffer, err := json.Marshal(newStatusResponse(status))
+	if err != nil {
+		logger.Error("error encoding response body", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(buffer)
+	if err != nil {
+		logger.Error("[limitKeyHandler] error writing response", "error", err)
+	}
+}
+
+// keysHandler lists keys in ascending order, either those starting with the prefix query parameter
+// or those in the range [start, end).
+func keysHandler(logger *slog.Logger, s *service.Service) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+
+			query := r.URL.Query()
+			prefix, start, end := query.Get("prefix"), query.Get("start"), query.Get("end")
+
+			limit := DefaultKeysLimit
+			if value := query.Get("limit"); value != "" {
+				var err error
+				if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > MaxKeysLimit {
+					w.WriteHeader(http.StatusBadRequest)
+					_, err = fmt.Fprintf(w, "limit must be between 1 and %d", MaxKeysLimit)
+					if err != nil {
+						logger.Error("[keysHandler] error writing response", "error", err)
+					}
+					return
+				}
+			}
+
+			if prefix != "" && (start != "" || end != "") {
+				w.WriteHeader(http.StatusBadRequest)
+				_, err := w.Write([]byte("prefix cannot be combined with start or end"))
 				if err != nil {
-					logger.Error("[limitHandler] error writing response", "error", err)
+					logger.Error("[keysHandler] error writing response", "error", err)
 				}
+				return
+			}
+
+			var statuses []*service.Status
+			var err error
+			if prefix != "" {
+				statuses, err = s.Keys(r.Context(), prefix, limit)
+			} else {
+				statuses, err = s.KeysInRange(r.Context(), start, end, limit)
+			}
+
+			if err != nil {
+				logger.Error("error calling limiter service", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			response := make([]statusResponse, 0, len(statuses))
+			for _, status := range statuses {
+				response = append(response, newStatusResponse(status))
+			}
+
+			buffer, err := json.Marshal(response)
+			if err != nil {
+				logger.Error("error encoding response body", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			_, err = w.Write(buffer)
+			if err != nil {
+				logger.Error("[keysHandler] error writing response", "error", err)
 			}
 		},
 	)
@@ -173,18 +646,113 @@ func NewServer(logger *slog.Logger, s *service.Service) http.Handler {
 
 	mux.Handle("/api/v1/health", loggingMiddleware(logger, healthHandler(logger)))
 	mux.Handle("/api/v1/limit", limitHandler(logger, s))
+	mux.Handle("/api/v1/limit/", limitKeyHandler(logger, s, map[string]http.Handler{
+		"batch":  batchHandler(logger, s),
+		"refund": refundHandler(logger, s),
+	}))
+	mux.Handle("/api/v1/keys", keysHandler(logger, s))
 
 	return mux
 }
 
-func run(ctx context.Context, getenv func(string) string, stdout io.Writer) {
+// restoreSnapshot restores the service's state from the snapshot at path, if there is one. A snapshot
+// that can't be restored is logged and skipped, so the service starts with empty buckets rather than
+// not at all.
+func restoreSnapshot(logger *slog.Logger, s *service.Service, path string) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		logger.Info("no snapshot to restore", "path", path)
+		return
+	}
+	if err != nil {
+		logger.Error("could not open snapshot", "path", path, "error", err)
+		return
+	}
+	defer file.Close()
+
+	if err = s.Restore(file); err != nil {
+		logger.Error("could not restore snapshot, starting empty", "path", path, "error", err)
+		return
+	}
+
+	logger.Info("restored snapshot", "path", path)
+}
+
+// saveSnapshot writes the service's state to path. The snapshot is written to a temporary file in the
+// same directory first and then renamed, so a failed write never replaces a good snapshot.
+func saveSnapshot(logger *slog.Logger, s *service.Service, path string) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		logger.Error("could not create snapshot", "path", path, "error", err)
+		return
+	}
+	defer os.Remove(file.Name()) // Fails harmlessly once the file has been renamed
+
+	err = s.Snapshot(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+
+	if err != nil {
+		logger.Error("could not save snapshot", "path", path, "error", err)
+		return
+	}
+
+	logger.Info("saved snapshot", "path", path)
+}
+
+func run(ctx context.Context, getenv func(string) string, stdout io.Writer) error {
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
 	defer cancel()
 
-	config := loadConfig(getenv)
+	config, err := loadConfig(getenv)
+	if err != nil {
+		return err
+	}
 
 	logger := slog.New(slog.NewJSONHandler(stdout, &slog.HandlerOptions{Level: config.LogLevel}))
-	s := service.NewLimiterService(config.Engine, logger)
+
+	opts := []service.Option{}
+	if config.WALDir != "" {
+		opts = append(opts, service.WithWAL(
+			config.WALDir,
+			config.WALCompactInterval,
+			wal.WithSync(config.WALSync),
+			wal.WithSyncInterval(config.WALSyncInterval),
+		))
+	}
+
+	naiveOpts := []naive.Option{naive.WithQueue(config.QueueSize, config.Overflow)}
+	if config.SwapPolicy != nil {
+		naiveOpts = append(naiveOpts, naive.WithSwapPolicy(config.SwapPolicy))
+	}
+	opts = append(opts, service.WithEngineOptions(database.WithNaiveOptions(naiveOpts...)))
+	opts = append(opts, service.WithEngineOptions(database.WithConcurrentOptions(concurrent.WithShards(config.Shards))))
+
+	if config.Limits.MaxKeys > 0 || config.Limits.MaxBytes > 0 {
+		opts = append(opts, service.WithEngineOptions(database.WithLimits(config.Limits)))
+	}
+
+	s, err := service.NewLimiterService(config.Engine, logger, opts...)
+	if err != nil {
+		logger.Error("could not create rate limiter service", "engine", config.Engine, "error", err)
+		return err
+	}
+
+	// The write-ahead log keeps its own snapshots, and restoring another would undo its replay
+	switch {
+	case config.SnapshotPath != "" && config.WALDir != "":
+		logger.Info("write-ahead log enabled, not restoring snapshot", "path", config.SnapshotPath)
+	case config.SnapshotPath != "":
+		restoreSnapshot(logger, s, config.SnapshotPath)
+	}
+
 	server := NewServer(logger, s)
 
 	// Take note of the timeouts: this makes the server more robust and less susceptible to attacks
@@ -228,19 +796,22 @@ func run(ctx context.Context, getenv func(string) string, stdout io.Writer) {
 			logger.Error("error shutting down http server", "error", err)
 		}
 
+		if config.SnapshotPath != "" {
+			saveSnapshot(logger, s, config.SnapshotPath)
+		}
+
 		logger.Info("shutting down rate limiter service")
 		s.Shutdown()
 	}()
 	wg.Wait()
+
+	return nil
 }
 
 func main() {
 	ctx := context.Background()
-	run(ctx, os.Getenv, os.Stdout)
-
-	// And this?
-	// if err := run(ctx, os.Getenv, os.Stdout); err != nil {
-	// 	fmt.Fprintf(os.Stderr, "%s\n", err)
-	//	os.Exit(1)
-	// }
+	if err := run(ctx, os.Getenv, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
 }
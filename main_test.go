@@ -4,12 +4,24 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/dominicfollett/argus-db/database"
+	"github.com/dominicfollett/argus-db/database/admission"
+	"github.com/dominicfollett/argus-db/database/naive"
+	"github.com/dominicfollett/argus-db/database/wal"
+	"github.com/dominicfollett/argus-db/service"
 )
 
 func TestService(t *testing.T) {
@@ -34,7 +46,9 @@ func TestService(t *testing.T) {
 
 	// Start the server in a separate goroutine
 	go func() {
-		run(ctx, getenv, out)
+		if err := run(ctx, getenv, out); err != nil {
+			t.Errorf("Unexpected error running the service: %v", err)
+		}
 	}()
 
 	// Wait for the server to start
@@ -125,3 +139,649 @@ func TestService(t *testing.T) {
 	// TODO: Check the log output for any errors or race conditions?
 	// write the log output to a file?
 }
+
+func TestUnknownEngine(t *testing.T) {
+	var logBuffer bytes.Buffer
+
+	getenv := func(key string) string {
+		if key == "ENGINE" {
+			return "does-not-exist"
+		}
+		return ""
+	}
+
+	err := run(context.Background(), getenv, &logBuffer)
+	if !errors.Is(err, database.ErrUnknownEngine) {
+		t.Errorf("Expected ErrUnknownEngine, got %v", err)
+	}
+}
+
+func TestSwapPolicyConfig(t *testing.T) {
+	getenv := func(policy string) func(string) string {
+		return func(key string) string {
+			if key == "SWAP_POLICY" {
+				return policy
+			}
+			return ""
+		}
+	}
+
+	config, err := loadConfig(getenv("elapsed=10m"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.SwapPolicy != (naive.ElapsedPolicy{Interval: 10 * time.Minute}) {
+		t.Errorf("Expected an elapsed swap policy, got %#v", config.SwapPolicy)
+	}
+
+	var logBuffer bytes.Buffer
+	if err = run(context.Background(), getenv("sometimes"), &logBuffer); err == nil {
+		t.Errorf("Expected an invalid SWAP_POLICY to be rejected")
+	}
+}
+
+func TestQueueConfig(t *testing.T) {
+	env := map[string]string{"AVL_QUEUE_SIZE": "16", "AVL_QUEUE_OVERFLOW": "coalesce"}
+	getenv := func(key string) string { return env[key] }
+
+	config, err := loadConfig(getenv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.QueueSize != 16 || config.Overflow != naive.OverflowCoalesce {
+		t.Errorf("Expected a queue of 16 coalescing updates, got %d, %v", config.QueueSize, config.Overflow)
+	}
+
+	for key, value := range map[string]string{"AVL_QUEUE_SIZE": "0", "AVL_QUEUE_OVERFLOW": "spill"} {
+		env = map[string]string{key: value}
+		if _, err = loadConfig(getenv); err == nil {
+			t.Errorf("Expected %s=%s to be rejected", key, value)
+		}
+	}
+}
+
+func TestShardsConfig(t *testing.T) {
+	env := map[string]string{"SHARDS": "8"}
+	getenv := func(key string) string { return env[key] }
+
+	config, err := loadConfig(getenv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.Shards != 8 {
+		t.Errorf("Expected 8 shards, got %d", config.Shards)
+	}
+
+	for _, value := range []string{"0", "-1", "many"} {
+		env = map[string]string{"SHARDS": value}
+		if _, err = loadConfig(getenv); err == nil {
+			t.Errorf("Expected SHARDS=%s to be rejected", value)
+		}
+	}
+}
+
+func TestLimitsConfig(t *testing.T) {
+	env := map[string]string{
+		"MAX_KEYS":           "1000",
+		"MAX_MEMORY_BYTES":   "1048576",
+		"EVICTION_POLICY":    "lfu",
+		"ADMISSION_FALLBACK": "deny",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	config, err := loadConfig(getenv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := admission.Limits{MaxKeys: 1000, MaxBytes: 1 << 20, Policy: admission.LFU, Fallback: admission.Deny}
+	if config.Limits != expected {
+		t.Errorf("Expected %+v, got %+v", expected, config.Limits)
+	}
+
+	invalid := map[string]string{
+		"MAX_KEYS":           "0",
+		"MAX_MEMORY_BYTES":   "lots",
+		"EVICTION_POLICY":    "fifo",
+		"ADMISSION_FALLBACK": "maybe",
+	}
+	for key, value := range invalid {
+		env = map[string]string{key: value}
+		if _, err = loadConfig(getenv); err == nil {
+			t.Errorf("Expected %s=%s to be rejected", key, value)
+		}
+	}
+}
+
+func TestLimitsDeny(t *testing.T) {
+	for _, engine := range []string{"naive", "concurrent"} {
+		t.Run(engine, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+			limits := admission.Limits{MaxKeys: 1, Policy: admission.LFU, Fallback: admission.Deny}
+			s, err := service.NewLimiterService(engine, logger, service.WithEngineOptions(database.WithLimits(limits)))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer s.Shutdown()
+
+			// Once the only key is in regular use, new keys are limited
+			for i := 0; i < 2; i++ {
+				if result, err := s.Limit(context.Background(), service.Request{Key: "regular", Capacity: 10, Interval: 1, Unit: "s"}); err != nil || result.Result != "OK" {
+					t.Fatalf("Expected OK, got %s, %v", result.Result, err)
+				}
+			}
+
+			if result, err := s.Limit(context.Background(), service.Request{Key: "new", Capacity: 10, Interval: 1, Unit: "s"}); err != nil || result.Result != "LIMITED" {
+				t.Errorf("Expected a new key to be limited, got %s, %v", result.Result, err)
+			}
+
+			// In a batch the requests before the new key keep their results, having consumed their tokens
+			requests := []service.Request{
+				{Key: "regular", Capacity: 10, Interval: 1, Unit: "s"},
+				{Key: "new", Capacity: 10, Interval: 1, Unit: "s"},
+				{Key: "regular", Capacity: 10, Interval: 1, Unit: "s"},
+			}
+			results, result, err := s.LimitMany(context.Background(), requests, false)
+			if err != nil || result != "LIMITED" || !slices.Equal(results, []string{"OK", "LIMITED", "LIMITED"}) {
+				t.Errorf("Expected OK, LIMITED, LIMITED, got %v %s, %v", results, result, err)
+			}
+
+			results, result, err = s.LimitMany(context.Background(), requests, true)
+			if err != nil || result != "LIMITED" || !slices.Equal(results, []string{"LIMITED", "LIMITED", "LIMITED"}) {
+				t.Errorf("Expected an all-or-nothing batch to be limited, got %v %s, %v", results, result, err)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s, err := service.NewLimiterService("naive", logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer s.Shutdown()
+
+	server := NewServer(logger, s)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/limit/status_key", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected %d for an unknown key, got %d", http.StatusNotFound, recorder.Code)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err = s.Limit(context.Background(), service.Request{Key: "status_key", Capacity: 10, Interval: 60, Unit: "s"}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Asking twice must not consume anything
+	for i := 0; i < 2; i++ {
+		recorder = httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/limit/status_key", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, recorder.Code)
+		}
+
+		var status statusResponse
+		if err = json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+			t.Fatalf("Error decoding response body: %v", err)
+		}
+
+		if status.AvailableTokens != 7 || status.Capacity != 10 {
+			t.Errorf("Expected 7 of 10 tokens, got %d of %d", status.AvailableTokens, status.Capacity)
+		}
+		if !status.ResetsAt.After(time.Now()) {
+			t.Errorf("Expected the reset time to be in the future, got %v", status.ResetsAt)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s, err := service.NewLimiterService("naive", logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer s.Shutdown()
+
+	server := NewServer(logger, s)
+
+	for i := 0; i < 2; i++ {
+		if _, err = s.Limit(context.Background(), service.Request{Key: "reset_key", Capacity: 1, Interval: 60, Unit: "s"}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/api/v1/limit/reset_key", nil))
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d", http.StatusNoContent, recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/api/v1/limit/reset_key", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected %d for an unknown key, got %d", http.StatusNotFound, recorder.Code)
+	}
+
+	result, err := s.Limit(context.Background(), service.Request{Key: "reset_key", Capacity: 1, Interval: 60, Unit: "s"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Result != "OK" {
+		t.Errorf("Expected the reset key to be allowed again, got %s", result.Result)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s, err := service.NewLimiterService("naive", logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer s.Shutdown()
+
+	server := NewServer(logger, s)
+
+	for _, key := range []string{"tenant42:b", "tenant42:a", "tenant4:a", "tenant43:a"} {
+		if _, err = s.Limit(context.Background(), service.Request{Key: key, Capacity: 10, Interval: 60, Unit: "s"}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/keys?prefix=tenant42:&limit=10", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	var statuses []statusResponse
+	if err = json.Unmarshal(recorder.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("Error decoding response body: %v", err)
+	}
+
+	if len(statuses) != 2 || statuses[0].Key != "tenant42:a" || statuses[1].Key != "tenant42:b" {
+		t.Errorf("Expected tenant42:a and tenant42:b, got %+v", statuses)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/keys?limit=0", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected %d for an invalid limit, got %d", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s, err := service.NewLimiterService("naive", logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer s.Shutdown()
+
+	server := NewServer(logger, s)
+
+	limit := func(body string) (int, string) {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/limit", bytes.NewBufferString(body)))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	for _, algorithm := range []string{"sliding_log", "sliding_window", "gcra"} {
+		body := fmt.Sprintf(`{"key": %q, "algorithm": %q, "capacity": 2, "interval": 60, "unit": "s"}`, algorithm, algorithm)
+		for i, expected := range []string{"OK", "OK", "LIMITED"} {
+			if code, result := limit(body); code != http.StatusOK || result != expected {
+				t.Errorf("Expected request %d of %s to be %s, got %d %s", i, algorithm, expected, code, result)
+			}
+		}
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/limit/"+algorithm, nil))
+
+		var status statusResponse
+		if err = json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+			t.Fatalf("Error decoding response body: %v", err)
+		}
+		if status.Algorithm != algorithm || status.AvailableTokens != 0 {
+			t.Errorf("Expected a %s with nothing available, got %+v", algorithm, status)
+		}
+	}
+
+	// A GCRA spacing requests 30 seconds apart, with bursts of one, knows when to come back
+	recorder := httptest.NewRecorder()
+	body := `{"key": "spaced", "algorithm": "gcra", "capacity": 2, "interval": 60, "unit": "s", "burst": 1}`
+	for i := 0; i < 2; i++ {
+		recorder = httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/limit", bytes.NewBufferString(body)))
+	}
+	if recorder.Body.String() != "LIMITED" || recorder.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected to be limited and told to retry after 30s, got %s after %q",
+			recorder.Body.String(), recorder.Header().Get("Retry-After"))
+	}
+
+	// A leaky bucket tells queued requests how long to wait for their turn
+	body = `{"key": "queued", "algorithm": "leaky_bucket", "capacity": 2, "interval": 60, "unit": "s"}`
+	for i, expected := range []limitResponse{{"OK", 0}, {"OK", 30000}, {"LIMITED", 0}} {
+		code, result := limit(body)
+
+		var response limitResponse
+		if err = json.Unmarshal([]byte(result), &response); err != nil {
+			t.Fatalf("Error decoding response body: %v", err)
+		}
+		if code != http.StatusOK || response != expected {
+			t.Errorf("Expected request %d of the leaky bucket to be %+v, got %d %+v", i, expected, code, response)
+		}
+	}
+
+	code, _ := limit(`{"key": "fixed","algorithm": "fixed_window", "capacity": 2, "interval": 60, "unit": "s"}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("Expected %d for an unknown algorithm, got %d", http.StatusBadRequest, code)
+	}
+
+	// Nothing is stored for requests the algorithm cannot limit by
+	for _, body := range []string{
+		`{"key": "invalid", "algorithm": "sliding_window", "capacity": 2, "interval": 60, "unit": "days"}`,
+		`{"key": "invalid", "algorithm": "gcra", "capacity": 0, "interval": 60, "unit": "s"}`,
+		`{"key": "invalid", "algorithm": "leaky_bucket", "capacity": 2000, "interval": 1, "unit": "us"}`,
+	} {
+		if code, _ = limit(body); code != http.StatusBadRequest {
+			t.Errorf("Expected %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/limit/invalid", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected no key to be left behind by invalid requests, got %d", recorder.Code)
+	}
+}
+
+func TestLimitCost(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s, err := service.NewLimiterService("naive", logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer s.Shutdown()
+
+	server := NewServer(logger, s)
+
+	limit := func(cost int) (int, string) {
+		body := fmt.Sprintf(`{"key": "uploads", "capacity": 10, "interval": 60, "unit": "s", "cost": %d}`, cost)
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/limit", bytes.NewBufferString(body)))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	// The second request would overdraw the bucket, so the third can have what is left
+	for i, step := range []struct {
+		cost     int
+		expected string
+	}{
+		{6, "OK"},
+		{6, "LIMITED"},
+		{4, "OK"},
+		{1, "LIMITED"},
+	} {
+		if code, result := limit(step.cost); code != http.StatusOK || result != step.expected {
+			t.Errorf("Expected request %d costing %d to be %s, got %d %s", i, step.cost, step.expected, code, result)
+		}
+	}
+
+	if code, _ := limit(11); code != http.StatusBadRequest {
+		t.Errorf("Expected %d for a cost over the capacity, got %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestLimitRefund(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s, err := service.NewLimiterService("naive", logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer s.Shutdown()
+
+	server := NewServer(logger, s)
+
+	limit := func() string {
+		body := `{"key": "downstream", "capacity": 2, "interval": 60, "unit": "s"}`
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/limit", bytes.NewBufferString(body)))
+		return recorder.Body.String()
+	}
+
+	refund := func(body string) (int, statusResponse) {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/limit/refund", bytes.NewBufferString(body)))
+
+		var status statusResponse
+		if recorder.Code == http.StatusOK {
+			if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+				t.Fatalf("Error decoding response body: %v", err)
+			}
+		}
+		return recorder.Code, status
+	}
+
+	limit()
+	limit()
+
+	// Retrying the refund must not credit it twice
+	for i := 0; i < 2; i++ {
+		code, status := refund(`{"key": "downstream", "request_id": "call-1"}`)
+		if code != http.StatusOK || status.AvailableTokens != 1 {
+			t.Errorf("Expected refund %d to leave 1 token available, got %d %+v", i, code, status)
+		}
+	}
+
+	if result := limit(); result != "OK" {
+		t.Errorf("Expected the refunded token to be used, got %s", result)
+	}
+	if result := limit(); result != "LIMITED" {
+		t.Errorf("Expected the bucket to be empty again, got %s", result)
+	}
+
+	// A refund never credits more than the capacity
+	if code, status := refund(`{"key": "downstream", "tokens": 5}`); code != http.StatusOK || status.AvailableTokens != 2 {
+		t.Errorf("Expected the bucket to be full, got %d %+v", code, status)
+	}
+
+	if code, _ := refund(`{"key": "unknown"}`); code != http.StatusNotFound {
+		t.Errorf("Expected %d for an unknown key, got %d", http.StatusNotFound, code)
+	}
+	if code, _ := refund(`{"key": "downstream", "tokens": -1}`); code != http.StatusBadRequest {
+		t.Errorf("Expected %d for a negative refund, got %d", http.StatusBadRequest, code)
+	}
+	// Only a POST is a refund, so a key named refund can still be reset
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/api/v1/limit/refund", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected %d for the unknown key named refund, got %d", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestLimitBatch(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s, err := service.NewLimiterService("naive", logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer s.Shutdown()
+
+	server := NewServer(logger, s)
+
+	batch := func(body string) (int, batchResponse) {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/limit/batch", bytes.NewBufferString(body)))
+
+		var response batchResponse
+		if recorder.Code == http.StatusOK {
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Error decoding response body: %v", err)
+			}
+		}
+		return recorder.Code, response
+	}
+
+	// The user key only allows one request, so the second batch must not consume the tenant's token
+	body := `{"all_or_nothing": true, "limits": [
+		{"key": "user", "capacity": 1, "interval": 60, "unit": "s"},
+		{"key": "tenant", "capacity": 2, "interval": 60, "unit": "s"}
+	]}`
+
+	code, response := batch(body)
+	if code != http.StatusOK || response.Result != "OK" || len(response.Results) != 2 {
+		t.Fatalf("Expected an allowed batch, got %d %+v", code, response)
+	}
+
+	code, response = batch(body)
+	if code != http.StatusOK || response.Result != "LIMITED" || response.Results[0].Result != "LIMITED" {
+		t.Fatalf("Expected a limited batch, got %d %+v", code, response)
+	}
+
+	status, ok, err := s.Status("tenant")
+	if err != nil || !ok {
+		t.Fatalf("Expected the tenant key to exist: %v", err)
+	}
+	if status.AvailableTokens != 1 {
+		t.Errorf("Expected the tenant to keep 1 token, got %d", status.AvailableTokens)
+	}
+
+	if code, _ = batch(`{"limits": []}`); code != http.StatusBadRequest {
+		t.Errorf("Expected %d for an empty batch, got %d", http.StatusBadRequest, code)
+	}
+
+	// Only a POST is a batch, so a key named batch can still be read
+	batch(`{"limits": [{"key": "batch", "capacity": 1, "interval": 60, "unit": "s"}]}`)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/limit/batch", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected the status of the key named batch, got %d", recorder.Code)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := filepath.Join(t.TempDir(), "argus.snapshot")
+
+	s, err := service.NewLimiterService("naive", logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = s.Limit(context.Background(), service.Request{Key: "snapshot_key", Capacity: 3, Interval: 60, Unit: "s"}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	saveSnapshot(logger, s, path)
+	s.Shutdown()
+
+	// Restoring is skipped, rather than failing, when there is no snapshot yet
+	restored, err := service.NewLimiterService("concurrent", logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer restored.Shutdown()
+
+	restoreSnapshot(logger, restored, path+".missing")
+	restoreSnapshot(logger, restored, path)
+
+	status, ok, err := restored.Status("snapshot_key")
+	if err != nil || !ok {
+		t.Fatalf("Expected the key to be restored, got ok: %t, error: %v", ok, err)
+	}
+	if status.AvailableTokens != 1 || status.Capacity != 3 {
+		t.Errorf("Expected 1 of 3 tokens left, got %d of %d", status.AvailableTokens, status.Capacity)
+	}
+}
+
+func TestWALRecovery(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+
+	for _, engine := range []string{"naive", "rebalancing", "concurrent"} {
+		t.Run(engine, func(t *testing.T) {
+			key := engine + "_key"
+
+			crashed, err := service.NewLimiterService(engine, logger, service.WithWAL(dir, 0, wal.WithSync(wal.SyncAlways)))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			// Only shut down once the recovered service is done with the log, as after a crash
+			defer crashed.Shutdown()
+
+			for i := 0; i < 2; i++ {
+				if _, err = crashed.Limit(context.Background(), service.Request{Key: key, Capacity: 3, Interval: 60, Unit: "s"}); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+
+			recovered, err := service.NewLimiterService(engine, logger, service.WithWAL(dir, 0))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer recovered.Shutdown()
+
+			status, ok, err := recovered.Status(key)
+			if err != nil || !ok {
+				t.Fatalf("Expected the key to be recovered, got ok: %t, error: %v", ok, err)
+			}
+			if status.AvailableTokens != 1 {
+				t.Errorf("Expected 1 token left, got %d", status.AvailableTokens)
+			}
+		})
+	}
+}
+
+func TestLongKeyRestart(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+
+	s, err := service.NewLimiterService("naive", logger, service.WithWAL(dir, 0))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	server := NewServer(logger, s)
+
+	limit := func(key string) int {
+		body := fmt.Sprintf(`{"key": %q, "capacity": 3, "interval": 60, "unit": "s"}`, key)
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/limit", bytes.NewBufferString(body)))
+		return recorder.Code
+	}
+
+	// A key too long for a snapshot would fail the compaction on shutdown, and the restart after it
+	if code := limit(strings.Repeat("k", 2<<20)); code != http.StatusBadRequest {
+		t.Errorf("Expected %d for a key over %d bytes, got %d", http.StatusBadRequest, service.MaxKeyLength, code)
+	}
+	if code := limit("uploads"); code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+	}
+	s.Shutdown()
+
+	restarted, err := service.NewLimiterService("naive", logger, service.WithWAL(dir, 0))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer restarted.Shutdown()
+
+	if status, ok, err := restarted.Status("uploads"); err != nil || !ok || status.AvailableTokens != 2 {
+		t.Errorf("Expected uploads to be recovered with 2 tokens, got %+v, ok: %t, error: %v", status, ok, err)
+	}
+}
@@ -0,0 +1,376 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// ErrUnknownAlgorithm is returned by ParseAlgorithm for names that are not an Algorithm.
+var ErrUnknownAlgorithm = errors.New("unknown rate limiting algorithm")
+
+// errInvalidWindow is returned when the interval and unit of a request do not make up a positive
+// window.
+var errInvalidWindow = fmt.Errorf("%w: invalid window", ErrInvalidRequest)
+
+// errInvalidCapacity is returned when the capacity of a request is negative, or is not positive for
+// a GCRA or leaky bucket.
+var errInvalidCapacity = fmt.Errorf("%w: invalid capacity", ErrInvalidRequest)
+
+// Algorithm decides how the requests to a key are limited.
+type Algorithm int
+
+const (
+	// TokenBucket refills a bucket of capacity tokens evenly over the interval. A full bucket lets a
+	// client burst capacity requests at once, at the start of every interval.
+	TokenBucket Algorithm = iota
+	// SlidingLog records the time of every allowed request, and allows at most capacity of them in
+	// any interval. It is exact, at the cost of storing up to capacity times per key, though the
+	// tokens of a request's cost share its time, so its capacity is at most MaxSlidingLogCapacity.
+	SlidingLog
+	// SlidingWindow counts the allowed requests in fixed windows of one interval, and estimates the
+	// requests in the interval up to now by weighing the previous window's count by how much of it
+	// that interval still overlaps.
+	SlidingWindow
+	// GCRA, the generic cell rate algorithm, spaces requests evenly at capacity per interval, while
+	// tolerating bursts of up to burst requests. It only stores the theoretical arrival time of the
+	// key's next request, and knows exactly when a denied request would be allowed.
+	GCRA
+	// LeakyBucket queues requests and lets them out evenly at capacity per interval. Rather than
+	// limiting a request it tells the client how long to wait for its turn, unless queue depth
+	// requests are already waiting, counting the one about to go ahead.
+	LeakyBucket
+)
+
+// String returns the name ParseAlgorithm accepts for the algorithm.
+func (a Algorithm) String() string {
+	switch a {
+	case TokenBucket:
+		return "token_bucket"
+	case SlidingLog:
+		return "sliding_log"
+	case SlidingWindow:
+		return "sliding_window"
+	case GCRA:
+		return "gcra"
+	case LeakyBucket:
+		return "leaky_bucket"
+	default:
+		return fmt.Sprintf("Algorithm(%d)", int(a))
+	}
+}
+
+// ParseAlgorithm parses "token_bucket", "sliding_log", "sliding_window", "gcra" or "leaky_bucket". An
+// empty name is the default, TokenBucket.
+func ParseAlgorithm(s string) (Algorithm, error) {
+	switch strings.ToLower(s) {
+	case "", "token_bucket":
+		return TokenBucket, nil
+	case "sliding_log":
+		return SlidingLog, nil
+	case "sliding_window":
+		return SlidingWindow, nil
+	case "gcra":
+		return GCRA, nil
+	case "leaky_bucket":
+		return LeakyBucket, nil
+	default:
+		return TokenBucket, fmt.Errorf("%w: %q", ErrUnknownAlgorithm, s)
+	}
+}
+
+// windowLength returns the length of interval in the unit, or errInvalidWindow if it is not positive.
+func windowLength(interval int32, unit string) (time.Duration, error) {
+	var length time.Duration
+
+	switch unit {
+	case "s":
+		length = time.Duration(interval) * time.Second
+	case "ms":
+		length = time.Duration(interval) * time.Millisecond
+	case "us":
+		length = time.Duration(interval) * time.Microsecond
+	}
+
+	if length <= 0 {
+		return 0, fmt.Errorf("%w: %d%s", errInvalidWindow, interval, unit)
+	}
+	return length, nil
+}
+
+// MaxSlidingLogCapacity is the largest capacity a sliding log may have. It bounds the entries of a
+// key's log, so that its data fits in a snapshot entry. Larger limits call for a sliding window.
+const MaxSlidingLogCapacity = 1 << 16
+
+// logEntryBytes is the size of a logEntry in memory: a time.Time and a count.
+const logEntryBytes = 24 + 8
+
+// logEntry is the time of one or more requests a sliding log allowed, and how many tokens they took.
+type logEntry struct {
+	at    time.Time
+	count int64
+}
+
+// slidingLog holds the requests a sliding log allowed, oldest first, with those allowed at the same
+// time in a single entry. It is never mutated once stored.
+type slidingLog struct {
+	entries []logEntry
+}
+
+// since returns the entries of the requests allowed after start. The slice shares the log's array.
+func (l *slidingLog) since(start time.Time) []logEntry {
+	if l == nil {
+		return nil
+	}
+
+	for i, entry := range l.entries {
+		if entry.at.After(start) {
+			return l.entries[i:]
+		}
+	}
+	return nil
+}
+
+// tokens returns the number of tokens the requests of the entries took.
+func tokens(entries []logEntry) int64 {
+	var n int64
+	for _, entry := range entries {
+		n += entry.count
+	}
+	return n
+}
+
+// slidingLogCallback allows the request if its cost still fits in capacity alongside the requests
+// allowed in the interval up to now, and logs it with its cost if so. The key expires once its
+// newest request leaves the interval, as its log is then empty.
+func slidingLogCallback(current *Data, p *Params) (*Data, outcome, error) {
+	length, err := windowLength(p.interval, p.unit)
+	if err != nil {
+		return nil, outcome{}, err
+	}
+
+	var entries []logEntry
+	if current != nil && current.algorithm == SlidingLog {
+		entries = current.log.since(p.now.Add(-length))
+	}
+
+	allowed := tokens(entries)+p.cost <= p.capacity
+	if allowed {
+		// Copy the log, the stored data must not change
+		logged := append(make([]logEntry, 0, len(entries)+1), entries...)
+		if n := len(logged); n > 0 && logged[n-1].at.Equal(p.now) {
+			logged[n-1].count += p.cost
+		} else {
+			logged = append(logged, logEntry{at: p.now, count: p.cost})
+		}
+		entries = logged
+	}
+
+	expiresAt := p.now
+	if len(entries) > 0 {
+		expiresAt = entries[len(entries)-1].at.Add(length)
+	}
+
+	return &Data{
+		algorithm: SlidingLog,
+		log:       &slidingLog{entries: entries},
+		expiresAt: expiresAt,
+		capacity:  p.capacity,
+		interval:  p.interval,
+		unit:      p.unit,
+	}, outcome{allowed: allowed}, nil
+}
+
+// slidingWindow holds the number of requests a sliding window allowed in the window starting at
+// start, and in the one before it.
+type slidingWindow struct {
+	start    time.Time
+	previous int64
+	current  int64
+}
+
+// advance returns the window as it stands at now. Windows start at multiples of length, so once now
+// is past the current window its count becomes the previous one, or both are forgotten if more
+// than a whole window has passed.
+func (w slidingWindow) advance(now time.Time, length time.Duration) slidingWindow {
+	start := now.Truncate(length)
+
+	switch {
+	case !start.After(w.start):
+		return w
+	case start.Sub(w.start) == length:
+		return slidingWindow{start: start, previous: w.current}
+	default:
+		return slidingWindow{start: start}
+	}
+}
+
+// estimate returns the number of requests allowed in the interval up to now, counting the previous
+// window's requests in proportion to the part of it the interval overlaps.
+func (w slidingWindow) estimate(now time.Time, length time.Duration) float64 {
+	overlap := float64(length-now.Sub(w.start)) / float64(length)
+	return float64(w.previous)*overlap + float64(w.current)
+}
+
+// slidingWindowCallback allows the request if counting its cost keeps the estimated requests in the
+// interval up to now within capacity. The key expires once neither of its windows overlaps the
+// interval any more.
+func slidingWindowCallback(current *Data, p *Params) (*Data, outcome, error) {
+	length, err := windowLength(p.interval, p.unit)
+	if err != nil {
+		return nil, outcome{}, err
+	}
+
+	window := slidingWindow{start: p.now.Truncate(length)}
+	if current != nil && current.algorithm == SlidingWindow {
+		window = current.window.advance(p.now, length)
+	}
+
+	allowed := window.estimate(p.now, length)+float64(p.cost) <= float64(p.capacity)
+	if allowed {
+		window.current += p.cost
+	}
+
+	return &Data{
+		algorithm: SlidingWindow,
+		window:    &window,
+		expiresAt: window.start.Add(2 * length),
+		capacity:  p.capacity,
+		interval:  p.interval,
+		unit:      p.unit,
+	}, outcome{allowed: allowed}, nil
+}
+
+// spacing returns the emission interval of a GCRA or leaky bucket, the time between two requests at
+// the sustained rate, and its tolerance, how far ahead of now the theoretical arrival time may run
+// after n requests. An n that is not positive defaults to capacity. A capacity of more requests than
+// there are nanoseconds in the window would space them no time apart, and is refused, as is an n
+// whose tolerance would overflow a time.Duration.
+func spacing(capacity int64, interval int32, unit string, n int64) (time.Duration, time.Duration, error) {
+	length, err := windowLength(interval, unit)
+	if err != nil {
+		return 0, 0, err
+	}
+	if capacity <= 0 {
+		return 0, 0, fmt.Errorf("%w: %d", errInvalidCapacity, capacity)
+	}
+
+	emission := length / time.Duration(capacity)
+	if emission == 0 {
+		return 0, 0, fmt.Errorf("%w: %d is more than one request a nanosecond over %v", errInvalidCapacity, capacity, length)
+	}
+
+	if n <= 0 {
+		n = capacity
+	}
+	if n > math.MaxInt64/int64(emission) {
+		return 0, 0, fmt.Errorf("%w: %d requests %v apart take too long", ErrInvalidRequest, n, emission)
+	}
+
+	return emission, emission * time.Duration(n), nil
+}
+
+// arrival returns the theoretical arrival time of the key's next request, which is never before now.
+func (d *Data) arrival(algorithm Algorithm, now time.Time) time.Time {
+	if d != nil && d.algorithm == algorithm && d.expiresAt.After(now) {
+		return d.expiresAt
+	}
+	return now
+}
+
+// schedule moves the theoretical arrival time tat on by increment, the emission intervals of the
+// request's cost, if it then stays within the tolerance of now, and returns it. Otherwise tat is
+// returned as it is, along with how long until the request would be allowed.
+func schedule(tat time.Time, now time.Time, increment time.Duration, tolerance time.Duration) (time.Time, outcome) {
+	next := tat.Add(increment)
+	if allowAt := next.Add(-tolerance); now.Before(allowAt) {
+		return tat, outcome{retryAfter: allowAt.Sub(now)}
+	}
+	return next, outcome{allowed: true}
+}
+
+// gcraCallback allows the request if moving the key's theoretical arrival time on by an emission
+// interval per token of its cost keeps it within the tolerance of now. A denied request leaves it
+// alone and is told exactly how long until it would be allowed. The key expires at its theoretical
+// arrival time, as it would then be as good as new.
+func gcraCallback(current *Data, p *Params) (*Data, outcome, error) {
+	emission, tolerance, err := spacing(p.capacity, p.interval, p.unit, p.burst)
+	if err != nil {
+		return nil, outcome{}, err
+	}
+
+	tat, result := schedule(current.arrival(GCRA, p.now), p.now, emission*time.Duration(p.cost), tolerance)
+
+	return &Data{
+		algorithm: GCRA,
+		expiresAt: tat,
+		capacity:  p.capacity,
+		interval:  p.interval,
+		unit:      p.unit,
+		burst:     p.burst,
+	}, result, nil
+}
+
+// leakyBucketCallback queues the request behind those already waiting, taking up a place per token
+// of its cost, if there is room, and tells it how long to wait for its turn. It is a GCRA whose
+// requests go ahead at their theoretical arrival time, rather than as soon as they are allowed: the
+// key's theoretical arrival time is when its queue runs empty, and as with a GCRA the key expires
+// then.
+func leakyBucketCallback(current *Data, p *Params) (*Data, outcome, error) {
+	emission, tolerance, err := spacing(p.capacity, p.interval, p.unit, p.queueDepth)
+	if err != nil {
+		return nil, outcome{}, err
+	}
+
+	turn := current.arrival(LeakyBucket, p.now)
+	tat, result := schedule(turn, p.now, emission*time.Duration(p.cost), tolerance)
+	if result.allowed {
+		result.delay = turn.Sub(p.now)
+	}
+
+	return &Data{
+		algorithm:  LeakyBucket,
+		expiresAt:  tat,
+		capacity:   p.capacity,
+		interval:   p.interval,
+		unit:       p.unit,
+		queueDepth: p.queueDepth,
+	}, result, nil
+}
+
+// available returns the requests the key would allow at now, without changing anything.
+func (d *Data) available(now time.Time) int64 {
+	switch d.algorithm {
+	case SlidingLog, SlidingWindow:
+		length, err := windowLength(d.interval, d.unit)
+		if err != nil {
+			return d.capacity
+		}
+
+		var used int64
+		if d.algorithm == SlidingLog {
+			used = tokens(d.log.since(now.Add(-length)))
+		} else {
+			used = int64(math.Ceil(d.window.advance(now, length).estimate(now, length)))
+		}
+		return max(0, d.capacity-used)
+	case GCRA, LeakyBucket:
+		n := d.burst
+		if d.algorithm == LeakyBucket {
+			n = d.queueDepth
+		}
+
+		emission, tolerance, err := spacing(d.capacity, d.interval, d.unit, n)
+		if err != nil {
+			return 0
+		}
+		return int64(now.Add(tolerance).Sub(d.arrival(d.algorithm, now)) / emission)
+	default:
+		// Work on a copy, the stored data must not change
+		bucket := *d
+		bucket.refill(now)
+		return bucket.availableTokens
+	}
+}
@@ -0,0 +1,507 @@
+//nolint:testpackage // Allow tests to drive the callbacks with a fake clock
+package service
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock makes requests to a single key at times the test sets, storing the data left by each.
+type fakeClock struct {
+	t          *testing.T
+	now        time.Time
+	data       *Data
+	last       outcome // last is the outcome of the latest request.
+	burst      int64   // burst is passed on to a GCRA.
+	queueDepth int64   // queueDepth is passed on to a leaky bucket.
+	cost       int64   // cost is the cost of every request.
+}
+
+// newFakeClock starts the clock at the start of a window of every length used by the tests.
+func newFakeClock(t *testing.T) *fakeClock {
+	return &fakeClock{t: t, now: time.Unix(1_000_000, 0)}
+}
+
+// at moves the clock to offset past its start and makes count requests, returning how many were
+// allowed.
+func (c *fakeClock) at(offset time.Duration, algorithm Algorithm, capacity int64, count int) int {
+	c.t.Helper()
+
+	now := time.Unix(1_000_000, 0).Add(offset)
+	if now.Before(c.now) {
+		c.t.Fatalf("The clock must not go backwards, from %v to %v", c.now, now)
+	}
+	c.now = now
+
+	allowed := 0
+	for i := 0; i < count; i++ {
+		request := Request{
+			Algorithm:  algorithm,
+			Capacity:   capacity,
+			Interval:   10,
+			Unit:       "s",
+			Burst:      c.burst,
+			QueueDepth: c.queueDepth,
+			Cost:       c.cost,
+		}
+
+		data, result, err := callback(c.data, request.params(c.now))
+		if err != nil {
+			c.t.Fatalf("Unexpected error: %v", err)
+		}
+
+		c.data, c.last = data, result
+		if result.allowed {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestSlidingLog(t *testing.T) {
+	clock := newFakeClock(t)
+
+	for _, step := range []struct {
+		offset   time.Duration
+		count    int
+		expected int
+	}{
+		{0, 1, 1},
+		{1 * time.Second, 1, 1},
+		{2 * time.Second, 2, 1},
+		// The first request is still within the interval until it is a whole interval old
+		{9999 * time.Millisecond, 1, 0},
+		{10 * time.Second, 2, 1},
+		{10500 * time.Millisecond, 1, 0},
+		{11 * time.Second, 1, 1},
+		// Every request has left the interval
+		{22 * time.Second, 5, 3},
+	} {
+		if allowed := clock.at(step.offset, SlidingLog, 3, step.count); allowed != step.expected {
+			t.Errorf("Expected %d of %d requests to be allowed at %v, got %d", step.expected, step.count, step.offset, allowed)
+		}
+	}
+
+	if expiresAt := clock.now.Add(10 * time.Second); !clock.data.expiresAt.Equal(expiresAt) {
+		t.Errorf("Expected the key to expire at %v, got %v", expiresAt, clock.data.expiresAt)
+	}
+	if available := clock.data.available(clock.now.Add(10 * time.Second)); available != 3 {
+		t.Errorf("Expected 3 requests to be available once the log is empty, got %d", available)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	clock := newFakeClock(t)
+
+	for _, step := range []struct {
+		offset   time.Duration
+		count    int
+		expected int
+	}{
+		{5 * time.Second, 12, 10},
+		// The previous window still counts in full at the start of the next one
+		{10 * time.Second, 1, 0},
+		// Half of it counts half way through the next window
+		{15 * time.Second, 8, 5},
+		{17 * time.Second, 1, 1},
+		// 6 requests in the previous window, of which 30% count
+		{27 * time.Second, 10, 8},
+		// More than a whole window has passed, so both counts are forgotten
+		{45 * time.Second, 12, 10},
+	} {
+		if allowed := clock.at(step.offset, SlidingWindow, 10, step.count); allowed != step.expected {
+			t.Errorf("Expected %d of %d requests to be allowed at %v, got %d", step.expected, step.count, step.offset, allowed)
+		}
+	}
+
+	if expiresAt := time.Unix(1_000_000, 0).Add(60 * time.Second); !clock.data.expiresAt.Equal(expiresAt) {
+		t.Errorf("Expected the key to expire at %v, got %v", expiresAt, clock.data.expiresAt)
+	}
+	if available := clock.data.available(time.Unix(1_000_000, 0).Add(55 * time.Second)); available != 5 {
+		t.Errorf("Expected half of the previous window's 10 requests to count, got %d available", available)
+	}
+}
+
+func TestGCRA(t *testing.T) {
+	// A sustained rate of one request a second, with bursts of up to 3
+	clock := newFakeClock(t)
+	clock.burst = 3
+
+	for _, step := range []struct {
+		offset     time.Duration
+		count      int
+		expected   int
+		retryAfter time.Duration
+	}{
+		{0, 5, 3, 1 * time.Second},
+		{250 * time.Millisecond, 1, 0, 750 * time.Millisecond},
+		// Every second makes room for one more request
+		{1 * time.Second, 2, 1, 1 * time.Second},
+		{2500 * time.Millisecond, 2, 1, 500 * time.Millisecond},
+		// The theoretical arrival time is behind the clock, so the whole burst is allowed again
+		{10 * time.Second, 4, 3, 1 * time.Second},
+	} {
+		if allowed := clock.at(step.offset, GCRA, 10, step.count); allowed != step.expected {
+			t.Errorf("Expected %d of %d requests to be allowed at %v, got %d", step.expected, step.count, step.offset, allowed)
+		}
+		if clock.last.allowed || clock.last.retryAfter != step.retryAfter {
+			t.Errorf("Expected a retry after %v at %v, got %+v", step.retryAfter, step.offset, clock.last)
+		}
+	}
+
+	// Only the theoretical arrival time is kept, as the expiry time
+	if tat := clock.now.Add(3 * time.Second); !clock.data.expiresAt.Equal(tat) {
+		t.Errorf("Expected a theoretical arrival time of %v, got %v", tat, clock.data.expiresAt)
+	}
+	if available := clock.data.available(clock.now.Add(2 * time.Second)); available != 2 {
+		t.Errorf("Expected 2 requests to be available after 2 seconds, got %d", available)
+	}
+
+	// Without a burst, the capacity is the burst
+	clock = newFakeClock(t)
+	if allowed := clock.at(0, GCRA, 10, 12); allowed != 10 || clock.last.retryAfter != time.Second {
+		t.Errorf("Expected a burst of 10 requests and a retry after a second, got %d and %+v", allowed, clock.last)
+	}
+}
+
+func TestLeakyBucket(t *testing.T) {
+	// Requests leave the queue once a second, and at most 3 wait at once
+	clock := newFakeClock(t)
+	clock.queueDepth = 3
+
+	for _, step := range []struct {
+		offset   time.Duration
+		expected outcome
+	}{
+		{0, outcome{allowed: true}},
+		{0, outcome{allowed: true, delay: 1 * time.Second}},
+		{0, outcome{allowed: true, delay: 2 * time.Second}},
+		{0, outcome{retryAfter: 1 * time.Second}},
+		// The queue is still full, as only part of the first request's second has passed
+		{500 * time.Millisecond, outcome{retryAfter: 500 * time.Millisecond}},
+		{1 * time.Second, outcome{allowed: true, delay: 2 * time.Second}},
+		// The queue ran empty, so the request goes ahead at once
+		{10 * time.Second, outcome{allowed: true}},
+	} {
+		if clock.at(step.offset, LeakyBucket, 10, 1); clock.last != step.expected {
+			t.Errorf("Expected %+v at %v, got %+v", step.expected, step.offset, clock.last)
+		}
+	}
+
+	// The queue runs empty once the last request's turn is over
+	if drained := clock.now.Add(1 * time.Second); !clock.data.expiresAt.Equal(drained) {
+		t.Errorf("Expected the queue to run empty at %v, got %v", drained, clock.data.expiresAt)
+	}
+	if available := clock.data.available(clock.now); available != 2 {
+		t.Errorf("Expected room for 2 more requests, got %d", available)
+	}
+
+	// Without a queue depth, an interval's worth of requests is queued
+	clock = newFakeClock(t)
+	if allowed := clock.at(0, LeakyBucket, 10, 12); allowed != 10 || clock.last.retryAfter != time.Second {
+		t.Errorf("Expected 10 requests to be queued and a retry after a second, got %d and %+v", allowed, clock.last)
+	}
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	clock := newFakeClock(t)
+
+	// Unlike the sliding algorithms, a full bucket allows the whole capacity at once
+	if allowed := clock.at(0, TokenBucket, 10, 12); allowed != 10 {
+		t.Errorf("Expected a burst of 10 requests, got %d", allowed)
+	}
+	if allowed := clock.at(1*time.Second, TokenBucket, 10, 2); allowed != 1 {
+		t.Errorf("Expected 1 token to be refilled after a second, got %d", allowed)
+	}
+}
+
+func TestCost(t *testing.T) {
+	for _, algorithm := range []Algorithm{TokenBucket, SlidingLog, SlidingWindow, GCRA, LeakyBucket} {
+		clock := newFakeClock(t)
+		clock.cost = 4
+
+		// The third request would need 4 tokens with only 2 left, and takes none of them
+		if allowed := clock.at(0, algorithm, 10, 3); allowed != 2 {
+			t.Errorf("Expected 2 requests costing 4 tokens to be allowed by a %v, got %d", algorithm, allowed)
+		}
+		if available := clock.data.available(clock.now); available != 2 {
+			t.Errorf("Expected a %v to have 2 tokens left, got %d", algorithm, available)
+		}
+
+		clock.cost = 2
+		if allowed := clock.at(0, algorithm, 10, 2); allowed != 1 {
+			t.Errorf("Expected the last 2 tokens of a %v to be consumed at once, got %d requests allowed", algorithm, allowed)
+		}
+	}
+
+	// The bucket expires once every token consumed is refilled, at one token a second
+	clock := newFakeClock(t)
+	clock.cost = 4
+	clock.at(0, TokenBucket, 10, 2)
+	if expiresAt := clock.now.Add(8 * time.Second); !clock.data.expiresAt.Equal(expiresAt) {
+		t.Errorf("Expected the bucket to expire at %v, got %v", expiresAt, clock.data.expiresAt)
+	}
+
+	// A GCRA is told to come back once the whole cost fits
+	clock = newFakeClock(t)
+	clock.cost = 4
+	if clock.at(0, GCRA, 10, 3); clock.last.retryAfter != 2*time.Second {
+		t.Errorf("Expected a retry after 2s, got %+v", clock.last)
+	}
+}
+
+func TestSlidingLogCost(t *testing.T) {
+	// A request's tokens share a single entry, however many there are
+	clock := newFakeClock(t)
+	clock.cost = 1 << 50
+	if allowed := clock.at(0, SlidingLog, 1<<50, 1); allowed != 1 || len(clock.data.log.entries) != 1 {
+		t.Fatalf("Expected the request to be allowed and logged once, got %d allowed and %v", allowed, clock.data.log.entries)
+	}
+
+	// As do the requests allowed at the same time, while those allowed later get their own
+	clock = newFakeClock(t)
+	clock.cost = 2
+	clock.at(0, SlidingLog, 10, 2)
+	clock.at(time.Second, SlidingLog, 10, 1)
+	if entries := clock.data.log.entries; len(entries) != 2 || entries[0].count != 4 || entries[1].count != 2 {
+		t.Errorf("Expected entries of 4 and 2 tokens, got %v", entries)
+	}
+	if available := clock.data.available(clock.now); available != 4 {
+		t.Errorf("Expected 4 tokens left, got %d", available)
+	}
+}
+
+func TestSlidingLogSize(t *testing.T) {
+	// The largest log there can be: a request at every nanosecond, and as many refunds as are kept
+	start := time.Unix(1_000_000, 0)
+	d := &Data{algorithm: SlidingLog, capacity: MaxSlidingLogCapacity, interval: 1, unit: "s", log: &slidingLog{}}
+	for i := 0; i < MaxSlidingLogCapacity; i++ {
+		d.log.entries = append(d.log.entries, logEntry{at: start.Add(time.Duration(i)), count: 1})
+	}
+	for i := 0; i < refundMemory; i++ {
+		d.refunds = append(d.refunds, strings.Repeat("x", MaxRequestIDLength))
+	}
+
+	// It still fits in a snapshot entry, of at most 1 MiB
+	if b, err := (dataCodec{}).Encode(d); err != nil || len(b) > 1<<20 {
+		t.Errorf("Expected the log to encode in 1 MiB, got %d bytes: %v", len(b), err)
+	}
+
+	expected := int64(cap(d.log.entries))*logEntryBytes + refundMemory*MaxRequestIDLength
+	if bytes := d.Bytes(); bytes != expected {
+		t.Errorf("Expected the log to take up %d bytes, got %d", expected, bytes)
+	}
+}
+
+func TestCostValidation(t *testing.T) {
+	for _, test := range []struct {
+		request Request
+		valid   bool
+	}{
+		{Request{Capacity: 10}, true},
+		{Request{Capacity: 10, Cost: 10}, true},
+		{Request{Capacity: 10, Cost: 11}, false},
+		{Request{Capacity: 10, Cost: -1}, false},
+		// A single token is always allowed to be asked for, even of no capacity at all
+		{Request{Capacity: 0, Cost: 1}, true},
+		{Request{Algorithm: GCRA, Capacity: 10, Burst: 2, Cost: 3}, false},
+		{Request{Algorithm: LeakyBucket, Capacity: 2, QueueDepth: 10, Cost: 3}, true},
+	} {
+		test.request.Interval, test.request.Unit = 1, "s"
+		if err := test.request.validate(); (err == nil) != test.valid {
+			t.Errorf("Expected %+v to be valid: %t, got %v", test.request, test.valid, err)
+		} else if err != nil && !errors.Is(err, ErrInvalidCost) {
+			t.Errorf("Expected ErrInvalidCost, got %v", err)
+		}
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	for _, test := range []struct {
+		request Request
+		valid   bool
+	}{
+		{Request{Capacity: 10, Interval: 1, Unit: "s"}, true},
+		{Request{Algorithm: SlidingLog, Capacity: 0, Interval: 5, Unit: "ms"}, true},
+		{Request{Algorithm: Algorithm(42), Capacity: 10, Interval: 1, Unit: "s"}, false},
+		{Request{Capacity: 10, Interval: 1, Unit: "days"}, false},
+		{Request{Algorithm: SlidingWindow, Capacity: 10, Interval: 0, Unit: "s"}, false},
+		{Request{Algorithm: TokenBucket, Capacity: -1, Interval: 1, Unit: "s"}, false},
+		{Request{Algorithm: GCRA, Capacity: 0, Interval: 1, Unit: "s"}, false},
+		{Request{Algorithm: LeakyBucket, Capacity: 0, Interval: 1, Unit: "s"}, false},
+		{Request{Algorithm: SlidingLog, Capacity: MaxSlidingLogCapacity, Interval: 1, Unit: "s"}, true},
+		{Request{Algorithm: SlidingLog, Capacity: MaxSlidingLogCapacity + 1, Interval: 1, Unit: "s"}, false},
+		{Request{Key: strings.Repeat("k", MaxKeyLength), Capacity: 10, Interval: 1, Unit: "s"}, true},
+		{Request{Key: strings.Repeat("k", MaxKeyLength+1), Capacity: 10, Interval: 1, Unit: "s"}, false},
+	} {
+		if err := test.request.validate(); (err == nil) != test.valid {
+			t.Errorf("Expected %+v to be valid: %t, got %v", test.request, test.valid, err)
+		} else if err != nil && !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("Expected ErrInvalidRequest, got %v", err)
+		}
+	}
+}
+
+func TestAlgorithmChange(t *testing.T) {
+	clock := newFakeClock(t)
+
+	if allowed := clock.at(0, TokenBucket, 2, 3); allowed != 2 {
+		t.Fatalf("Expected 2 requests to be allowed, got %d", allowed)
+	}
+
+	// The bucket is empty, but a key switching algorithm starts afresh
+	if allowed := clock.at(0, SlidingLog, 2, 3); allowed != 2 {
+		t.Errorf("Expected 2 requests to be allowed, got %d", allowed)
+	}
+	if clock.data.algorithm != SlidingLog || clock.data.window != nil {
+		t.Errorf("Expected only the sliding log's state, got %+v", clock.data)
+	}
+}
+
+func TestInvalidWindow(t *testing.T) {
+	request := Request{Algorithm: SlidingWindow, Capacity: 1, Interval: 10, Unit: "days"}
+	if _, _, err := callback(nil, request.params(time.Now())); !errors.Is(err, errInvalidWindow) {
+		t.Errorf("Expected errInvalidWindow, got %v", err)
+	}
+
+	request = Request{Algorithm: GCRA, Capacity: 0, Interval: 10, Unit: "s"}
+	if _, _, err := callback(nil, request.params(time.Now())); !errors.Is(err, errInvalidCapacity) {
+		t.Errorf("Expected errInvalidCapacity, got %v", err)
+	}
+}
+
+func TestGCRASubNanosecondSpacing(t *testing.T) {
+	// 2000 requests a microsecond would be spaced no time apart
+	request := Request{Algorithm: GCRA, Capacity: 2000, Interval: 1, Unit: "us"}
+	if err := request.validate(); !errors.Is(err, errInvalidCapacity) {
+		t.Errorf("Expected errInvalidCapacity, got %v", err)
+	}
+	if _, _, err := callback(nil, request.params(time.Now())); !errors.Is(err, errInvalidCapacity) {
+		t.Errorf("Expected errInvalidCapacity, got %v", err)
+	}
+
+	// Such data stored before it was refused has nothing available rather than dividing by zero
+	d := &Data{algorithm: GCRA, capacity: 2000, interval: 1, unit: "us", expiresAt: time.Now()}
+	if available := d.available(time.Now()); available != 0 {
+		t.Errorf("Expected nothing available, got %d", available)
+	}
+	if _, err := d.credit(1, time.Now()); !errors.Is(err, errInvalidCapacity) {
+		t.Errorf("Expected errInvalidCapacity, got %v", err)
+	}
+}
+
+func TestGCRABurstOverflow(t *testing.T) {
+	// A burst of 2e9 requests 6 seconds apart is further ahead than a time.Duration reaches
+	request := Request{Algorithm: GCRA, Capacity: 10, Interval: 60, Unit: "s", Burst: 2e9}
+	if err := request.validate(); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected ErrInvalidRequest, got %v", err)
+	}
+	if _, _, err := callback(nil, request.params(time.Now())); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected ErrInvalidRequest, got %v", err)
+	}
+
+	// The largest burst that fits is allowed at once
+	request.Burst = math.MaxInt64 / int64(6*time.Second)
+	if err := request.validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, result, err := callback(nil, request.params(time.Now())); err != nil || !result.allowed {
+		t.Errorf("Expected the request to be allowed, got %+v, error: %v", result, err)
+	}
+}
+
+func TestLeakyBucketSubNanosecondSpacing(t *testing.T) {
+	// 2000 requests a microsecond would be let out with no delay at all
+	request := Request{Algorithm: LeakyBucket, Capacity: 2000, Interval: 1, Unit: "us"}
+	if err := request.validate(); !errors.Is(err, errInvalidCapacity) {
+		t.Errorf("Expected errInvalidCapacity, got %v", err)
+	}
+	if _, _, err := callback(nil, request.params(time.Now())); !errors.Is(err, errInvalidCapacity) {
+		t.Errorf("Expected errInvalidCapacity, got %v", err)
+	}
+
+	// Such data stored before it was refused has nothing available rather than dividing by zero
+	d := &Data{algorithm: LeakyBucket, capacity: 2000, interval: 1, unit: "us", queueDepth: 10, expiresAt: time.Now()}
+	if available := d.available(time.Now()); available != 0 {
+		t.Errorf("Expected nothing available, got %d", available)
+	}
+	if _, err := d.credit(1, time.Now()); !errors.Is(err, errInvalidCapacity) {
+		t.Errorf("Expected errInvalidCapacity, got %v", err)
+	}
+}
+
+func TestLeakyBucketQueueOverflow(t *testing.T) {
+	// A queue of 2e9 requests 6 seconds apart would delay the last further than a time.Duration reaches
+	request := Request{Algorithm: LeakyBucket, Capacity: 10, Interval: 60, Unit: "s", QueueDepth: 2e9}
+	if err := request.validate(); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected ErrInvalidRequest, got %v", err)
+	}
+	if _, _, err := callback(nil, request.params(time.Now())); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected ErrInvalidRequest, got %v", err)
+	}
+
+	// The deepest queue that fits is allowed to fill
+	request.QueueDepth = math.MaxInt64 / int64(6*time.Second)
+	if err := request.validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, result, err := callback(nil, request.params(time.Now())); err != nil || !result.allowed {
+		t.Errorf("Expected the request to be allowed, got %+v, error: %v", result, err)
+	}
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	for _, algorithm := range []Algorithm{TokenBucket, SlidingLog, SlidingWindow, GCRA, LeakyBucket} {
+		if parsed, err := ParseAlgorithm(algorithm.String()); err != nil || parsed != algorithm {
+			t.Errorf("Expected %v, got %v: %v", algorithm, parsed, err)
+		}
+	}
+
+	if parsed, err := ParseAlgorithm(""); err != nil || parsed != TokenBucket {
+		t.Errorf("Expected the default to be a token bucket, got %v: %v", parsed, err)
+	}
+	if _, err := ParseAlgorithm("fixed_window"); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("Expected ErrUnknownAlgorithm, got %v", err)
+	}
+}
+
+func TestDataCodec(t *testing.T) {
+	codec := dataCodec{}
+
+	for _, algorithm := range []Algorithm{TokenBucket, SlidingLog, SlidingWindow, GCRA, LeakyBucket} {
+		clock := newFakeClock(t)
+		clock.burst = 2
+		clock.queueDepth = 3
+		clock.at(0, algorithm, 5, 2)
+		clock.at(12*time.Second, algorithm, 5, 1)
+		clock.refund(1, "retried")
+
+		b, err := codec.Encode(clock.data)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		decoded, err := codec.Decode(b)
+		if err != nil {
+			t.Fatalf("Unexpected error decoding %v: %v", algorithm, err)
+		}
+
+		if decoded.algorithm != algorithm || decoded.unit != "s" || !decoded.expiresAt.Equal(clock.data.expiresAt) {
+			t.Errorf("Expected %+v, got %+v", clock.data, decoded)
+		}
+		if !slices.Equal(decoded.refunds, clock.data.refunds) {
+			t.Errorf("Expected %v to decode with refunds %v, got %v", algorithm, clock.data.refunds, decoded.refunds)
+		}
+		if available, expected := decoded.available(clock.now), clock.data.available(clock.now); available != expected {
+			t.Errorf("Expected %v to decode with %d requests available, got %d", algorithm, expected, available)
+		}
+
+		if _, err = codec.Decode(b[:len(b)-1]); !errors.Is(err, errDataTruncated) {
+			t.Errorf("Expected truncated %v data to be refused, got %v", algorithm, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// dataSize is the encoded size of Data, excluding the unit.
+const dataSize = 8 + 8 + 8 + 8 + 4
+
+// windowSize is the encoded size of a slidingWindow.
+const windowSize = 8 + 8 + 8
+
+var errDataTruncated = errors.New("encoded data is truncated")
+
+var errDataAlgorithm = errors.New("encoded data has an unknown algorithm")
+
+// dataCodec encodes Data for snapshots as its fixed-size fields in big-endian order, with the times
+// as Unix nanoseconds, followed by the unit. A nil *Data is encoded as no bytes at all.
+// Algorithms other than TokenBucket follow the unit with a zero byte, which no unit contains, the
+// algorithm as a byte and its state: the uvarint number of entries in a sliding log and their times,
+// each followed by its uvarint count, the start of a sliding window and its two counts, or the burst
+// of a GCRA or queue depth of a leaky bucket, whose theoretical arrival time is the expiry time. The
+// request IDs of the key's latest refunds come last, if it has any, as their uvarint number followed
+// by each ID's uvarint length and bytes. Token buckets without refunds are encoded as they were
+// before there were other algorithms.
+type dataCodec struct{}
+
+func (dataCodec) Encode(d *Data) ([]byte, error) {
+	if d == nil {
+		return []byte{}, nil
+	}
+
+	b := make([]byte, 0, dataSize+len(d.unit))
+	b = binary.BigEndian.AppendUint64(b, uint64(d.availableTokens))
+	b = binary.BigEndian.AppendUint64(b, uint64(d.lastRefilled.UnixNano()))
+	b = binary.BigEndian.AppendUint64(b, uint64(d.expiresAt.UnixNano()))
+	b = binary.BigEndian.AppendUint64(b, uint64(d.capacity))
+	b = binary.BigEndian.AppendUint32(b, uint32(d.interval))
+	b = append(b, d.unit...)
+
+	if d.algorithm != TokenBucket || len(d.refunds) > 0 {
+		b = append(b, 0, byte(d.algorithm))
+	}
+
+	switch d.algorithm {
+	case SlidingLog:
+		b = binary.AppendUvarint(b, uint64(len(d.log.entries)))
+		for _, entry := range d.log.entries {
+			b = binary.BigEndian.AppendUint64(b, uint64(entry.at.UnixNano()))
+			b = binary.AppendUvarint(b, uint64(entry.count))
+		}
+	case SlidingWindow:
+		b = binary.BigEndian.AppendUint64(b, uint64(d.window.start.UnixNano()))
+		b = binary.BigEndian.AppendUint64(b, uint64(d.window.previous))
+		b = binary.BigEndian.AppendUint64(b, uint64(d.window.current))
+	case GCRA:
+		b = binary.BigEndian.AppendUint64(b, uint64(d.burst))
+	case LeakyBucket:
+		b = binary.BigEndian.AppendUint64(b, uint64(d.queueDepth))
+	}
+
+	if len(d.refunds) > 0 {
+		b = binary.AppendUvarint(b, uint64(len(d.refunds)))
+		for _, id := range d.refunds {
+			b = binary.AppendUvarint(b, uint64(len(id)))
+			b = append(b, id...)
+		}
+	}
+
+	return b, nil
+}
+
+func (dataCodec) Decode(b []byte) (*Data, error) {
+	if len(b) == 0 {
+		return nil, nil //nolint:nilnil // a nil *Data is a valid value, see Encode
+	}
+
+	if len(b) < dataSize {
+		return nil, errDataTruncated
+	}
+
+	d := &Data{
+		availableTokens: int64(binary.BigEndian.Uint64(b[0:8])),
+		lastRefilled:    time.Unix(0, int64(binary.BigEndian.Uint64(b[8:16]))),
+		expiresAt:       time.Unix(0, int64(binary.BigEndian.Uint64(b[16:24]))),
+		capacity:        int64(binary.BigEndian.Uint64(b[24:32])),
+		interval:        int32(binary.BigEndian.Uint32(b[32:36])),
+	}
+
+	unit, state, found := bytes.Cut(b[dataSize:], []byte{0})
+	d.unit = string(unit)
+	if !found {
+		return d, nil
+	}
+
+	if len(state) == 0 {
+		return nil, errDataTruncated
+	}
+	d.algorithm, state = Algorithm(state[0]), state[1:]
+
+	switch d.algorithm {
+	case TokenBucket:
+		// A token bucket only has state when it remembers refunds
+	case SlidingLog:
+		log, rest, err := decodeLog(state)
+		if err != nil {
+			return nil, err
+		}
+		d.log, state = log, rest
+	case SlidingWindow:
+		if len(state) < windowSize {
+			return nil, errDataTruncated
+		}
+
+		d.window = &slidingWindow{
+			start:    time.Unix(0, int64(binary.BigEndian.Uint64(state[0:8]))),
+			previous: int64(binary.BigEndian.Uint64(state[8:16])),
+			current:  int64(binary.BigEndian.Uint64(state[16:24])),
+		}
+		state = state[windowSize:]
+	case GCRA, LeakyBucket:
+		if len(state) < 8 {
+			return nil, errDataTruncated
+		}
+
+		if d.algorithm == GCRA {
+			d.burst = int64(binary.BigEndian.Uint64(state))
+		} else {
+			d.queueDepth = int64(binary.BigEndian.Uint64(state))
+		}
+		state = state[8:]
+	default:
+		return nil, errDataAlgorithm
+	}
+
+	refunds, err := decodeRefunds(state)
+	if err != nil {
+		return nil, err
+	}
+	d.refunds = refunds
+
+	return d, nil
+}
+
+// decodeLog decodes the sliding log at the start of b and returns the rest.
+func decodeLog(b []byte) (*slidingLog, []byte, error) {
+	// Each entry takes at least a time and a byte of count
+	count, n := binary.Uvarint(b)
+	if n <= 0 || count > uint64(len(b)-n)/9 {
+		return nil, nil, errDataTruncated
+	}
+	b = b[n:]
+
+	log := &slidingLog{entries: make([]logEntry, 0, count)}
+	for i := uint64(0); i < count; i++ {
+		if len(b) < 8 {
+			return nil, nil, errDataTruncated
+		}
+		at := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+
+		tokens, n := binary.Uvarint(b[8:])
+		if n <= 0 {
+			return nil, nil, errDataTruncated
+		}
+		log.entries = append(log.entries, logEntry{at: at, count: int64(tokens)})
+		b = b[8+n:]
+	}
+
+	return log, b, nil
+}
+
+// decodeRefunds decodes the request IDs of the refunds that end the encoded data, if there are any.
+func decodeRefunds(b []byte) ([]string, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	count, n := binary.Uvarint(b)
+	if n <= 0 || count > uint64(len(b)-n) {
+		return nil, errDataTruncated
+	}
+	b = b[n:]
+
+	refunds := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		length, n := binary.Uvarint(b)
+		if n <= 0 || length > uint64(len(b)-n) {
+			return nil, errDataTruncated
+		}
+
+		refunds = append(refunds, string(b[n:n+int(length)]))
+		b = b[n+int(length):]
+	}
+
+	if len(b) > 0 {
+		return nil, errDataTruncated
+	}
+	return refunds, nil
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/dominicfollett/argus-db/database/admission"
+)
+
+// ErrInvalidRefund is returned by Refund for a refund of fewer than one token, or with a request ID
+// longer than MaxRequestIDLength.
+var ErrInvalidRefund = errors.New("invalid refund")
+
+// errNoKey is returned by the refund callback for a key that no longer exists, so that the database
+// stores nothing rather than bring the key back empty.
+var errNoKey = errors.New("no such key")
+
+// MaxRequestIDLength is the longest request ID a refund may have.
+const MaxRequestIDLength = 128
+
+// refundMemory is the number of refund request IDs a key remembers. A refund retried after as many
+// newer refunds of the same key is credited again.
+const refundMemory = 16
+
+// Refund gives n tokens back to the key, up to its capacity, e.g. when the work they were consumed
+// for failed before it started. A refund with a request ID is only credited once, however often it
+// is retried. The boolean is false if the key is unknown, as it would be as good as new anyway.
+func (s *Service) Refund(ctx context.Context, key string, n int64, requestID string) (bool, error) {
+	if n < 1 || len(requestID) > MaxRequestIDLength {
+		return false, fmt.Errorf("%w: %d tokens with a request ID of %d bytes", ErrInvalidRefund, n, len(requestID))
+	}
+
+	// Don't create a key only to refund it
+	if _, ok, err := s.database.Peek(key); err != nil || !ok {
+		if err != nil {
+			s.logger.Error("could not peek rate limit", "error", err)
+		}
+		return false, err
+	}
+
+	result, err := s.database.Calculate(ctx, key, &Params{refund: true, cost: n, requestID: requestID, now: time.Now()})
+	if errors.Is(err, errNoKey) || errors.Is(err, admission.ErrFull) {
+		// The key expired or was evicted meanwhile
+		return false, nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			s.logger.Warn("gave up refunding rate limit", "error", err)
+		} else {
+			s.logger.Error("could not refund rate limit", "error", err)
+		}
+		return false, err
+	}
+
+	return result.allowed, nil
+}
+
+// refundCallback credits the key with the refund's tokens and remembers its request ID, unless the
+// refund was credited before. It returns errNoKey if the key does not exist.
+func refundCallback(current *Data, p *Params) (*Data, outcome, error) {
+	if current == nil {
+		// The key expired before the refund got to it, so there is nothing to give back
+		return nil, outcome{}, errNoKey
+	}
+
+	if p.requestID != "" && slices.Contains(current.refunds, p.requestID) {
+		return current, outcome{allowed: true}, nil
+	}
+
+	d, err := current.credit(p.cost, p.now)
+	if err != nil {
+		return nil, outcome{}, err
+	}
+
+	if p.requestID != "" {
+		// Copy the IDs, the stored data must not change
+		refunds := current.refunds[max(0, len(current.refunds)-refundMemory+1):]
+		d.refunds = append(append(make([]string, 0, len(refunds)+1), refunds...), p.requestID)
+	}
+
+	return d, outcome{allowed: true}, nil
+}
+
+// credit returns a copy of the data with n more requests available at now, up to its capacity, and
+// its expiry time moved forward to match.
+func (d *Data) credit(n int64, now time.Time) (*Data, error) {
+	c := *d
+
+	switch d.algorithm {
+	case SlidingLog, SlidingWindow:
+		length, err := windowLength(d.interval, d.unit)
+		if err != nil {
+			return nil, err
+		}
+
+		if d.algorithm == SlidingLog {
+			// Forget the newest requests' tokens, in a copy of the log as the stored data must not change
+			entries := slices.Clone(d.log.since(now.Add(-length)))
+			for n > 0 && len(entries) > 0 {
+				newest := &entries[len(entries)-1]
+				if newest.count > n {
+					newest.count -= n
+					break
+				}
+				n -= newest.count
+				entries = entries[:len(entries)-1]
+			}
+
+			c.log = &slidingLog{entries: entries}
+			c.expiresAt = now
+			if len(entries) > 0 {
+				c.expiresAt = entries[len(entries)-1].at.Add(length)
+			}
+		} else {
+			// Take the refund off the current window first, and off the previous one if need be
+			window := d.window.advance(now, length)
+			fromCurrent := min(n, window.current)
+			window.current -= fromCurrent
+			window.previous = max(0, window.previous-(n-fromCurrent))
+
+			c.window = &window
+			c.expiresAt = window.start.Add(2 * length)
+			if window.current == 0 && window.previous == 0 {
+				c.expiresAt = now
+			}
+		}
+	case GCRA, LeakyBucket:
+		limit := d.burst
+		if d.algorithm == LeakyBucket {
+			limit = d.queueDepth
+		}
+
+		emission, tolerance, err := spacing(d.capacity, d.interval, d.unit, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		// Move the theoretical arrival time back, but never behind now. It runs at most the tolerance
+		// ahead of now, so a larger refund is cut down to that before it can overflow.
+		n = min(n, int64(tolerance/emission))
+		c.expiresAt = d.arrival(d.algorithm, now).Add(-emission * time.Duration(n))
+		if c.expiresAt.Before(now) {
+			c.expiresAt = now
+		}
+	default:
+		refillRate, unit := c.refill(now)
+		c.availableTokens += min(n, c.capacity-c.availableTokens)
+		c.expiresAt = c.fullAt(now, refillRate, unit)
+	}
+
+	return &c, nil
+}
@@ -0,0 +1,105 @@
+//nolint:testpackage // Allow tests to drive the callbacks with a fake clock
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// refund refunds n tokens to the clock's key under the request ID, storing the data left behind.
+func (c *fakeClock) refund(n int64, requestID string) {
+	c.t.Helper()
+
+	data, result, err := callback(c.data, &Params{refund: true, cost: n, requestID: requestID, now: c.now})
+	if err != nil {
+		c.t.Fatalf("Unexpected error: %v", err)
+	}
+	c.data, c.last = data, result
+}
+
+func TestRefund(t *testing.T) {
+	for _, algorithm := range []Algorithm{TokenBucket, SlidingLog, SlidingWindow, GCRA, LeakyBucket} {
+		clock := newFakeClock(t)
+		clock.at(0, algorithm, 5, 5)
+
+		clock.refund(2, "first")
+		if available := clock.data.available(clock.now); !clock.last.allowed || available != 2 {
+			t.Errorf("Expected a %v to have 2 tokens refunded, got %d", algorithm, available)
+		}
+
+		// A retried refund is not credited again
+		clock.refund(2, "first")
+		if available := clock.data.available(clock.now); !clock.last.allowed || available != 2 {
+			t.Errorf("Expected a %v to credit a retried refund once, got %d tokens available", algorithm, available)
+		}
+
+		// The refunds survive the key's requests, and never credit more than the capacity
+		if allowed := clock.at(0, algorithm, 5, 1); allowed != 1 {
+			t.Errorf("Expected a %v to allow a refunded token to be used", algorithm)
+		}
+		clock.refund(2, "first")
+		clock.refund(10, "second")
+		if available := clock.data.available(clock.now); available != 5 {
+			t.Errorf("Expected a %v to be refunded up to its capacity of 5, got %d", algorithm, available)
+		}
+
+		// A full key expires at once, as it is as good as new
+		if !clock.data.expiresAt.Equal(clock.now) {
+			t.Errorf("Expected a full %v to expire at %v, got %v", algorithm, clock.now, clock.data.expiresAt)
+		}
+	}
+}
+
+func TestRefundExpiry(t *testing.T) {
+	// One token a second, of which 3 are refunded
+	clock := newFakeClock(t)
+	clock.at(0, TokenBucket, 10, 6)
+	clock.refund(3, "")
+
+	if expiresAt := clock.now.Add(3 * time.Second); !clock.data.expiresAt.Equal(expiresAt) {
+		t.Errorf("Expected the bucket to expire at %v, got %v", expiresAt, clock.data.expiresAt)
+	}
+
+	// There is nothing to refund to a key that expired before the refund got to it, nor to store
+	if _, _, err := callback(nil, &Params{refund: true, cost: 1, now: clock.now}); !errors.Is(err, errNoKey) {
+		t.Errorf("Expected errNoKey, got %v", err)
+	}
+}
+
+func TestRefundMemory(t *testing.T) {
+	clock := newFakeClock(t)
+	clock.at(0, TokenBucket, 100, 100)
+
+	for i := 0; i < refundMemory+1; i++ {
+		clock.refund(1, fmt.Sprintf("refund-%d", i))
+	}
+	if len(clock.data.refunds) != refundMemory || clock.data.refunds[0] != "refund-1" {
+		t.Fatalf("Expected the latest %d refunds to be remembered, got %v", refundMemory, clock.data.refunds)
+	}
+
+	// The oldest refund is forgotten, so its retry is credited again, unlike that of the latest
+	clock.refund(1, "refund-0")
+	clock.refund(1, fmt.Sprintf("refund-%d", refundMemory))
+	if available := clock.data.available(clock.now); available != refundMemory+2 {
+		t.Errorf("Expected %d tokens refunded, got %d", refundMemory+2, available)
+	}
+}
+
+func TestRefundOverflow(t *testing.T) {
+	for _, algorithm := range []Algorithm{TokenBucket, SlidingLog, SlidingWindow, GCRA, LeakyBucket} {
+		clock := newFakeClock(t)
+		clock.at(0, algorithm, 5, 4)
+
+		// The largest refund fills the key, rather than overflowing its tokens or arrival time
+		clock.refund(math.MaxInt64, "")
+		if available := clock.data.available(clock.now); available != 5 {
+			t.Errorf("Expected a %v to be refunded up to its capacity of 5, got %d", algorithm, available)
+		}
+		if !clock.data.expiresAt.Equal(clock.now) {
+			t.Errorf("Expected a full %v to expire at %v, got %v", algorithm, clock.now, clock.data.expiresAt)
+		}
+	}
+}
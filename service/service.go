@@ -3,28 +3,186 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/dominicfollett/argus-db/database"
+	"github.com/dominicfollett/argus-db/database/admission"
+	"github.com/dominicfollett/argus-db/database/wal"
 )
 
-// Shared Data structure stores the Token Bucket particulars.
+// ErrInvalidCost is returned for a request whose cost is negative, or more than its key could
+// ever allow at once.
+var ErrInvalidCost = errors.New("invalid cost")
+
+// ErrInvalidRequest is returned for a request with an unknown algorithm, an interval and unit that
+// do not make up a positive window, or a capacity its algorithm cannot limit by.
+var ErrInvalidRequest = errors.New("invalid request")
+
+// MaxKeyLength is the longest key a request may have, well within what a snapshot entry can hold.
+const MaxKeyLength = 1024
+
+// Shared Data structure stores the Token Bucket particulars, or the state of the key's other
+// algorithm.
+// Data is never mutated once stored: the callback returns a fresh copy, so values handed out by
+// the database can be read without holding any locks.
 type Data struct {
+	algorithm       Algorithm
 	availableTokens int64
 	lastRefilled    time.Time // Should this rather be a unix timestamp as int64?
 	expiresAt       time.Time
+	capacity        int64
+	interval        int32
+	unit            string
+	log             *slidingLog    // log is the state of a SlidingLog, nil for other algorithms.
+	window          *slidingWindow // window is the state of a SlidingWindow, nil for other algorithms.
+	burst           int64          // burst is the number of requests a GCRA allows at once.
+	queueDepth      int64          // queueDepth is the number of requests a LeakyBucket queues.
+	refunds         []string       // refunds holds the request IDs of the latest refunds, oldest first.
 }
 
 type Params struct {
-	capacity int64
-	interval int32
-	unit     string
+	algorithm  Algorithm
+	capacity   int64
+	interval   int32
+	unit       string
+	burst      int64
+	queueDepth int64
+	cost       int64     // cost is the number of tokens the request consumes, at least one.
+	now        time.Time // now is the time of the request.
+	refund     bool      // refund credits cost tokens back to the key instead, the rest being unused.
+	requestID  string    // requestID identifies a refund, so that it is only credited once.
+}
+
+// outcome is the result the callbacks hand back through the database.
+type outcome struct {
+	allowed    bool
+	retryAfter time.Duration // retryAfter is how long a denied request must wait, or zero if unknown.
+	delay      time.Duration // delay is how long an allowed request must wait for its turn.
+}
+
+// Request is a single rate limit check.
+type Request struct {
+	Key        string
+	Algorithm  Algorithm
+	Capacity   int64
+	Interval   int32
+	Unit       string
+	Burst      int64 // Burst is the number of requests a GCRA allows at once, Capacity if not positive.
+	QueueDepth int64 // QueueDepth is the number of requests a LeakyBucket queues, Capacity if not positive.
+	Cost       int64 // Cost is the number of tokens the request consumes, one if zero.
+}
+
+// Decision is the verdict on a single rate limit check.
+type Decision struct {
+	Result     string        // Result is "OK", "LIMITED" or "UNDETERMINED".
+	RetryAfter time.Duration // RetryAfter is how long a limited request must wait to be allowed, or zero if unknown.
+	Delay      time.Duration // Delay is how long an allowed request must wait for its turn, for a LeakyBucket.
+}
+
+// params returns the params of the request, made at now.
+func (r Request) params(now time.Time) *Params {
+	return &Params{
+		algorithm:  r.Algorithm,
+		capacity:   r.Capacity,
+		interval:   r.Interval,
+		unit:       r.Unit,
+		burst:      r.Burst,
+		queueDepth: r.QueueDepth,
+		cost:       max(r.Cost, 1),
+		now:        now,
+	}
+}
+
+// validate returns ErrInvalidRequest if the request's key is longer than MaxKeyLength, its
+// algorithm is unknown, its window is not positive or its capacity is negative, over
+// MaxSlidingLogCapacity for a SlidingLog, or cannot space the requests of a GCRA or LeakyBucket at
+// least a nanosecond apart, nor its burst or queue depth that far apart within a time.Duration. It
+// returns ErrInvalidCost if the request's cost is negative or more than its key allows at once: its
+// capacity, or the burst of a GCRA or queue depth of a LeakyBucket. A cost of one, the default, is
+// never refused, so a capacity of zero still limits every request of the others.
+func (r Request) validate() error {
+	if len(r.Key) > MaxKeyLength {
+		// Leave the key itself out of the error, it is written back to the client
+		return fmt.Errorf("%w: key of %d bytes is longer than %d", ErrInvalidRequest, len(r.Key), MaxKeyLength)
+	}
+	if r.Algorithm < TokenBucket || r.Algorithm > LeakyBucket {
+		return fmt.Errorf("%w: %v for %q", ErrInvalidRequest, r.Algorithm, r.Key)
+	}
+	if _, err := windowLength(r.Interval, r.Unit); err != nil {
+		return fmt.Errorf("%w for %q", err, r.Key)
+	}
+	if r.Capacity < 0 || (r.Algorithm == SlidingLog && r.Capacity > MaxSlidingLogCapacity) {
+		return fmt.Errorf("%w of %d for %q", errInvalidCapacity, r.Capacity, r.Key)
+	}
+
+	allowance := r.Capacity
+	switch {
+	case r.Algorithm == GCRA && r.Burst > 0:
+		allowance = r.Burst
+	case r.Algorithm == LeakyBucket && r.QueueDepth > 0:
+		allowance = r.QueueDepth
+	}
+
+	if r.Algorithm == GCRA || r.Algorithm == LeakyBucket {
+		if _, _, err := spacing(r.Capacity, r.Interval, r.Unit, allowance); err != nil {
+			return fmt.Errorf("%w for %q", err, r.Key)
+		}
+	}
+
+	if r.Cost < 0 || (r.Cost > 1 && r.Cost > allowance) {
+		return fmt.Errorf("%w: %d is more than the %d tokens %q can allow at once", ErrInvalidCost, r.Cost, allowance, r.Key)
+	}
+	return nil
+}
+
+// Status describes the state of a key's token bucket, or of its other algorithm, at a point in time.
+type Status struct {
+	Key             string
+	Algorithm       Algorithm
+	AvailableTokens int64 // AvailableTokens is the number of requests the key would allow now.
+	Capacity        int64
+	ResetsAt        time.Time // ResetsAt is when the bucket will be full again.
 }
 
 type Service struct {
-	database database.Database
-	logger   *slog.Logger
+	database    database.Database[*Data, *Params, outcome]
+	log         *wal.Log[*Data]
+	stopRoutine context.CancelFunc
+	wg          *sync.WaitGroup
+	logger      *slog.Logger
+}
+
+// options holds the optional Service settings.
+type options struct {
+	walDir          string
+	walOptions      []wal.Option
+	compactInterval time.Duration
+	engineOptions   []database.Option
+}
+
+// Option configures optional Service settings.
+type Option func(o *options)
+
+// WithWAL journals every change to a write-ahead log in dir, which is replayed when the service is
+// created, and compacts the log into a snapshot every compactInterval as well as on Shutdown. A
+// non-positive compactInterval leaves compaction to Shutdown.
+func WithWAL(dir string, compactInterval time.Duration, opts ...wal.Option) Option {
+	return func(o *options) {
+		o.walDir = dir
+		o.walOptions = opts
+		o.compactInterval = compactInterval
+	}
+}
+
+// WithEngineOptions passes the options to the database engine.
+func WithEngineOptions(opts ...database.Option) Option {
+	return func(o *options) {
+		o.engineOptions = append(o.engineOptions, opts...)
+	}
 }
 
 func min(a int64, b int64) int64 {
@@ -36,11 +194,8 @@ func min(a int64, b int64) int64 {
 
 // evict is a function passed to the database layer that determines when a node should be evicted
 // based on the data stored at that node.
-func evict(data any) bool {
-	d, ok := data.(*Data)
-
-	// Ideally we should log the fact that we can't cast the data
-	if !ok {
+func evict(d *Data) bool {
+	if d == nil {
 		return false
 	}
 
@@ -49,34 +204,42 @@ func evict(data any) bool {
 	return delta >= 0
 }
 
-// callback is the function that is passed to the database layer which is invoked on each insert to
-// the DB.
-func callback(data any, params any) (any, any, error) {
-	p, ok := params.(*Params)
-	if !ok {
-		return data, nil, errors.New("could not cast params")
+// expiresAt is passed to the database layer alongside evict, and returns when the record expires.
+func expiresAt(d *Data) time.Time {
+	if d == nil {
+		return time.Time{}
 	}
 
-	var d *Data
-	if data == nil {
-		d = &Data{
-			availableTokens: p.capacity,
-			lastRefilled:    time.Now(),
-		}
-	} else {
-		d, ok = data.(*Data)
-		if !ok {
-			return data, nil, errors.New("could not cast data")
-		}
+	return d.expiresAt
+}
+
+// Bytes returns the size of the data's sliding log and refund request IDs, which the database adds
+// to its fixed estimate of a record's size when it is bounded. The log's spare capacity counts too.
+func (d *Data) Bytes() int64 {
+	if d == nil {
+		return 0
+	}
+
+	var bytes int64
+	if d.log != nil {
+		bytes += int64(cap(d.log.entries)) * logEntryBytes
 	}
+	for _, id := range d.refunds {
+		bytes += int64(len(id))
+	}
+	return bytes
+}
 
-	refillRate := float64(p.capacity) / float64(p.interval)
-	elapsedTime := time.Since(d.lastRefilled)
+// refill credits the tokens accrued since the bucket was last refilled, up to its capacity. It
+// returns the refill rate and the unit of time the rate is expressed in.
+func (d *Data) refill(now time.Time) (float64, time.Duration) {
+	refillRate := float64(d.capacity) / float64(d.interval)
+	elapsedTime := now.Sub(d.lastRefilled)
 
 	var refillTokens float64
 	var unit time.Duration
 
-	switch p.unit {
+	switch d.unit {
 	case "s":
 		refillTokens = elapsedTime.Seconds() * refillRate
 		unit = time.Second
@@ -90,53 +253,364 @@ func callback(data any, params any) (any, any, error) {
 
 	// TODO: ideally we should cast this one time only
 	if int64(refillTokens) > 0 {
-		d.lastRefilled = time.Now()
-		d.availableTokens = min(p.capacity, d.availableTokens+int64(refillTokens))
+		d.lastRefilled = now
+		d.availableTokens = min(d.capacity, d.availableTokens+int64(refillTokens))
+	}
+
+	return refillRate, unit
+}
+
+// callback is the function that is passed to the database layer which is invoked on each insert to
+// the DB. It applies the algorithm the params ask for, starting afresh if the key's data was left
+// by another algorithm, or refunds the key, and never mutates the data it is given. The key's
+// latest refunds are remembered for as long as it keeps its algorithm.
+func callback(current *Data, p *Params) (*Data, outcome, error) {
+	if p.refund {
+		return refundCallback(current, p)
+	}
+
+	d, result, err := limitCallback(current, p)
+	if err == nil && current != nil && d.algorithm == current.algorithm {
+		d.refunds = current.refunds
+	}
+	return d, result, err
+}
+
+// limitCallback applies the algorithm the params ask for.
+func limitCallback(current *Data, p *Params) (*Data, outcome, error) {
+	switch p.algorithm {
+	case GCRA:
+		return gcraCallback(current, p)
+	case LeakyBucket:
+		return leakyBucketCallback(current, p)
+	case SlidingLog:
+		return slidingLogCallback(current, p)
+	case SlidingWindow:
+		return slidingWindowCallback(current, p)
+	default:
+		return tokenBucketCallback(current, p)
+	}
+}
+
+// tokenBucketCallback takes the request's cost in tokens from the key's bucket, if it has that many
+// left after refilling it. A request it cannot afford takes nothing.
+func tokenBucketCallback(current *Data, p *Params) (*Data, outcome, error) {
+	now := p.now
+
+	var d Data
+	if current == nil || current.algorithm != TokenBucket {
+		d = Data{
+			availableTokens: p.capacity,
+			lastRefilled:    now,
+		}
+	} else {
+		d = *current
 	}
 
-	allowed := d.availableTokens > 0
+	d.capacity = p.capacity
+	d.interval = p.interval
+	d.unit = p.unit
+
+	refillRate, unit := d.refill(now)
+
+	allowed := d.availableTokens >= p.cost
 	if allowed {
-		d.availableTokens--
+		d.availableTokens -= p.cost
 	}
 
+	// Set the record's expiry time
+	d.expiresAt = d.fullAt(now, refillRate, unit)
+
+	return &d, outcome{allowed: allowed}, nil
+}
+
+// fullAt returns when the bucket, refilled at now, will be full again at the refill rate and unit
+// returned by refill.
+func (d *Data) fullAt(now time.Time, refillRate float64, unit time.Duration) time.Time {
 	// If its 1000 tokens every 60 seconds: refillRate = 1000 / 60 == 16.666.. tokens/s
-	// replenish / refillRate == duration needed to replenish
-	replenish := p.capacity - d.availableTokens
+	// replenish / refillRate == duration needed to replenish, including every token of a cost
+	replenish := d.capacity - d.availableTokens
 	duration := time.Duration(float64(replenish)/refillRate) * unit
 
-	// Set the record's expiry time
-	d.expiresAt = time.Now().Add(duration)
-
-	return d, allowed, nil
+	return now.Add(duration)
 }
 
 func (s *Service) Shutdown() {
+	s.stopRoutine()
+	s.wg.Wait()
+
+	if s.log != nil {
+		if err := s.log.Compact(s.database.Snapshot); err != nil {
+			s.logger.Error("could not compact write-ahead log", "error", err)
+		}
+	}
+
 	s.database.Shutdown()
+
+	if s.log != nil {
+		if err := s.log.Close(); err != nil {
+			s.logger.Error("could not close write-ahead log", "error", err)
+		}
+	}
 }
 
-func NewLimiterService(engine string, logger *slog.Logger) *Service {
-	return &Service{
-		database: database.NewDatabase(engine, callback, evict, logger),
-		logger:   logger,
+func NewLimiterService(engine string, logger *slog.Logger, opts ...Option) (*Service, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
 	}
+
+	var log *wal.Log[*Data]
+	var journal wal.Journal[*Data]
+	if o.walDir != "" {
+		var err error
+		if log, err = wal.Open[*Data](o.walDir, dataCodec{}, logger, o.walOptions...); err != nil {
+			return nil, err
+		}
+		journal = log
+	}
+
+	db, err := database.NewDatabase(engine, callback, evict, expiresAt, dataCodec{}, journal, logger, o.engineOptions...)
+	if err != nil {
+		if log != nil {
+			log.Close()
+		}
+		return nil, err
+	}
+
+	if log != nil {
+		if err = log.Replay(db.Restore); err != nil {
+			db.Shutdown()
+			log.Close()
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Service{
+		database:    db,
+		log:         log,
+		stopRoutine: cancel,
+		wg:          &sync.WaitGroup{},
+		logger:      logger,
+	}
+
+	if log != nil && o.compactInterval > 0 {
+		s.wg.Add(1)
+		go s.compact(ctx, o.compactInterval)
+	}
+
+	return s, nil
 }
 
-func (s *Service) Limit(ctx context.Context, key string, capacity int64, interval int32, unit string) (string, error) {
-	select {
-	case <-ctx.Done():
-		return "", errors.New("request canceled")
-	default:
-		result, err := s.database.Calculate(key, &Params{capacity, interval, unit})
+// compact folds the write-ahead log into a snapshot every interval until the context is done.
+func (s *Service) compact(ctx context.Context, interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.log.Compact(s.database.Snapshot); err != nil {
+				s.logger.Error("could not compact write-ahead log", "error", err)
+			}
+		}
+	}
+}
+
+// Limit checks the request against its key's rate limit, using the algorithm it asks for.
+func (s *Service) Limit(ctx context.Context, r Request) (Decision, error) {
+	if err := r.validate(); err != nil {
+		return Decision{Result: "UNDETERMINED"}, err
+	}
 
-		if err != nil {
+	result, err := s.database.Calculate(ctx, r.Key, r.params(time.Now()))
+	if errors.Is(err, admission.ErrFull) {
+		s.logger.Debug("no room for a new key, request limited", "key", r.Key)
+		return Decision{Result: "LIMITED"}, nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			s.logger.Warn("gave up calculating rate limit", "error", err)
+		} else {
 			s.logger.Error("could not calculate rate limit", "error", err)
-			return "UNDETERMINED", err
 		}
+		return Decision{Result: "UNDETERMINED"}, err
+	}
+
+	if result.allowed {
+		return Decision{Result: "OK", Delay: result.delay}, nil
+	}
+	return Decision{Result: "LIMITED", RetryAfter: result.retryAfter}, nil
+}
+
+// LimitMany checks several rate limits at once. It returns the result of each request and the
+// overall verdict, which is only "OK" if every request is allowed. In all-or-nothing mode tokens are
+// only consumed when the verdict is "OK"; otherwise each request consumes its token independently.
+func (s *Service) LimitMany(ctx context.Context, requests []Request, allOrNothing bool) ([]string, string, error) {
+	now := time.Now()
+	keys := make([]string, 0, len(requests))
+	params := make([]*Params, 0, len(requests))
+	for _, r := range requests {
+		if err := r.validate(); err != nil {
+			return nil, "UNDETERMINED", err
+		}
+
+		keys = append(keys, r.Key)
+		params = append(params, r.params(now))
+	}
+
+	var commit func(results []outcome) bool
+	if allOrNothing {
+		commit = allAllowed
+	}
+
+	allowed, _, err := s.database.CalculateMany(ctx, keys, params, commit)
+	if errors.Is(err, admission.ErrFull) {
+		// A new key that was denied limits the whole batch. Without all-or-nothing the requests
+		// before it keep their results, as they have consumed their tokens, and the rest are limited.
+		s.logger.Debug("no room for a new key, requests limited", "error", err)
+		if allOrNothing {
+			allowed = nil
+		}
+		allowed = append(allowed, make([]outcome, len(requests)-len(allowed))...)
+		err = nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			s.logger.Warn("gave up calculating rate limits", "error", err)
+		} else {
+			s.logger.Error("could not calculate rate limits", "error", err)
+		}
+		return nil, "UNDETERMINED", err
+	}
 
-		if result.(bool) {
-			return "OK", nil
+	results := make([]string, 0, len(allowed))
+	for _, result := range allowed {
+		if result.allowed {
+			results = append(results, "OK")
 		} else {
-			return "LIMITED", nil
+			results = append(results, "LIMITED")
+		}
+	}
+
+	if allAllowed(allowed) {
+		return results, "OK", nil
+	}
+	return results, "LIMITED", nil
+}
+
+// allAllowed reports whether every result allows its request.
+func allAllowed(results []outcome) bool {
+	for _, result := range results {
+		if !result.allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// Status reports the state of the key's bucket, including tokens refilled since the last request,
+// without consuming a token. The boolean is false if the key is unknown.
+func (s *Service) Status(key string) (*Status, bool, error) {
+	current, ok, err := s.database.Peek(key)
+	if err != nil {
+		s.logger.Error("could not peek rate limit", "error", err)
+		return nil, false, err
+	}
+
+	if !ok || current == nil {
+		return nil, false, nil
+	}
+
+	return newStatus(key, current, time.Now()), true, nil
+}
+
+// Keys returns the status of up to limit keys starting with prefix, in ascending key order.
+func (s *Service) Keys(ctx context.Context, prefix string, limit int) ([]*Status, error) {
+	now := time.Now()
+	statuses := []*Status{}
+
+	err := s.database.ScanPrefix(ctx, prefix, limit, func(key string, d *Data) bool {
+		if d != nil {
+			statuses = append(statuses, newStatus(key, d, now))
+		}
+		return true
+	})
+	if err != nil {
+		s.logger.Error("could not scan rate limits", "error", err)
+		return nil, err
+	}
+
+	return statuses, nil
+}
+
+// KeysInRange returns the status of up to limit keys in the range [start, end), in ascending key
+// order. An empty end leaves the range unbounded above.
+func (s *Service) KeysInRange(ctx context.Context, start string, end string, limit int) ([]*Status, error) {
+	now := time.Now()
+	statuses := []*Status{}
+
+	err := s.database.Scan(ctx, start, end, limit, func(key string, d *Data) bool {
+		if d != nil {
+			statuses = append(statuses, newStatus(key, d, now))
 		}
+		return true
+	})
+	if err != nil {
+		s.logger.Error("could not scan rate limits", "error", err)
+		return nil, err
+	}
+
+	return statuses, nil
+}
+
+// newStatus describes the bucket as it stands at the given time, including tokens refilled since
+// the last request.
+func newStatus(key string, current *Data, now time.Time) *Status {
+	return &Status{
+		Key:             key,
+		Algorithm:       current.algorithm,
+		AvailableTokens: current.available(now),
+		Capacity:        current.capacity,
+		ResetsAt:        current.expiresAt,
+	}
+}
+
+// Reset forgets everything about the key, so its next request starts with a full bucket. The
+// boolean is false if the key was unknown.
+func (s *Service) Reset(key string) (bool, error) {
+	deleted, err := s.database.Delete(key)
+	if err != nil {
+		s.logger.Error("could not reset rate limit", "error", err)
+		return false, err
+	}
+
+	return deleted, nil
+}
+
+// Snapshot writes the state of every bucket to w, so that it can be restored after a restart.
+func (s *Service) Snapshot(w io.Writer) error {
+	if err := s.database.Snapshot(w); err != nil {
+		s.logger.Error("could not snapshot rate limits", "error", err)
+		return err
 	}
+
+	return nil
+}
+
+// Restore replaces the state of every bucket with a snapshot written by Snapshot. Buckets that
+// expired in the meantime are left out, as they would be full again anyway.
+func (s *Service) Restore(r io.Reader) error {
+	if err := s.database.Restore(r); err != nil {
+		s.logger.Error("could not restore rate limits", "error", err)
+		return err
+	}
+
+	return nil
 }